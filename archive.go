@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/arcticfoxnv/oolong/tsdb"
+	"github.com/arcticfoxnv/oolong/wirelesstag"
+	log "github.com/sirupsen/logrus"
+)
+
+// Archive is a sink which appends readings to local files, one per day.
+// Readings already in a day's file are skipped, so retries, backfills and
+// migrations don't store them twice.
+type Archive struct {
+	directory string
+	format    string
+
+	// Day (YYYY-MM-DD) of the currently open file
+	day    string
+	file   *os.File
+	writer RecordWriter
+	// Readings in the currently open file, by archiveKey
+	stored map[string]bool
+}
+
+// archiveKey identifies a reading in an archive.  Timestamps are only kept to
+// the second in CSV, which is all the API returns anyway.
+func archiveKey(uuid, stat string, timestamp time.Time) string {
+	return fmt.Sprintf("%s/%s/%d", uuid, stat, timestamp.Unix())
+}
+
+// NewArchive creates a file sink writing to directory.  Only formats that can
+// be appended to are supported, since a day's file is reopened after restarts
+// and whenever older readings are backfilled.
+func NewArchive(directory, format string) (*Archive, error) {
+	if format != "csv" && format != "jsonl" {
+		return nil, fmt.Errorf("Unsupported archive format %s", format)
+	}
+
+	err := os.MkdirAll(directory, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Archive{
+		directory: directory,
+		format:    format,
+	}, nil
+}
+
+// Filename returns the path of the file holding readings for the given day.
+func (a *Archive) Filename(day string) string {
+	return filepath.Join(a.directory, fmt.Sprintf("oolong-%s.%s", day, exportExtensions[a.format]))
+}
+
+// rotate makes sure the file for day is the one currently open.
+func (a *Archive) rotate(day string) error {
+	if a.file != nil && a.day == day {
+		return nil
+	}
+
+	err := a.Close()
+	if err != nil {
+		return err
+	}
+
+	stored, err := a.readStored(day)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(a.Filename(day), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	// Only new files get a header
+	writer, err := NewRecordWriter(file, a.format, info.Size() == 0)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	a.day = day
+	a.file = file
+	a.writer = writer
+	a.stored = stored
+	return nil
+}
+
+// readStored returns the keys of the readings already in the file for day.
+// An incomplete last line, left by a crash while appending, is removed so
+// that the next reading isn't appended to it.
+func (a *Archive) readStored(day string) (map[string]bool, error) {
+	stored := make(map[string]bool)
+	filename := a.Filename(day)
+	records, complete, err := a.readFile(filename)
+	if os.IsNotExist(err) {
+		return stored, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if complete >= 0 {
+		err = os.Truncate(filename, complete)
+		if err != nil {
+			return nil, err
+		}
+		log.WithField("filename", filename).Warn("Removed an incomplete line from the end of the archive")
+	}
+	for _, record := range records {
+		stored[archiveKey(record.UUID, record.Stat, record.Timestamp)] = true
+	}
+	return stored, nil
+}
+
+// readFile reads the records in an archive file.  If the last line is
+// incomplete or can't be read, the records before it are returned along with
+// the length of the file without it.  Otherwise the length is -1.
+func (a *Archive) readFile(filename string) ([]ExportRecord, int64, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, -1, err
+	}
+	records, err := ReadRecords(bytes.NewReader(data), a.format)
+	if err == nil && (len(data) == 0 || data[len(data)-1] == '\n') {
+		return records, -1, nil
+	}
+
+	complete := bytes.LastIndexByte(bytes.TrimSuffix(data, []byte("\n")), '\n') + 1
+	records, err = ReadRecords(bytes.NewReader(data[:complete]), a.format)
+	if err != nil {
+		return nil, -1, fmt.Errorf("Unable to read %s: %w", filename, err)
+	}
+	return records, int64(complete), nil
+}
+
+func (a *Archive) write(tag *wirelesstag.Tag, valueType string, reading wirelesstag.Reading) error {
+	err := a.rotate(reading.Timestamp.Format("2006-01-02"))
+	if err != nil {
+		return err
+	}
+	key := archiveKey(tag.UUID, valueType, reading.Timestamp)
+	if a.stored[key] {
+		return nil
+	}
+	err = a.writer.Write(NewExportRecord(tag, valueType, reading))
+	if err != nil {
+		return err
+	}
+	a.stored[key] = true
+	return nil
+}
+
+func (a *Archive) PutValue(tag *wirelesstag.Tag, valueType string, reading wirelesstag.Reading) error {
+	err := a.write(tag, valueType, reading)
+	if err != nil {
+		return err
+	}
+	return a.writer.Flush()
+}
+
+func (a *Archive) PutValues(tag *wirelesstag.Tag, valueType string, readings []wirelesstag.Reading) error {
+	if len(readings) == 0 {
+		return nil
+	}
+
+	for _, reading := range readings {
+		err := a.write(tag, valueType, reading)
+		if err != nil {
+			return err
+		}
+	}
+	return a.writer.Flush()
+}
+
+// Close flushes and closes the currently open file, if any.
+func (a *Archive) Close() error {
+	if a.file == nil {
+		return nil
+	}
+
+	err := a.writer.Close()
+	closeErr := a.file.Close()
+	a.file = nil
+	a.writer = nil
+	a.stored = nil
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// GetValues reads back the files for each day between from and to.  Days
+// without a file are skipped, as are any readings stored more than once by
+// older versions.
+func (a *Archive) GetValues(ctx context.Context, valueType string, from, to time.Time) ([]tsdb.Series, error) {
+	// Make sure anything buffered for the open file can be read
+	if a.writer != nil {
+		err := a.writer.Flush()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	series := []tsdb.Series{}
+	// uuid -> index in series
+	seriesIndex := make(map[string]int)
+	seen := make(map[string]bool)
+
+	startDay := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, from.Location())
+	for day := startDay; !day.After(to); day = day.AddDate(0, 0, 1) {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		records, _, err := a.readFile(a.Filename(day.Format("2006-01-02")))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, record := range records {
+			if record.Stat != valueType || record.Timestamp.Before(from) || record.Timestamp.After(to) {
+				continue
+			}
+			key := archiveKey(record.UUID, record.Stat, record.Timestamp)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			i, ok := seriesIndex[record.UUID]
+			if !ok {
+				i = len(series)
+				seriesIndex[record.UUID] = i
+				series = append(series, tsdb.Series{
+					Tag: wirelesstag.Tag{UUID: record.UUID, Name: record.Name},
+				})
+			}
+			series[i].Readings = append(series[i].Readings, wirelesstag.Reading{
+				Timestamp: record.Timestamp,
+				Value:     record.Value,
+			})
+		}
+	}
+
+	// Backfilled readings are appended after newer ones, so the files aren't
+	// necessarily in order.
+	for _, s := range series {
+		readings := s.Readings
+		sort.Slice(readings, func(i, j int) bool {
+			return readings[i].Timestamp.Before(readings[j].Timestamp)
+		})
+	}
+	return series, nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arcticfoxnv/oolong/wirelesstag"
+)
+
+func TestNewArchiveBadFormat(t *testing.T) {
+	a, err := NewArchive("archive", "parquet")
+	if err == nil {
+		t.Fail()
+	}
+	if a != nil {
+		t.Fail()
+	}
+}
+
+func TestArchivePutValues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oolong")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	a, err := NewArchive(dir, "csv")
+	if err != nil {
+		t.FailNow()
+	}
+
+	tag := &wirelesstag.Tag{Name: "tag1", UUID: "xxx-yyy-zzz"}
+	day1 := time.Date(2006, 1, 2, 23, 59, 0, 0, time.Local)
+	day2 := time.Date(2006, 1, 3, 0, 1, 0, 0, time.Local)
+	err = a.PutValues(tag, "temperature", []wirelesstag.Reading{
+		{Timestamp: day1, Value: 1},
+		{Timestamp: day2, Value: 2},
+	})
+	if err != nil {
+		t.Fail()
+	}
+	err = a.PutValue(tag, "temperature", wirelesstag.Reading{Timestamp: day2.Add(time.Minute), Value: 3})
+	if err != nil {
+		t.Fail()
+	}
+	a.Close()
+
+	// Each day should be in its own file, with one header
+	data, err := ioutil.ReadFile(a.Filename("2006-01-02"))
+	if err != nil {
+		t.FailNow()
+	}
+	if len(strings.Split(strings.TrimSpace(string(data)), "\n")) != 2 {
+		t.Fail()
+	}
+
+	data, err = ioutil.ReadFile(a.Filename("2006-01-03"))
+	if err != nil {
+		t.FailNow()
+	}
+	if len(strings.Split(strings.TrimSpace(string(data)), "\n")) != 3 {
+		t.Fail()
+	}
+}
+
+func TestArchiveAppend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oolong")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	tag := &wirelesstag.Tag{Name: "tag1", UUID: "xxx-yyy-zzz"}
+	day := time.Date(2006, 1, 2, 0, 0, 0, 0, time.Local)
+
+	// Simulate a restart between writes
+	for i := 0; i < 2; i++ {
+		a, err := NewArchive(dir, "csv")
+		if err != nil {
+			t.FailNow()
+		}
+		a.PutValue(tag, "temperature", wirelesstag.Reading{Timestamp: day.Add(time.Duration(i) * time.Minute), Value: 1})
+		a.Close()
+	}
+
+	data, err := ioutil.ReadFile(dir + "/oolong-2006-01-02.csv")
+	if err != nil {
+		t.FailNow()
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 {
+		t.Fail()
+	}
+	if strings.HasPrefix(lines[2], "timestamp") {
+		t.Fail()
+	}
+}
+
+func TestArchiveWriteDayTwice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oolong")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	tag := &wirelesstag.Tag{Name: "tag1", UUID: "xxx-yyy-zzz"}
+	day := time.Date(2006, 1, 2, 0, 0, 0, 0, time.Local)
+	readings := []wirelesstag.Reading{
+		{Timestamp: day.Add(time.Hour), Value: 1},
+		{Timestamp: day.Add(2 * time.Hour), Value: 2},
+	}
+
+	for _, format := range []string{"csv", "jsonl"} {
+		a, err := NewArchive(dir, format)
+		if err != nil {
+			t.FailNow()
+		}
+		// Again in the same run, e.g. a retry, then after a restart, e.g. a
+		// second migration
+		a.PutValues(tag, "temperature", readings)
+		a.PutValues(tag, "temperature", readings)
+		a.Close()
+		a, _ = NewArchive(dir, format)
+		a.PutValues(tag, "temperature", readings)
+		a.PutValue(tag, "humidity", readings[0])
+
+		series, err := a.GetValues(context.Background(), "temperature", day, day.AddDate(0, 0, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(series) != 1 || len(series[0].Readings) != 2 {
+			t.Error(format, series)
+		}
+		a.Close()
+
+		file, err := os.Open(a.Filename("2006-01-02"))
+		if err != nil {
+			t.FailNow()
+		}
+		records, _ := ReadRecords(file, format)
+		file.Close()
+		if len(records) != 3 {
+			t.Error(format, records)
+		}
+	}
+}
+
+func TestArchiveIncompleteLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oolong")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	tag := &wirelesstag.Tag{Name: "tag1", UUID: "xxx-yyy-zzz"}
+	day := time.Date(2006, 1, 2, 0, 0, 0, 0, time.Local)
+
+	for _, format := range []string{"csv", "jsonl"} {
+		a, err := NewArchive(dir, format)
+		if err != nil {
+			t.FailNow()
+		}
+		a.PutValues(tag, "temperature", []wirelesstag.Reading{
+			{Timestamp: day.Add(time.Hour), Value: 1},
+			{Timestamp: day.Add(2 * time.Hour), Value: 2},
+		})
+		a.Close()
+
+		// Crashed part way through writing the second reading
+		filename := a.Filename("2006-01-02")
+		data, _ := ioutil.ReadFile(filename)
+		ioutil.WriteFile(filename, data[:len(data)-8], 0644)
+
+		a, _ = NewArchive(dir, format)
+		series, err := a.GetValues(context.Background(), "temperature", day, day.AddDate(0, 0, 1))
+		if err != nil || len(series) != 1 || len(series[0].Readings) != 1 {
+			t.Error(format, err, series)
+		}
+
+		// The incomplete line is removed before the next reading is written
+		err = a.PutValues(tag, "temperature", []wirelesstag.Reading{
+			{Timestamp: day.Add(2 * time.Hour), Value: 2},
+			{Timestamp: day.Add(3 * time.Hour), Value: 3},
+		})
+		if err != nil {
+			t.Error(format, err)
+		}
+		series, err = a.GetValues(context.Background(), "temperature", day, day.AddDate(0, 0, 1))
+		if err != nil || len(series) != 1 || len(series[0].Readings) != 3 {
+			t.Error(format, err, series)
+		}
+		a.Close()
+	}
+}
+
+func TestArchiveGetValuesDuplicates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oolong")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	// Written twice by an older version
+	a, _ := NewArchive(dir, "csv")
+	ioutil.WriteFile(a.Filename("2006-01-02"), []byte("timestamp,uuid,name,stat,value\n"+
+		"2006-01-02T01:00:00Z,xxx,tag1,temperature,1\n"+
+		"2006-01-02T01:00:00Z,xxx,tag1,temperature,1\n"), 0644)
+
+	day := time.Date(2006, 1, 2, 0, 0, 0, 0, time.UTC)
+	series, err := a.GetValues(context.Background(), "temperature", day, day.AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 1 || len(series[0].Readings) != 1 {
+		t.Error(series)
+	}
+}
+
+func TestArchiveGetValues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oolong")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	a, err := NewArchive(dir, "jsonl")
+	if err != nil {
+		t.FailNow()
+	}
+
+	tag := &wirelesstag.Tag{Name: "tag1", UUID: "xxx-yyy-zzz"}
+	day1 := time.Date(2006, 1, 2, 12, 0, 0, 0, time.Local)
+	day2 := day1.AddDate(0, 0, 1)
+	a.PutValues(tag, "temperature", []wirelesstag.Reading{{Timestamp: day2, Value: 2}})
+	// Backfilled after the newer reading
+	a.PutValues(tag, "temperature", []wirelesstag.Reading{{Timestamp: day1, Value: 1}})
+	a.PutValues(tag, "cap", []wirelesstag.Reading{{Timestamp: day1, Value: 50}})
+
+	series, err := a.GetValues(context.Background(), "temperature", day1.Add(-time.Hour), day2.Add(time.Hour))
+	if err != nil {
+		t.FailNow()
+	}
+	if len(series) != 1 || len(series[0].Readings) != 2 {
+		t.FailNow()
+	}
+	if series[0].Tag.UUID != tag.UUID || series[0].Readings[0].Value != 1 {
+		t.Fail()
+	}
+
+	// Readings outside of the range are skipped
+	series, err = a.GetValues(context.Background(), "temperature", day1.Add(time.Hour), day2.Add(time.Hour))
+	if err != nil {
+		t.FailNow()
+	}
+	if len(series[0].Readings) != 1 {
+		t.Fail()
+	}
+}
@@ -1,63 +1,120 @@
 package main
 
 import (
-	"log"
+	"context"
+	"fmt"
 	"time"
 
+	"github.com/arcticfoxnv/oolong/logging"
 	"github.com/arcticfoxnv/oolong/state"
 	"github.com/arcticfoxnv/oolong/tsdb"
 	"github.com/arcticfoxnv/oolong/wirelesstag"
+	"github.com/sirupsen/logrus"
 )
 
-func Backfill(config *Config, state state.State, tagClient wirelesstag.Client, tsdbClient tsdb.TSDB, date time.Time) {
+// Backfill fetches and stores every configured stat for all tags on a single
+// day.  A stat which fails to fetch or store doesn't stop the others, so the
+// report says which ones need backfilling again.  An error is only returned
+// if the backfill couldn't start.
+func Backfill(ctx context.Context, config *Config, state state.State, tagClient wirelesstag.Client, tsdbClient tsdb.TSDB, date time.Time) (*CycleReport, error) {
+	ctx = logging.WithFields(ctx, logrus.Fields{"date": date.Format("2006-01-02")})
+	log := logging.FromContext(ctx)
 
 	// Get tag list
-	log.Printf("Fetching list of tags...\n")
-	tags, err := GetTags(tagClient)
+	log.Info("Fetching list of tags")
+	tags, err := GetTags(ctx, tagClient)
 	if err != nil {
-		log.Fatalf("Failed to load tags: %s\n", err.Error())
+		return nil, fmt.Errorf("Failed to load tags: %w", err)
 	}
 
-	// Extract ids for use later
-	var tagIds []int
-	for _, t := range tags {
-		tagIds = append(tagIds, t.SlaveId)
+	// Some sinks keep tag and tag manager details as well as readings
+	err = StoreTagMetadata(ctx, tagClient, tsdbClient)
+	if err != nil {
+		log.WithError(err).Warn("Failed to store tag metadata")
 	}
 
-	for _, queryType := range config.QueryStats {
-		stats, err := GetStats(tagClient, queryType, tagIds, date, date)
-		if err != nil {
-			// TODO: Maybe this shouldn't be fatal anymore?  Now that we record
-			// the last successful reading, the next successful call will read
-			// anything a failed call should have.
-			log.Fatalf("Failed to load raw %s stats: %s\n", queryType, err.Error())
-		}
-		log.Printf("Fetched %s stats for %d tags\n", queryType, len(stats))
+	groups, err := GroupTagsByLocation(config, tags)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid time zone: %w", err)
+	}
 
-		// Iterate through each returned stat (one stat per tag)
-		for _, stat := range stats {
-			// Stats return tags by SlaveId, but we store tags in state/datastore
-			// by UUID.
-			tag := GetTagBySlaveId(tags, stat.SlaveId)
+	filter := NewSanityFilter(config.Filter)
+	report := &CycleReport{}
 
-			log.Printf("  * Fetched %d %s stats for tag %s (%d)", len(stat.Readings), queryType, tag.UUID, stat.SlaveId)
+	for _, queryType := range config.QueryStats {
+		for _, group := range groups {
+			var tagIds []int
+			for _, t := range group.Tags {
+				tagIds = append(tagIds, t.SlaveId)
+			}
 
-			// Process all of the remaining readings for this stat/tag
-			for _, reading := range stat.Readings {
+			// Once interrupted, the rest are reported as not fetched
+			if ctx.Err() != nil {
+				for _, tag := range group.Tags {
+					report.Results = append(report.Results, StatResult{Tag: tag, Stat: queryType, Err: ErrNotFetched})
+				}
+				continue
+			}
 
-				// Special handling for temperature - values are returned from
-				// the API in celsius, but for those unlucky few who grew up
-				// learning fahrenheit instead, convert to something we can read
-				if queryType == "temperature" && config.ConvertToF {
-					reading.Value = ConvertCToF(reading.Value)
+			// The same date in each tag manager's time zone.  Readings missed
+			// because of a failed call are left for the next backfill.
+			day := Day(date, group.Location)
+			report.Calls++
+			stats, err := GetStats(ctx, tagClient, queryType, tagIds, day, day, group.Location)
+			if err != nil {
+				log.WithField("stat", queryType).WithError(err).Error("Failed to load raw stats")
+				report.Failures = append(report.Failures, FetchFailure{Tags: group.Tags, Stats: []string{queryType}, Err: err})
+				for _, tag := range group.Tags {
+					report.Results = append(report.Results, StatResult{Tag: tag, Stat: queryType, Err: err})
 				}
+				continue
+			}
+			log.WithFields(logrus.Fields{"stat": queryType, "tags": len(stats)}).Info("Fetched stats")
 
-				// Store value in the data store
-				err := tsdbClient.PutValue(tag, queryType, reading)
-				if err != nil {
-					log.Fatalf("Failed to store value: %s\n", err.Error())
+			// Iterate through each returned stat (one stat per tag)
+			for _, stat := range withEmptyStats(stats, group.Tags) {
+				// Stats return tags by SlaveId, but we store tags in
+				// state/datastore by UUID.
+				tag := GetTagBySlaveId(tags, stat.SlaveId)
+				if tag == nil {
+					log.WithFields(logrus.Fields{"stat": queryType, "slave_id": stat.SlaveId}).Warn("Skipping stats for unknown tag")
+					continue
 				}
+				report.Results = append(report.Results, backfillStat(log, config, filter, tsdbClient, *tag, queryType, stat))
 			}
 		}
 	}
+
+	if ctx.Err() != nil {
+		log.Warn("Backfill interrupted")
+	}
+	return report, nil
+}
+
+// backfillStat filters the readings of a stat and stores them.
+func backfillStat(log logrus.FieldLogger, config *Config, filter *SanityFilter, tsdbClient tsdb.TSDB, tag wirelesstag.Tag, queryType string, stat wirelesstag.Stat) StatResult {
+	result := StatResult{Tag: tag, Stat: queryType}
+	log = log.WithFields(logrus.Fields{"tag": tag.UUID, "stat": queryType, "manager": tag.ManagerMac})
+	log.WithField("readings", len(stat.Readings)).Debug("Fetched readings")
+
+	// Drop readings which can't be right
+	var dropped []DroppedReading
+	stat.Readings, dropped = filter.Filter(queryType, stat.Readings)
+	result.Dropped = len(ReportDroppedReadings(log, dropped, time.Time{}))
+
+	// Special handling for temperature - values are returned from the API
+	// in celsius, but for those unlucky few who grew up learning fahrenheit
+	// instead, convert to something we can read
+	if queryType == "temperature" && config.ConvertToF {
+		ConvertReadingsCToF(stat.Readings)
+	}
+
+	// Store all of the readings for this stat/tag
+	result.Err = tsdb.PutValues(tsdbClient, &tag, queryType, stat.Readings)
+	if result.Err != nil {
+		log.WithError(result.Err).Error("Failed to store values")
+		return result
+	}
+	result.Stored = len(stat.Readings)
+	return result
 }
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
 	"testing"
+	"time"
 )
 
 func TestConfigFileGlobal(t *testing.T) {
@@ -17,6 +20,10 @@ func TestConfigFileGlobal(t *testing.T) {
 	if config.Backend == "" {
 		t.Fail()
 	}
+
+	if len(config.Sinks) == 0 {
+		t.Fail()
+	}
 }
 
 func TestConfigFileOAuth(t *testing.T) {
@@ -43,6 +50,10 @@ func TestConfigFileOpenTSDB(t *testing.T) {
 	if config.OpenTSDB.MetricsPrefix == "" {
 		t.Fail()
 	}
+
+	if config.OpenTSDB.Policy().BufferSize == 0 {
+		t.Fail()
+	}
 }
 
 func TestConfigFileFile(t *testing.T) {
@@ -66,3 +77,226 @@ func TestConfigFileRedis(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestConfigFilePostgres(t *testing.T) {
+	config := ReadConfigFile("oolong.toml.example")
+	if config.Postgres.DSN == "" {
+		t.Fail()
+	}
+}
+
+func TestConfigFileArchive(t *testing.T) {
+	config := ReadConfigFile("oolong.toml.example")
+	if config.Archive.Directory == "" {
+		t.Fail()
+	}
+
+	if config.Archive.Format == "" {
+		t.Fail()
+	}
+}
+
+func TestConfigFileAPI(t *testing.T) {
+	config := ReadConfigFile("oolong.toml.example")
+	options := config.API.ClientOptions()
+	if options.Timeout == 0 {
+		t.Fail()
+	}
+
+	if options.CallsPerMinute == 0 {
+		t.Fail()
+	}
+}
+
+func TestConfigFileAPIDefaults(t *testing.T) {
+	ioutil.WriteFile("test.toml", []byte("poll_interval = 300\n"), 0600)
+	defer os.Remove("test.toml")
+
+	config := ReadConfigFile("test.toml")
+	if config.API.Timeout == 0 || config.API.Retries == 0 {
+		t.Fail()
+	}
+}
+
+func TestConfigLocation(t *testing.T) {
+	config := &Config{
+		TimeZone:  "America/Denver",
+		TimeZones: map[string]string{"aa:bb": "Europe/London"},
+	}
+	loc, err := config.Location("aa:bb")
+	if err != nil || loc.String() != "Europe/London" {
+		t.Fail()
+	}
+	loc, err = config.Location("cc:dd")
+	if err != nil || loc.String() != "America/Denver" {
+		t.Fail()
+	}
+
+	config.TimeZone = ""
+	loc, _ = config.Location("cc:dd")
+	if loc != time.Local {
+		t.Fail()
+	}
+
+	config.TimeZone = "Mars/Olympus_Mons"
+	_, err = config.Location("cc:dd")
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func TestConfigFileFilter(t *testing.T) {
+	config := ReadConfigFile("oolong.toml.example")
+	if config.Filter.Ranges["temperature"].Max == 0 {
+		t.Fail()
+	}
+
+	if config.Filter.Spikes["temperature"] == 0 {
+		t.Fail()
+	}
+}
+
+func TestConfigFileMetrics(t *testing.T) {
+	config := ReadConfigFile("oolong.toml.example")
+	if config.Metrics.Listen == "" {
+		t.Fail()
+	}
+	if config.StaleAfter() != 900*time.Second {
+		t.Fail()
+	}
+}
+
+func TestConfigStaleAfter(t *testing.T) {
+	config := &Config{PollInterval: 60}
+	if config.StaleAfter() != 5*time.Minute {
+		t.Fail()
+	}
+
+	config.PollInterval = 600
+	if config.StaleAfter() != 30*time.Minute {
+		t.Fail()
+	}
+
+	// The longest gap between cron ticks counts instead
+	config.Schedule.Cron = []string{"*/5 7-22 * * *", "0 23,0-6 * * *"}
+	if config.StaleAfter() != 3*time.Hour {
+		t.Error(config.StaleAfter())
+	}
+}
+
+func TestConfigFileLog(t *testing.T) {
+	config := ReadConfigFile("oolong.toml.example")
+	if config.Log.Level != "info" || config.Log.Format != "text" {
+		t.Fail()
+	}
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+	environ := []string{
+		"OOLONG_POLL_INTERVAL=60",
+		"OOLONG_CONVERT_TO_F=false",
+		"OOLONG_SINKS=postgres, archive",
+		"OOLONG_OAUTH_SECRET=fromenv",
+		"OOLONG_OPENTSDB_RETRIES=5",
+		"OOLONG_FILTER_SPIKES={ temperature = 3 }",
+		"OOLONG_TIMEZONES={ \"aa:bb\" = \"Europe/London\" }",
+		"HOME=/root",
+	}
+	config, err := LoadConfig("oolong.toml.example", environ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.PollInterval != 60 || config.ConvertToF {
+		t.Fail()
+	}
+	if len(config.Sinks) != 2 || config.Sinks[1] != "archive" {
+		t.Fail()
+	}
+	if config.OAuth.Secret != "fromenv" || config.OAuth.ID != "x" {
+		t.Fail()
+	}
+	if config.OpenTSDB.Retries != 5 || config.OpenTSDB.Host != "localhost" {
+		t.Fail()
+	}
+	if len(config.Filter.Spikes) != 1 || config.Filter.Spikes["temperature"] != 3 {
+		t.Fail()
+	}
+	if config.TimeZones["aa:bb"] != "Europe/London" {
+		t.Fail()
+	}
+}
+
+func TestLoadConfigEnvOnly(t *testing.T) {
+	config, err := LoadConfig("", []string{"OOLONG_BACKEND=file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Backend != "file" || config.API.Timeout == 0 {
+		t.Fail()
+	}
+}
+
+func TestLoadConfigEnvInvalid(t *testing.T) {
+	_, err := LoadConfig("", []string{"OOLONG_POLL_INTERVAL=often"})
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func TestLoadConfigSecretFiles(t *testing.T) {
+	ioutil.WriteFile("test.secret", []byte("fromfile\n"), 0600)
+	defer os.Remove("test.secret")
+	ioutil.WriteFile("test.toml", []byte("[oauth]\nsecret_file = \"test.secret\"\n[redis]\npassword = \"pass\"\n"), 0600)
+	defer os.Remove("test.toml")
+
+	config, err := LoadConfig("test.toml", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.OAuth.Secret != "fromfile" || config.OAuth.SecretFile != "" {
+		t.Fail()
+	}
+
+	// The environment wins over the config file, whether it's a value or a
+	// file
+	config, err = LoadConfig("test.toml", []string{"OOLONG_OAUTH_SECRET=fromenv", "OOLONG_REDIS_PASSWORD_FILE=test.secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.OAuth.Secret != "fromenv" || config.Redis.Password != "fromfile" {
+		t.Fail()
+	}
+
+	_, err = LoadConfig("test.toml", []string{"OOLONG_OAUTH_ACCESS_TOKEN_FILE=missing.secret"})
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func TestRedisOptions(t *testing.T) {
+	config, err := LoadConfig("", []string{"OOLONG_REDIS_SENTINELS=s1:26379,s2:26379", "OOLONG_REDIS_MASTER_NAME=mymaster", "OOLONG_REDIS_DB=2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	options, err := config.Redis.Options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.Addr != "localhost:6379" || options.DB != 2 || options.MasterName != "mymaster" || len(options.Sentinels) != 2 || options.TLS != nil {
+		t.Error(options)
+	}
+
+	config.Redis.TLS = true
+	options, _ = config.Redis.Options()
+	if options.TLS == nil || options.TLS.ServerName != "localhost" {
+		t.Fail()
+	}
+
+	ioutil.WriteFile("test.pem", []byte("not a certificate"), 0600)
+	defer os.Remove("test.pem")
+	config.Redis.TLSCA = "test.pem"
+	_, err = config.Redis.Options()
+	if err == nil {
+		t.Fail()
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/arcticfoxnv/oolong/logging"
+	"github.com/arcticfoxnv/oolong/wirelesstag"
+	"github.com/sirupsen/logrus"
+	"github.com/xitongsys/parquet-go-source/writerfile"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// ExportRecord is a single reading, flattened with the details of the tag it
+// came from.
+type ExportRecord struct {
+	Timestamp time.Time `json:"timestamp"`
+	UUID      string    `json:"uuid"`
+	Name      string    `json:"name"`
+	Stat      string    `json:"stat"`
+	Value     float32   `json:"value"`
+}
+
+// RecordWriter writes records in one of the supported export formats.
+type RecordWriter interface {
+	Write(ExportRecord) error
+	// Flush writes any buffered records to the underlying writer
+	Flush() error
+	// Close flushes and finishes the output.  The underlying writer is not
+	// closed.
+	Close() error
+}
+
+var exportColumns = []string{"timestamp", "uuid", "name", "stat", "value"}
+
+// Extensions used for each of the supported formats
+var exportExtensions = map[string]string{
+	"csv":     "csv",
+	"jsonl":   "jsonl",
+	"parquet": "parquet",
+}
+
+// NewRecordWriter creates a writer for the named format.  header controls
+// whether a csv header row is written, and is ignored for other formats.
+func NewRecordWriter(w io.Writer, format string, header bool) (RecordWriter, error) {
+	switch format {
+	case "csv":
+		return newCSVRecordWriter(w, header)
+	case "jsonl":
+		return &jsonRecordWriter{encoder: json.NewEncoder(w)}, nil
+	case "parquet":
+		return newParquetRecordWriter(w)
+	}
+	return nil, fmt.Errorf("Unknown export format %s", format)
+}
+
+// ReadRecords reads back records written in csv or jsonl format.
+func ReadRecords(r io.Reader, format string) ([]ExportRecord, error) {
+	switch format {
+	case "csv":
+		return readCSVRecords(r)
+	case "jsonl":
+		return readJSONRecords(r)
+	}
+	return nil, fmt.Errorf("Unable to read %s records", format)
+}
+
+func NewExportRecord(tag *wirelesstag.Tag, valueType string, reading wirelesstag.Reading) ExportRecord {
+	return ExportRecord{
+		Timestamp: reading.Timestamp,
+		UUID:      tag.UUID,
+		Name:      tag.Name,
+		Stat:      valueType,
+		Value:     reading.Value,
+	}
+}
+
+type csvRecordWriter struct {
+	writer *csv.Writer
+}
+
+func newCSVRecordWriter(w io.Writer, header bool) (*csvRecordWriter, error) {
+	c := &csvRecordWriter{writer: csv.NewWriter(w)}
+	if header {
+		err := c.writer.Write(exportColumns)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *csvRecordWriter) Write(record ExportRecord) error {
+	return c.writer.Write([]string{
+		record.Timestamp.Format(time.RFC3339),
+		record.UUID,
+		record.Name,
+		record.Stat,
+		strconv.FormatFloat(float64(record.Value), 'f', -1, 32),
+	})
+}
+
+func (c *csvRecordWriter) Flush() error {
+	c.writer.Flush()
+	return c.writer.Error()
+}
+
+func (c *csvRecordWriter) Close() error {
+	return c.Flush()
+}
+
+func readCSVRecords(r io.Reader) ([]ExportRecord, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = len(exportColumns)
+
+	records := []ExportRecord{}
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if row[0] == exportColumns[0] {
+			continue
+		}
+
+		timestamp, err := time.Parse(time.RFC3339, row[0])
+		if err != nil {
+			return nil, err
+		}
+		value, err := strconv.ParseFloat(row[4], 32)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, ExportRecord{
+			Timestamp: timestamp,
+			UUID:      row[1],
+			Name:      row[2],
+			Stat:      row[3],
+			Value:     float32(value),
+		})
+	}
+	return records, nil
+}
+
+type jsonRecordWriter struct {
+	encoder *json.Encoder
+}
+
+// Encode writes the record followed by a newline, which is all json-lines needs.
+func (j *jsonRecordWriter) Write(record ExportRecord) error {
+	return j.encoder.Encode(record)
+}
+
+func (j *jsonRecordWriter) Flush() error {
+	return nil
+}
+
+func (j *jsonRecordWriter) Close() error {
+	return nil
+}
+
+func readJSONRecords(r io.Reader) ([]ExportRecord, error) {
+	records := []ExportRecord{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		record := ExportRecord{}
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// Parquet needs explicit column types, and stores timestamps as milliseconds.
+type parquetRecord struct {
+	Timestamp int64   `parquet:"name=timestamp, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	UUID      string  `parquet:"name=uuid, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Name      string  `parquet:"name=name, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Stat      string  `parquet:"name=stat, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Value     float32 `parquet:"name=value, type=FLOAT"`
+}
+
+type parquetRecordWriter struct {
+	writer *writer.ParquetWriter
+}
+
+func newParquetRecordWriter(w io.Writer) (*parquetRecordWriter, error) {
+	pw, err := writer.NewParquetWriter(writerfile.NewWriterFile(w), new(parquetRecord), 1)
+	if err != nil {
+		return nil, err
+	}
+	pw.CompressionType = parquet.CompressionCodec_SNAPPY
+	return &parquetRecordWriter{writer: pw}, nil
+}
+
+func (p *parquetRecordWriter) Write(record ExportRecord) error {
+	return p.writer.Write(parquetRecord{
+		Timestamp: record.Timestamp.UnixNano() / int64(time.Millisecond),
+		UUID:      record.UUID,
+		Name:      record.Name,
+		Stat:      record.Stat,
+		Value:     record.Value,
+	})
+}
+
+// Parquet files can't be read until the footer is written, so there's
+// nothing useful to flush part way through.
+func (p *parquetRecordWriter) Flush() error {
+	return nil
+}
+
+func (p *parquetRecordWriter) Close() error {
+	return p.writer.WriteStop()
+}
+
+// Export fetches every configured stat for all tags between from and to
+// (inclusive) and passes each reading to the record writer.
+func Export(ctx context.Context, config *Config, tagClient wirelesstag.Client, out RecordWriter, from, to time.Time) error {
+	log := logging.FromContext(ctx)
+
+	// Get tag list
+	log.Info("Fetching list of tags")
+	tags, err := GetTags(ctx, tagClient)
+	if err != nil {
+		return err
+	}
+
+	groups, err := GroupTagsByLocation(config, tags)
+	if err != nil {
+		return err
+	}
+
+	filter := NewSanityFilter(config.Filter)
+
+	// Fetch a day at a time, so exporting a large range doesn't turn into a
+	// single huge response from the API server.
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		for _, queryType := range config.QueryStats {
+			var stats []wirelesstag.Stat
+			for _, group := range groups {
+				var tagIds []int
+				for _, t := range group.Tags {
+					tagIds = append(tagIds, t.SlaveId)
+				}
+
+				// The same date in each tag manager's time zone
+				groupDay := Day(day, group.Location)
+				groupStats, err := GetStats(ctx, tagClient, queryType, tagIds, groupDay, groupDay, group.Location)
+				if err != nil {
+					return err
+				}
+				stats = append(stats, groupStats...)
+			}
+			log.WithFields(logrus.Fields{"stat": queryType, "tags": len(stats), "date": day.Format("2006-01-02")}).Info("Fetched stats")
+
+			for _, stat := range stats {
+				tag := GetTagBySlaveId(tags, stat.SlaveId)
+				if tag == nil {
+					log.WithFields(logrus.Fields{"stat": queryType, "slave_id": stat.SlaveId}).Warn("Skipping stats for unknown tag")
+					continue
+				}
+
+				// Drop readings which can't be right
+				var dropped []DroppedReading
+				stat.Readings, dropped = filter.Filter(queryType, stat.Readings)
+				ReportDroppedReadings(log.WithFields(logrus.Fields{"tag": tag.UUID, "stat": queryType}), dropped, time.Time{})
+
+				if queryType == "temperature" && config.ConvertToF {
+					ConvertReadingsCToF(stat.Readings)
+				}
+
+				for _, reading := range stat.Readings {
+					err := out.Write(NewExportRecord(tag, queryType, reading))
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+
+	return out.Close()
+}
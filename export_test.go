@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arcticfoxnv/oolong/wirelesstag"
+)
+
+var testExportRecord = ExportRecord{
+	Timestamp: time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC),
+	UUID:      "xxx-yyy-zzz",
+	Name:      "tag1",
+	Stat:      "temperature",
+	Value:     21.5,
+}
+
+func TestCSVRecordWriter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w, err := NewRecordWriter(buf, "csv", true)
+	if err != nil {
+		t.FailNow()
+	}
+	w.Write(testExportRecord)
+	w.Close()
+
+	expected := "timestamp,uuid,name,stat,value\n2006-01-02T15:04:05Z,xxx-yyy-zzz,tag1,temperature,21.5\n"
+	if buf.String() != expected {
+		t.Fail()
+	}
+}
+
+func TestCSVRecordWriterNoHeader(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w, err := NewRecordWriter(buf, "csv", false)
+	if err != nil {
+		t.FailNow()
+	}
+	w.Write(testExportRecord)
+	w.Close()
+
+	if strings.HasPrefix(buf.String(), "timestamp") {
+		t.Fail()
+	}
+}
+
+func TestJSONRecordWriter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w, err := NewRecordWriter(buf, "jsonl", true)
+	if err != nil {
+		t.FailNow()
+	}
+	w.Write(testExportRecord)
+	w.Write(testExportRecord)
+	w.Close()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.FailNow()
+	}
+
+	record := ExportRecord{}
+	err = json.Unmarshal([]byte(lines[0]), &record)
+	if err != nil {
+		t.FailNow()
+	}
+	if record.UUID != testExportRecord.UUID || record.Value != testExportRecord.Value {
+		t.Fail()
+	}
+}
+
+func TestParquetRecordWriter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w, err := NewRecordWriter(buf, "parquet", true)
+	if err != nil {
+		t.FailNow()
+	}
+	err = w.Write(testExportRecord)
+	if err != nil {
+		t.Fail()
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fail()
+	}
+
+	// Parquet files start and end with a magic number
+	if !bytes.HasPrefix(buf.Bytes(), []byte("PAR1")) {
+		t.Fail()
+	}
+}
+
+func TestNewRecordWriterBadFormat(t *testing.T) {
+	w, err := NewRecordWriter(new(bytes.Buffer), "xml", true)
+	if err == nil {
+		t.Fail()
+	}
+	if w != nil {
+		t.Fail()
+	}
+}
+
+func TestExport(t *testing.T) {
+	client := &DummyTagClient{
+		Stats: []wirelesstag.RawMultiStat{
+			{
+				Date:             "1/2/2006",
+				SlaveIds:         []int{0},
+				Values:           [][]float32{{1, 2}},
+				TimeOfDaySeconds: [][]int{{0, 5}},
+			},
+		},
+	}
+	config := &Config{QueryStats: []string{"temperature", "cap"}}
+
+	buf := new(bytes.Buffer)
+	w, _ := NewRecordWriter(buf, "csv", true)
+	day := time.Date(2006, 1, 2, 0, 0, 0, 0, time.Local)
+	err := Export(context.Background(), config, client, w, day, day)
+	if err != nil {
+		t.Fail()
+	}
+
+	// Header, plus two readings for each stat
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 5 {
+		t.Fail()
+	}
+}
+
+func TestReadRecords(t *testing.T) {
+	for _, format := range []string{"csv", "jsonl"} {
+		buf := new(bytes.Buffer)
+		w, _ := NewRecordWriter(buf, format, true)
+		w.Write(testExportRecord)
+		w.Close()
+
+		records, err := ReadRecords(buf, format)
+		if err != nil {
+			t.FailNow()
+		}
+		if len(records) != 1 {
+			t.FailNow()
+		}
+		if !records[0].Timestamp.Equal(testExportRecord.Timestamp) || records[0].Value != testExportRecord.Value {
+			t.Fail()
+		}
+	}
+}
+
+func TestReadRecordsBadData(t *testing.T) {
+	_, err := ReadRecords(strings.NewReader("garbage,1,2,3,4\n"), "csv")
+	if err == nil {
+		t.Fail()
+	}
+}
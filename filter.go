@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/arcticfoxnv/oolong/wirelesstag"
+)
+
+// Valid ranges for stats without one configured, in the units the API
+// returns.  The API uses values like -999 when a tag has no reading.
+var DefaultFilterRanges = map[string]FilterRange{
+	"temperature": {Min: -50, Max: 100},
+	"cap":         {Min: 0, Max: 100},
+	"batteryVolt": {Min: 0, Max: 5},
+}
+
+// Reasons readings are dropped
+const (
+	DropDuplicate  = "duplicate"
+	DropOutOfRange = "out of range"
+	DropSpike      = "spike"
+)
+
+// DroppedReading is a reading removed by the sanity filter.
+type DroppedReading struct {
+	wirelesstag.Reading
+	Reason string
+}
+
+func (d DroppedReading) String() string {
+	return fmt.Sprintf("%v at %s (%s)", d.Value, d.Timestamp.Format(time.RFC3339), d.Reason)
+}
+
+// SanityFilter removes readings which can't be right before they're stored.
+type SanityFilter struct {
+	ranges map[string]FilterRange
+	spikes map[string]float64
+}
+
+func NewSanityFilter(config FilterConfig) *SanityFilter {
+	f := &SanityFilter{
+		ranges: make(map[string]FilterRange),
+		spikes: config.Spikes,
+	}
+	for queryType, r := range DefaultFilterRanges {
+		f.ranges[queryType] = r
+	}
+	for queryType, r := range config.Ranges {
+		f.ranges[queryType] = r
+	}
+	return f
+}
+
+// Filter returns the readings of a stat in time order, without duplicate
+// timestamps, values outside the stat's range, or spikes.  A spike is a
+// reading that differs by more than the stat's spike threshold from the
+// readings either side, when those two agree with each other.  The newest
+// reading only has readings before it, so it's judged against the two before
+// it instead.  If that drops a genuine step change, the state isn't moved
+// past it, so it's judged again, and kept, once later readings arrive.  The
+// readings removed are returned as well.
+func (f *SanityFilter) Filter(queryType string, readings []wirelesstag.Reading) ([]wirelesstag.Reading, []DroppedReading) {
+	var dropped []DroppedReading
+
+	sorted := make([]wirelesstag.Reading, len(readings))
+	copy(sorted, readings)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Timestamp.Before(sorted[j].Timestamp)
+	})
+
+	// Duplicates and values out of range
+	valueRange, hasRange := f.ranges[queryType]
+	var valid []wirelesstag.Reading
+	for i, reading := range sorted {
+		if i > 0 && reading.Timestamp.Equal(sorted[i-1].Timestamp) {
+			dropped = append(dropped, DroppedReading{reading, DropDuplicate})
+			continue
+		}
+		value := float64(reading.Value)
+		if math.IsNaN(value) || (hasRange && (value < valueRange.Min || value > valueRange.Max)) {
+			dropped = append(dropped, DroppedReading{reading, DropOutOfRange})
+			continue
+		}
+		valid = append(valid, reading)
+	}
+
+	threshold := f.spikes[queryType]
+	if threshold <= 0 || len(valid) < 3 {
+		return valid, dropped
+	}
+
+	// Spikes.  The first reading can't be judged, having nothing before it,
+	// but it's the oldest fetched, so usually stored already.
+	filtered := []wirelesstag.Reading{valid[0]}
+	last := len(valid) - 1
+	for i := 1; i <= last; i++ {
+		a, b := i-1, i+1
+		if i == last {
+			a, b = i-1, i-2
+		}
+		if isSpike(float64(valid[i].Value), float64(valid[a].Value), float64(valid[b].Value), threshold) {
+			dropped = append(dropped, DroppedReading{valid[i], DropSpike})
+			continue
+		}
+		filtered = append(filtered, valid[i])
+	}
+
+	return filtered, dropped
+}
+
+// isSpike returns whether value is more than threshold from both of its
+// neighbours, which are within threshold of each other.
+func isSpike(value, a, b, threshold float64) bool {
+	return math.Abs(value-a) > threshold && math.Abs(value-b) > threshold && math.Abs(a-b) <= threshold
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/arcticfoxnv/oolong/wirelesstag"
+)
+
+// Returns a reading for each value, a minute apart
+func filterTestReadings(values ...float32) []wirelesstag.Reading {
+	start := time.Date(2006, 1, 2, 15, 0, 0, 0, time.UTC)
+	var readings []wirelesstag.Reading
+	for i, value := range values {
+		readings = append(readings, wirelesstag.Reading{
+			Timestamp: start.Add(time.Duration(i) * time.Minute),
+			Value:     value,
+		})
+	}
+	return readings
+}
+
+func TestSanityFilterRange(t *testing.T) {
+	filter := NewSanityFilter(FilterConfig{})
+	readings, dropped := filter.Filter("temperature", filterTestReadings(20, -999, 21))
+	if len(readings) != 2 || len(dropped) != 1 {
+		t.FailNow()
+	}
+	if dropped[0].Value != -999 || dropped[0].Reason != DropOutOfRange {
+		t.Fail()
+	}
+
+	// Humidity can't be over 100%
+	_, dropped = filter.Filter("cap", filterTestReadings(50, 101))
+	if len(dropped) != 1 {
+		t.Fail()
+	}
+
+	// Stats without a range are left alone
+	readings, _ = filter.Filter("light", filterTestReadings(-999, 1e6))
+	if len(readings) != 2 {
+		t.Fail()
+	}
+}
+
+func TestSanityFilterConfiguredRange(t *testing.T) {
+	filter := NewSanityFilter(FilterConfig{
+		Ranges: map[string]FilterRange{"temperature": {Min: 0, Max: 30}},
+	})
+	readings, _ := filter.Filter("temperature", filterTestReadings(-5, 20, 35))
+	if len(readings) != 1 || readings[0].Value != 20 {
+		t.Fail()
+	}
+}
+
+func TestSanityFilterDuplicates(t *testing.T) {
+	filter := NewSanityFilter(FilterConfig{})
+	input := filterTestReadings(20, 21, 22)
+	input = append(input, input[1])
+	input[3].Value = 30
+
+	readings, dropped := filter.Filter("temperature", input)
+	if len(readings) != 3 || len(dropped) != 1 {
+		t.FailNow()
+	}
+	// The first reading with the timestamp is kept, and order is restored
+	if readings[1].Value != 21 || dropped[0].Reason != DropDuplicate {
+		t.Fail()
+	}
+	if !readings[2].Timestamp.After(readings[1].Timestamp) {
+		t.Fail()
+	}
+}
+
+func TestSanityFilterSpikes(t *testing.T) {
+	filter := NewSanityFilter(FilterConfig{
+		Spikes: map[string]float64{"temperature": 5},
+	})
+	readings, dropped := filter.Filter("temperature", filterTestReadings(20, 21, 60, 21, 22))
+	if len(readings) != 4 || len(dropped) != 1 {
+		t.FailNow()
+	}
+	if dropped[0].Value != 60 || dropped[0].Reason != DropSpike {
+		t.Fail()
+	}
+
+	// A genuine step change isn't a spike
+	readings, _ = filter.Filter("temperature", filterTestReadings(20, 21, 40, 41, 42))
+	if len(readings) != 5 {
+		t.Fail()
+	}
+
+	// The newest reading is judged against the two before it
+	readings, dropped = filter.Filter("temperature", filterTestReadings(20, 21, 22, 60))
+	if len(readings) != 3 || len(dropped) != 1 || dropped[0].Value != 60 {
+		t.Fail()
+	}
+	// and kept once a later reading shows it was a step change
+	readings, _ = filter.Filter("temperature", filterTestReadings(20, 21, 22, 40, 41))
+	if len(readings) != 5 {
+		t.Fail()
+	}
+
+	// Stats without a threshold aren't checked
+	readings, _ = filter.Filter("cap", filterTestReadings(20, 21, 90, 21, 22))
+	if len(readings) != 5 {
+		t.Fail()
+	}
+}
@@ -1,18 +1,36 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
-	"math/rand"
+	"html/template"
+	"io"
+	"math/big"
+	mathrand "math/rand"
 	"net"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/arcticfoxnv/oolong/logging"
 	"github.com/arcticfoxnv/oolong/oauth"
 	"github.com/arcticfoxnv/oolong/state"
+	log "github.com/sirupsen/logrus"
 )
 
-var oauthClient oauth.OAuthClient
-
 // Helper function to find the local IP.
 func GetLocalIPAddress() string {
 	ifaces, _ := net.Interfaces()
@@ -34,58 +52,326 @@ func GetLocalIPAddress() string {
 	return ""
 }
 
+// newOAuthState returns a random value for the OAuth state parameter, so that
+// codes which didn't come from a login we started are rejected.
+func newOAuthState() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func checkOAuthState(expected, got string) bool {
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(got)) == 1
+}
+
+var resultPage = template.Must(template.New("result").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Oolong - {{.Title}}</title></head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+</body>
+</html>
+`))
+
+func writeResultPage(w http.ResponseWriter, status int, title, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	resultPage.Execute(w, struct{ Title, Message string }{title, message})
+}
+
+// InitServer serves the pages for oolong init.  /start sends the browser to
+// the OAuth page, which sends it back to /authorize with a code to exchange
+// for an access token.
+type InitServer struct {
+	client oauth.OAuthClient
+	state  state.State
+	// Sent to the OAuth page with each login, and checked on the way back
+	oauthState string
+
+	done chan struct{}
+	once sync.Once
+}
+
+func NewInitServer(client oauth.OAuthClient, st state.State) (*InitServer, error) {
+	oauthState, err := newOAuthState()
+	if err != nil {
+		return nil, err
+	}
+	return &InitServer{
+		client:     client,
+		state:      st,
+		oauthState: oauthState,
+		done:       make(chan struct{}),
+	}, nil
+}
+
+// Done is closed once the access token has been saved.
+func (s *InitServer) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *InitServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/start", s.ClientLoginHandler)
+	mux.HandleFunc("/authorize", s.AuthorizeHandler)
+	return mux
+}
+
 // Redirects the user to the OAuth authorization page on www.mytaglist.com/www.wirelesstag.net
-func ClientLoginHandler(w http.ResponseWriter, r *http.Request) {
-	http.Redirect(w, r, oauthClient.GetAuthorizeURL(), http.StatusFound)
+func (s *InitServer) ClientLoginHandler(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, s.client.GetAuthorizeURL(s.oauthState), http.StatusFound)
 }
 
 // OAuth page sends user to here, which reads the code and exchanges it for an access token.
-func AuthorizeHandler(w http.ResponseWriter, r *http.Request, state state.State, done chan int) {
-	code := r.URL.Query().Get("code")
-	log.Printf("Got auth code %s from client\n", code)
-	accessToken, err := oauthClient.GetAccessToken(code)
+func (s *InitServer) AuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-s.done:
+		writeResultPage(w, http.StatusOK, "Already authorized", "Oolong already has an access token.  You can close this page.")
+		return
+	default:
+	}
+
+	query := r.URL.Query()
+	if !checkOAuthState(s.oauthState, query.Get("state")) {
+		log.Warn("Rejected authorization with the wrong state")
+		writeResultPage(w, http.StatusBadRequest, "Authorization failed", "This authorization didn't come from the login oolong started.  Start again from the URL oolong printed.")
+		return
+	}
+	if oauthErr := query.Get("error"); oauthErr != "" {
+		log.WithField("error", oauthErr).Error("Authorization was refused")
+		writeResultPage(w, http.StatusBadRequest, "Authorization failed", "Access wasn't granted: "+oauthErr)
+		return
+	}
+
+	// Give up on the exchange if the browser goes away
+	err := exchangeCode(r.Context(), s.client, s.state, query.Get("code"))
 	if err != nil {
-		log.Printf("Failed to exchange code for token: %s\n", err.Error())
+		log.WithError(err).Error("Failed to get access token")
+		writeResultPage(w, http.StatusInternalServerError, "Authorization failed", "Oolong couldn't get an access token, see its output for details.  Start again from the URL oolong printed to retry.")
 		return
 	}
-	log.Printf("Got access token: %s\n", accessToken)
+
+	writeResultPage(w, http.StatusOK, "Authorized", "Oolong has an access token and is ready to run.  You can close this page.")
+	s.once.Do(func() { close(s.done) })
+}
+
+// exchangeCode exchanges an auth code for an access token, and saves the
+// token in the state.
+func exchangeCode(ctx context.Context, client oauth.OAuthClient, state state.State, code string) error {
+	if code == "" {
+		return errors.New("No code given")
+	}
+	log.WithField("code", code).Debug("Got auth code from client")
+	accessToken, err := client.GetAccessTokenContext(ctx, code)
+	if err != nil {
+		return err
+	}
+	logging.AddSecret(accessToken)
+	log.WithField("token", accessToken).Info("Got access token")
 
 	// Store the access token
 	state.SetAccessToken(accessToken)
 
 	// Write the state to file
-	state.Save()
-	done <- 1
+	return state.Save()
+}
+
+// Where the OAuth page sends the browser back to in manual mode, unless
+// public_url is set.  Nothing needs to be listening there, since the code is
+// copied out of the address bar.
+const manualRedirectURL = "http://localhost/authorize"
+
+// InitAddresses returns the address the init server listens on, and the base
+// URL the browser reaches it at.  Neither needs to be reachable from the
+// OAuth server, only from the user's browser.  Without a public URL, the
+// base URL uses the host being listened on, or the first global unicast
+// address if listening on all interfaces.
+func InitAddresses(config *Config) (string, string, error) {
+	listen := config.HTTP.Listen
+	if listen == "" {
+		port := config.HTTP.Port
+		if port == 0 {
+			port = mathrand.Intn(1000) + 10000
+		}
+		listen = fmt.Sprintf(":%d", port)
+	}
+	if config.HTTP.PublicURL != "" {
+		return listen, strings.TrimRight(config.HTTP.PublicURL, "/"), nil
+	}
+
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return "", "", err
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = GetLocalIPAddress()
+	}
+	scheme := "http"
+	if config.HTTP.TLS {
+		scheme = "https"
+	}
+	return listen, scheme + "://" + net.JoinHostPort(host, port), nil
 }
 
-func StartHTTPServer(config *Config, urlChan chan string, done chan int) {
-	var st state.State
-	ip := GetLocalIPAddress()
-	port := config.HTTP.Port
-	if port == 0 {
-		port = rand.Intn(1000) + 10000
+// selfSignedCert creates a short lived certificate for the init server.  The
+// browser will warn about it, but the fingerprint is logged for checking.
+func selfSignedCert(hosts []string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	certTemplate := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"oolong init"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			certTemplate.IPAddresses = append(certTemplate.IPAddresses, ip)
+		} else if host != "" {
+			certTemplate.DNSNames = append(certTemplate.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &certTemplate, &certTemplate, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// initTLSConfig loads the configured certificate, or creates a self-signed
+// one for the host in baseURL.
+func initTLSConfig(config *Config, baseURL string) (*tls.Config, error) {
+	if config.HTTP.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(config.HTTP.TLSCert, config.HTTP.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+	}
+
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if u, err := url.Parse(baseURL); err == nil {
+		hosts = append(hosts, u.Hostname())
+	}
+	cert, err := selfSignedCert(hosts)
+	if err != nil {
+		return nil, err
+	}
+	fingerprint := sha256.Sum256(cert.Certificate[0])
+	log.WithField("sha256", hex.EncodeToString(fingerprint[:])).Info("Using a self-signed certificate")
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// RunInitServer serves the OAuth flow until the access token has been saved in
+// st, then shuts the server down.  Stops early if ctx is cancelled.
+func RunInitServer(ctx context.Context, config *Config, st state.State) error {
+	listen, baseURL, err := InitAddresses(config)
+	if err != nil {
+		return fmt.Errorf("Invalid listen address: %w", err)
+	}
+	// Redirect URL will be <base url>/authorize
+	client := oauth.NewOAuthClient(config.OAuth.ID, config.OAuth.Secret, baseURL+"/authorize")
+	initServer, err := NewInitServer(client, st)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{Addr: listen, Handler: initServer.Handler()}
+	if config.HTTP.TLS {
+		server.TLSConfig, err = initTLSConfig(config, baseURL)
+		if err != nil {
+			return fmt.Errorf("Failed to set up TLS: %w", err)
+		}
 	}
-	// Redirect URL will be http://<local ip>:<port>/authorize
-	redirectURL := fmt.Sprintf("http://%s:%d/authorize", ip, port)
-	oauthClient = oauth.NewOAuthClient(config.OAuth.ID, config.OAuth.Secret, redirectURL)
 
-	// Create a new state
-	switch config.Backend {
-	case "file":
-		st = state.NewFileState(config.File.Filename)
-	case "redis":
-		st = state.NewRedisState(config.Redis.Host, config.Redis.Port, config.Redis.Key)
+	// Listen before printing the URL, so it works once it's printed
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+	if server.TLSConfig != nil {
+		listener = tls.NewListener(listener, server.TLSConfig)
 	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
 
-	http.HandleFunc("/start", ClientLoginHandler)
-	http.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
-		AuthorizeHandler(w, r, st, done)
-	})
+	// Start URL will be <base url>/start
+	log.Infof("Oolong ready!  Go to %s/start to begin.", baseURL)
 
-	// Start URL will be http://<local ip>:<port>/authorize
-	// Neither URL needs to be reachable from the remote OAuth server.  The only client
-	// to access either URL will be the user's browser.
-	urlChan <- fmt.Sprintf("http://%s:%d/start", ip, port)
+	select {
+	case <-initServer.Done():
+	case <-ctx.Done():
+	case err := <-serveErr:
+		return err
+	}
+
+	// Let the result page finish sending before closing.  Connections which
+	// haven't sent a request yet would hold Shutdown up, so they're closed
+	// after a moment.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = server.Shutdown(shutdownCtx)
+	if err != nil {
+		server.Close()
+	}
+	return ctx.Err()
+}
 
-	http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
+// ManualInit gets an access token without a server: the user opens the
+// authorize URL in any browser, then pastes the URL they were sent back to,
+// or just the code from it.  The page they're sent back to doesn't need to
+// load.
+func ManualInit(ctx context.Context, client oauth.OAuthClient, st state.State, in io.Reader, out io.Writer) error {
+	oauthState, err := newOAuthState()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Go to this URL in a browser and approve access:\n\n  %s\n\n", client.GetAuthorizeURL(oauthState))
+	fmt.Fprint(out, "Then paste the URL you were sent back to (or the code from it): ")
+
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && line == "" {
+		return fmt.Errorf("Failed to read the code: %w", err)
+	}
+	code, gotState := parseAuthCode(strings.TrimSpace(line))
+	if code == "" {
+		return errors.New("No code found in the pasted text")
+	}
+	// A bare code can't be checked, but a pasted URL can
+	if gotState != "" && !checkOAuthState(oauthState, gotState) {
+		return errors.New("The pasted URL is from a different login, paste the one from this login")
+	}
+	return exchangeCode(ctx, client, st, code)
+}
+
+// parseAuthCode finds the code and state in a redirect URL or query string,
+// or returns input as it is if it's just the code.
+func parseAuthCode(input string) (string, string) {
+	if !strings.Contains(input, "code=") {
+		return input, ""
+	}
+	if i := strings.Index(input, "?"); i >= 0 {
+		input = input[i+1:]
+	}
+	values, err := url.ParseQuery(input)
+	if err != nil {
+		return "", ""
+	}
+	return values.Get("code"), values.Get("state")
 }
@@ -1,21 +1,28 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
-	"github.com/arcticfoxnv/oolong/oauth"
 	"github.com/arcticfoxnv/oolong/state"
 )
 
 type DummyOAuthClient struct {
 }
 
-func (c *DummyOAuthClient) GetAuthorizeURL() string {
-	return "http://example.com/authorize"
+func (c *DummyOAuthClient) GetAuthorizeURL(state string) string {
+	return "http://example.com/authorize?state=" + state
 }
 
 func (c *DummyOAuthClient) GetAccessToken(code string) (string, error) {
@@ -25,6 +32,10 @@ func (c *DummyOAuthClient) GetAccessToken(code string) (string, error) {
 	return code, nil
 }
 
+func (c *DummyOAuthClient) GetAccessTokenContext(ctx context.Context, code string) (string, error) {
+	return c.GetAccessToken(code)
+}
+
 func TestGetLocalIPAddress(t *testing.T) {
 	ip := GetLocalIPAddress()
 	if ip == "" {
@@ -40,6 +51,33 @@ func TestGetLocalIPAddress(t *testing.T) {
 	}
 }
 
+func newTestInitServer(t *testing.T) *InitServer {
+	server, err := NewInitServer(&DummyOAuthClient{}, state.NewFileState("state.json"))
+	if err != nil {
+		t.FailNow()
+	}
+	return server
+}
+
+func authorizeRequest(t *testing.T, server *InitServer, params url.Values) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(http.MethodGet, "/authorize?"+params.Encode(), nil)
+	if err != nil {
+		t.FailNow()
+	}
+	resp := httptest.NewRecorder()
+	server.Handler().ServeHTTP(resp, req)
+	return resp
+}
+
+func isDone(server *InitServer) bool {
+	select {
+	case <-server.Done():
+		return true
+	default:
+		return false
+	}
+}
+
 func TestClientLoginHandler(t *testing.T) {
 	resp := httptest.NewRecorder()
 	path := "/start"
@@ -49,55 +87,230 @@ func TestClientLoginHandler(t *testing.T) {
 		t.FailNow()
 	}
 
-	oauthClient = oauth.NewOAuthClient("test.id", "test.secret", "http://example.com/authorize")
-	ClientLoginHandler(resp, req)
+	server := newTestInitServer(t)
+	server.Handler().ServeHTTP(resp, req)
 
 	if resp.Code != http.StatusFound {
 		t.Fail()
 	}
 
-	if resp.Header().Get("Location") != oauthClient.GetAuthorizeURL() {
+	if resp.Header().Get("Location") != "http://example.com/authorize?state="+server.oauthState {
 		t.Fail()
 	}
-
 }
 
 func TestAuthorizeHandler(t *testing.T) {
-	resp := httptest.NewRecorder()
-	path := "/authorize"
-	param := make(url.Values)
-	param["code"] = []string{"123456"}
+	defer os.Remove("state.json")
+	server := newTestInitServer(t)
+
+	resp := authorizeRequest(t, server, url.Values{"code": {"123456"}, "state": {server.oauthState}})
+	if resp.Code != http.StatusOK || !isDone(server) {
+		t.Fail()
+	}
+	if !strings.Contains(resp.Body.String(), "Authorized") {
+		t.Fail()
+	}
+
+	st, err := state.NewStateFromFile("state.json")
+	if err != nil || st.GetAccessToken() != "123456" {
+		t.Fail()
+	}
+}
+
+func TestAuthorizeHandlerFailed(t *testing.T) {
+	server := newTestInitServer(t)
+
+	resp := authorizeRequest(t, server, url.Values{"code": {"failnow"}, "state": {server.oauthState}})
+	if resp.Code != http.StatusInternalServerError || isDone(server) {
+		t.Fail()
+	}
+
+	resp = authorizeRequest(t, server, url.Values{"error": {"access_denied"}, "state": {server.oauthState}})
+	if resp.Code != http.StatusBadRequest || isDone(server) {
+		t.Fail()
+	}
+}
+
+func TestAuthorizeHandlerWrongState(t *testing.T) {
+	server := newTestInitServer(t)
+
+	resp := authorizeRequest(t, server, url.Values{"code": {"123456"}, "state": {"forged"}})
+	if resp.Code != http.StatusBadRequest || isDone(server) {
+		t.Fail()
+	}
 
-	req, err := http.NewRequest(http.MethodGet, path+param.Encode(), nil)
+	resp = authorizeRequest(t, server, url.Values{"code": {"123456"}})
+	if resp.Code != http.StatusBadRequest || isDone(server) {
+		t.Fail()
+	}
+}
+
+func TestRunInitServerTLS(t *testing.T) {
+	defer os.Remove("state.json")
+
+	// Find a free port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		t.FailNow()
 	}
+	listen := listener.Addr().String()
+	listener.Close()
 
-	done := make(chan int)
-	oauthClient = &DummyOAuthClient{}
+	config := &Config{}
+	config.HTTP.Listen = listen
+	config.HTTP.TLS = true
 	st := state.NewFileState("state.json")
-	go AuthorizeHandler(resp, req, st, done)
-	<-done
 
-	// TODO: Test valid token is written
-}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	result := make(chan error, 1)
+	go func() {
+		result <- RunInitServer(ctx, config, st)
+	}()
 
-func TestAuthorizeHandlerFailed(t *testing.T) {
-	resp := httptest.NewRecorder()
-	path := "/authorize"
-	param := make(url.Values)
-	param["code"] = []string{"failnow"}
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		// Stop at the OAuth page, rather than going to it
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+		Timeout: 5 * time.Second,
+	}
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		resp, err = client.Get("https://" + listen + "/start")
+		if err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
 
-	req, err := http.NewRequest(http.MethodGet, path+param.Encode(), nil)
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || location.Query().Get("redirect_uri") != "https://"+listen+"/authorize" {
+		t.Fatal(resp.Header.Get("Location"))
+	}
+
+	// The server is still running until a valid authorization arrives
+	resp, err = client.Get("https://" + listen + "/authorize?code=x&state=forged")
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fail()
+	}
+	resp.Body.Close()
+
+	select {
+	case err := <-result:
+		t.Error("server stopped early", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Giving up shuts the server down
+	cancel()
+	select {
+	case err := <-result:
+		if err != context.Canceled {
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("server didn't shut down")
+	}
+}
+
+func TestSelfSignedCert(t *testing.T) {
+	cert, err := selfSignedCert([]string{"localhost", "192.168.1.5"})
 	if err != nil {
-		t.FailNow()
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
 	}
+	if parsed.VerifyHostname("localhost") != nil || parsed.VerifyHostname("192.168.1.5") != nil {
+		t.Fail()
+	}
+	if parsed.VerifyHostname("example.com") == nil {
+		t.Fail()
+	}
+}
 
-	done := make(chan int)
-	oauthClient = &DummyOAuthClient{}
+func TestInitAddresses(t *testing.T) {
+	config := &Config{}
+	config.HTTP.Port = 10000
+	listen, baseURL, err := InitAddresses(config)
+	if err != nil || listen != ":10000" || baseURL != "http://"+GetLocalIPAddress()+":10000" {
+		t.Fail()
+	}
+
+	config.HTTP.Listen = "127.0.0.1:9000"
+	listen, baseURL, err = InitAddresses(config)
+	if err != nil || listen != "127.0.0.1:9000" || baseURL != "http://127.0.0.1:9000" {
+		t.Fail()
+	}
+
+	config.HTTP.PublicURL = "https://oolong.example.com/"
+	_, baseURL, err = InitAddresses(config)
+	if err != nil || baseURL != "https://oolong.example.com" {
+		t.Fail()
+	}
+
+	config.HTTP.PublicURL = ""
+	config.HTTP.Listen = "nowhere"
+	_, _, err = InitAddresses(config)
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func TestParseAuthCode(t *testing.T) {
+	inputs := []string{
+		"http://localhost/authorize?code=abc123",
+		"http://localhost/authorize?state=x&code=abc123",
+		"code=abc123",
+		"abc123",
+	}
+	for _, input := range inputs {
+		if code, _ := parseAuthCode(input); code != "abc123" {
+			t.Error(input)
+		}
+	}
+
+	code, state := parseAuthCode("http://localhost/authorize?code=abc123&state=xyz")
+	if code != "abc123" || state != "xyz" {
+		t.Fail()
+	}
+}
+
+func TestManualInit(t *testing.T) {
 	st := state.NewFileState("state.json")
-	go AuthorizeHandler(resp, req, st, done)
-	<-done
+	defer os.Remove("state.json")
 
-	// TODO: Test no token is written
+	var out bytes.Buffer
+	in := strings.NewReader("http://localhost/authorize?code=token123\n")
+	err := ManualInit(context.Background(), &DummyOAuthClient{}, st, in, &out)
+	if err != nil || st.GetAccessToken() != "token123" {
+		t.Fail()
+	}
+	if !strings.Contains(out.String(), "http://example.com/authorize") {
+		t.Fail()
+	}
+
+	// A URL from another login is rejected
+	in = strings.NewReader("http://localhost/authorize?code=token123&state=forged\n")
+	err = ManualInit(context.Background(), &DummyOAuthClient{}, st, in, &out)
+	if err == nil {
+		t.Fail()
+	}
+
+	err = ManualInit(context.Background(), &DummyOAuthClient{}, st, strings.NewReader("failnow\n"), &out)
+	if err == nil {
+		t.Fail()
+	}
+
+	err = ManualInit(context.Background(), &DummyOAuthClient{}, st, strings.NewReader(""), &out)
+	if err == nil {
+		t.Fail()
+	}
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/arcticfoxnv/oolong/logging"
+	"github.com/arcticfoxnv/oolong/state"
+)
+
+// Elector picks one of several oolongs to poll, by holding a lock in the
+// state backend.
+type Elector struct {
+	lock    state.Lock
+	id      string
+	ttl     time.Duration
+	metrics *Metrics
+}
+
+// NewElector creates an elector using a lock in the configured backend.
+func NewElector(config *Config, metrics *Metrics) (*Elector, error) {
+	id := config.Leader.LeaderID()
+	ttl := time.Duration(config.Leader.TTL) * time.Second
+	lock, err := leaderLock(config, id, ttl)
+	if err != nil {
+		return nil, err
+	}
+	return &Elector{lock: lock, id: id, ttl: ttl, metrics: metrics}, nil
+}
+
+// leaderLock returns the lock in the configured backend which the leader
+// holds, taken as id.
+func leaderLock(config *Config, id string, ttl time.Duration) (state.Lock, error) {
+	switch config.Backend {
+	case "file":
+		return state.NewFileLock(config.File.Filename+".lock", id), nil
+	case "redis":
+		options, err := config.Redis.Options()
+		if err != nil {
+			return nil, err
+		}
+		return state.NewRedisLock(options, config.Redis.Key+":leader", id, ttl), nil
+	}
+	return nil, fmt.Errorf("Unknown state backend %s", config.Backend)
+}
+
+// Run calls lead whenever this oolong becomes the leader, with a context
+// which is cancelled when it stops being the leader.  The lock is renewed
+// every third of the ttl.  If it can't be renewed, the leader steps down
+// before the lock could expire and be taken by another oolong.  Returns when
+// ctx is cancelled, or with the error from lead if it returns before then.
+func (e *Elector) Run(ctx context.Context, lead func(context.Context) error) error {
+	log := logging.FromContext(ctx).WithField("id", e.id)
+	defer func() {
+		err := e.lock.Release()
+		if err != nil {
+			log.WithError(err).Warn("Unable to release leader lock")
+		}
+	}()
+
+	renew := time.NewTicker(e.ttl / 3)
+	defer renew.Stop()
+
+	var (
+		renewed time.Time
+		// Who was leader when last checked, if known
+		leader      string
+		leaderKnown bool
+		stop        context.CancelFunc
+		done        chan error
+	)
+	startLeading := func() {
+		leaderCtx, cancel := context.WithCancel(ctx)
+		stop, done = cancel, make(chan error, 1)
+		go func(done chan<- error) {
+			done <- lead(leaderCtx)
+		}(done)
+	}
+	stepDown := func() {
+		if stop != nil {
+			stop()
+			<-done
+			stop, done = nil, nil
+		}
+	}
+	defer stepDown()
+
+	for {
+		held, err := e.lock.Acquire()
+		if err == nil && held {
+			renewed = time.Now()
+		} else if err != nil {
+			log.WithError(err).Warn("Unable to renew leader lock")
+			held = stop != nil && time.Since(renewed) < e.ttl*2/3
+		}
+
+		holder := e.id
+		if !held {
+			stepDown()
+			holder, err = e.lock.Holder()
+			if err != nil {
+				holder = ""
+			}
+		} else if stop == nil {
+			startLeading()
+		}
+
+		if !leaderKnown || holder != leader {
+			switch {
+			case holder == e.id:
+				log.Info("Became the leader, polling")
+			case leader == e.id:
+				log.WithField("leader", holder).Warn("No longer the leader, stopped polling")
+			case holder == "":
+				log.Info("No leader")
+			default:
+				log.WithField("leader", holder).Info("Following the leader")
+			}
+			leader, leaderKnown = holder, true
+			e.metrics.LeaderChanged(e.id, leader)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-done:
+			stop()
+			stop, done = nil, nil
+			return err
+		case <-renew.C:
+		}
+	}
+}
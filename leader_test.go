@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A lock shared between electors in the same process
+type testLock struct {
+	lock   *sync.Mutex
+	holder *string
+	id     string
+	err    error
+}
+
+func (l *testLock) Acquire() (bool, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.err != nil {
+		return false, l.err
+	}
+	if *l.holder == "" {
+		*l.holder = l.id
+	}
+	return *l.holder == l.id, nil
+}
+
+func (l *testLock) Holder() (string, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return *l.holder, l.err
+}
+
+func (l *testLock) Release() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if *l.holder == l.id {
+		*l.holder = ""
+	}
+	return nil
+}
+
+func TestElectorFailover(t *testing.T) {
+	var lock sync.Mutex
+	var holder string
+	first := &Elector{lock: &testLock{lock: &lock, holder: &holder, id: "first"}, id: "first", ttl: 30 * time.Millisecond}
+	second := &Elector{lock: &testLock{lock: &lock, holder: &holder, id: "second"}, id: "second", ttl: 30 * time.Millisecond, metrics: NewMetrics(time.Hour)}
+
+	leading := make(chan string, 10)
+	lead := func(id string) func(context.Context) error {
+		return func(ctx context.Context) error {
+			leading <- id
+			<-ctx.Done()
+			return nil
+		}
+	}
+
+	firstCtx, stopFirst := context.WithCancel(context.Background())
+	firstDone := make(chan error)
+	go func() {
+		firstDone <- first.Run(firstCtx, lead("first"))
+	}()
+	if <-leading != "first" {
+		t.FailNow()
+	}
+
+	secondCtx, stopSecond := context.WithCancel(context.Background())
+	defer stopSecond()
+	go second.Run(secondCtx, lead("second"))
+	time.Sleep(50 * time.Millisecond)
+	if len(leading) != 0 || second.metrics.Healthy() != nil {
+		t.Fail()
+	}
+
+	// The second takes over when the first stops
+	stopFirst()
+	if <-firstDone != nil {
+		t.Fail()
+	}
+	select {
+	case id := <-leading:
+		if id != "second" {
+			t.Fail()
+		}
+	case <-time.After(time.Second):
+		t.Fail()
+	}
+}
+
+func TestElectorStepsDown(t *testing.T) {
+	var lock sync.Mutex
+	var holder string
+	testLock := &testLock{lock: &lock, holder: &holder, id: "first"}
+	elector := &Elector{lock: testLock, id: "first", ttl: 30 * time.Millisecond}
+
+	stopped := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go elector.Run(ctx, func(ctx context.Context) error {
+		lock.Lock()
+		testLock.err = errors.New("unavailable")
+		lock.Unlock()
+		<-ctx.Done()
+		close(stopped)
+		return nil
+	})
+
+	// Polling stops once the lock can't be renewed
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fail()
+	}
+}
+
+func TestElectorLeadError(t *testing.T) {
+	var lock sync.Mutex
+	var holder string
+	elector := &Elector{lock: &testLock{lock: &lock, holder: &holder, id: "first"}, id: "first", ttl: 30 * time.Millisecond}
+
+	err := elector.Run(context.Background(), func(ctx context.Context) error {
+		return errors.New("failed")
+	})
+	if err == nil || holder != "" {
+		t.Fail()
+	}
+}
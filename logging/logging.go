@@ -0,0 +1,149 @@
+// Package logging sets up the structured logger used throughout oolong, and
+// passes it around in contexts so log entries carry fields like the tag and
+// stat they're about.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Output formats
+const (
+	// Human readable, coloured when writing to a terminal
+	FormatText = "text"
+	// key=value pairs
+	FormatLogfmt = "logfmt"
+	// One JSON object per line
+	FormatJSON = "json"
+)
+
+// Fields whose values are always redacted, whatever they hold
+var sensitiveFields = []string{"token", "access_token", "code", "secret", "password", "authorization"}
+
+// Configure sets the level and output format of logger, and makes it redact
+// secrets.  An empty level or format leaves it at info or text.
+func Configure(logger *logrus.Logger, level, format string, out io.Writer) error {
+	if level == "" {
+		level = "info"
+	}
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	var formatter logrus.Formatter
+	switch format {
+	case "", FormatText:
+		formatter = &logrus.TextFormatter{FullTimestamp: true}
+	case FormatLogfmt:
+		formatter = &logrus.TextFormatter{FullTimestamp: true, DisableColors: true}
+	case FormatJSON:
+		formatter = &logrus.JSONFormatter{}
+	default:
+		return fmt.Errorf("Unknown log format %s", format)
+	}
+
+	logger.SetLevel(lvl)
+	logger.SetFormatter(&redactFormatter{formatter})
+	if out != nil {
+		logger.SetOutput(out)
+	}
+	return nil
+}
+
+type contextKey struct{}
+
+// WithLogger returns a context carrying logger.
+func WithLogger(ctx context.Context, logger logrus.FieldLogger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the logger carried by ctx, or the standard logger if
+// there isn't one.
+func FromContext(ctx context.Context) logrus.FieldLogger {
+	if logger, ok := ctx.Value(contextKey{}).(logrus.FieldLogger); ok {
+		return logger
+	}
+	return logrus.StandardLogger()
+}
+
+// WithFields returns a context whose logger adds fields to every entry.
+func WithFields(ctx context.Context, fields logrus.Fields) context.Context {
+	return WithLogger(ctx, FromContext(ctx).WithFields(fields))
+}
+
+var secrets = struct {
+	sync.RWMutex
+	values map[string]bool
+}{values: make(map[string]bool)}
+
+// AddSecret makes every logger configured by Configure redact value wherever
+// it appears, in case it ends up in an error message.
+func AddSecret(value string) {
+	if value == "" {
+		return
+	}
+	secrets.Lock()
+	defer secrets.Unlock()
+	secrets.values[value] = true
+}
+
+// Redact hides a secret.  None of it is kept, not even its length.
+func Redact(value string) string {
+	return "[redacted]"
+}
+
+func redactString(s string) string {
+	secrets.RLock()
+	defer secrets.RUnlock()
+	for value := range secrets.values {
+		s = strings.Replace(s, value, Redact(value), -1)
+	}
+	return s
+}
+
+func isSensitiveField(key string) bool {
+	key = strings.ToLower(key)
+	for _, field := range sensitiveFields {
+		if key == field {
+			return true
+		}
+	}
+	return false
+}
+
+// redactFormatter removes secrets from entries before formatting them.
+type redactFormatter struct {
+	logrus.Formatter
+}
+
+func (f *redactFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	// Work on a copy, the entry's fields may be shared with other entries
+	redacted := *entry
+	redacted.Message = redactString(entry.Message)
+	redacted.Data = make(logrus.Fields, len(entry.Data))
+	for key, value := range entry.Data {
+		switch {
+		case isSensitiveField(key):
+			redacted.Data[key] = Redact(fmt.Sprint(value))
+		case key == logrus.ErrorKey:
+			if err, ok := value.(error); ok {
+				redacted.Data[key] = redactString(err.Error())
+			} else {
+				redacted.Data[key] = value
+			}
+		default:
+			if s, ok := value.(string); ok {
+				value = redactString(s)
+			}
+			redacted.Data[key] = value
+		}
+	}
+	return f.Formatter.Format(&redacted)
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/arcticfoxnv/oolong/wirelesstag"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+// Metrics counts what the poller is doing, for serving on /metrics, and keeps
+// track of the health reported by /healthz and /readyz.  A nil *Metrics
+// records nothing.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	apiRequests         *prometheus.CounterVec
+	apiDuration         *prometheus.HistogramVec
+	readingsFetched     *prometheus.CounterVec
+	readingsDropped     *prometheus.CounterVec
+	readingsWritten     *prometheus.CounterVec
+	sinkWriteDuration   *prometheus.HistogramVec
+	sinkWriteErrors     *prometheus.CounterVec
+	lastCycle           prometheus.Gauge
+	lastSuccessfulCycle prometheus.Gauge
+	stateSaveFailures   prometheus.Counter
+	ticksMissed         prometheus.Counter
+	tokenValid          prometheus.Gauge
+	leader              *prometheus.GaugeVec
+
+	// How long without a successful cycle before the poller is unhealthy
+	staleAfter time.Duration
+
+	lock          sync.Mutex
+	started       time.Time
+	lastSuccess   time.Time
+	tokenRejected bool
+	// Waiting to take over from another oolong, so not expected to poll
+	standby     bool
+	leaderSince time.Time
+}
+
+func NewMetrics(staleAfter time.Duration) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		apiRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "oolong_api_requests_total",
+			Help: "Requests made to the wirelesstag API, including retries.",
+		}, []string{"method", "code"}),
+		apiDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "oolong_api_request_duration_seconds",
+			Help:    "Time taken by requests to the wirelesstag API.",
+			Buckets: prometheus.ExponentialBuckets(0.1, 2, 10),
+		}, []string{"method"}),
+		readingsFetched: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "oolong_readings_fetched_total",
+			Help: "New readings fetched from the API.",
+		}, []string{"stat"}),
+		readingsDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "oolong_readings_dropped_total",
+			Help: "New readings removed by the sanity filter.",
+		}, []string{"stat", "reason"}),
+		readingsWritten: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "oolong_readings_written_total",
+			Help: "Readings written to each sink.",
+		}, []string{"sink", "stat"}),
+		sinkWriteDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "oolong_sink_write_duration_seconds",
+			Help:    "Time taken by writes to each sink, including failed writes.",
+			Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+		}, []string{"sink"}),
+		sinkWriteErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "oolong_sink_write_errors_total",
+			Help: "Failed writes to each sink, including retries.",
+		}, []string{"sink"}),
+		lastCycle: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "oolong_last_cycle_timestamp_seconds",
+			Help: "When the last poll cycle finished.",
+		}),
+		lastSuccessfulCycle: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "oolong_last_successful_cycle_timestamp_seconds",
+			Help: "When the last poll cycle without any failures finished.",
+		}),
+		stateSaveFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "oolong_state_save_failures_total",
+			Help: "Failed attempts to save the state.",
+		}),
+		ticksMissed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "oolong_schedule_ticks_missed_total",
+			Help: "Scheduled poll cycles which were late, or skipped, because the cycle before overran them.",
+		}),
+		tokenValid: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "oolong_token_valid",
+			Help: "0 if the API rejected the access token on the last request, otherwise 1.",
+		}),
+		leader: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "oolong_leader",
+			Help: "1 if this oolong (label id) is the leader, otherwise 0.  Label leader is the current leader's id, or empty if there is none.",
+		}, []string{"id", "leader"}),
+		staleAfter: staleAfter,
+		started:    time.Now(),
+	}
+	m.tokenValid.Set(1)
+
+	m.registry.MustRegister(
+		m.apiRequests, m.apiDuration,
+		m.readingsFetched, m.readingsDropped, m.readingsWritten,
+		m.sinkWriteDuration, m.sinkWriteErrors,
+		m.lastCycle, m.lastSuccessfulCycle, m.stateSaveFailures, m.ticksMissed, m.tokenValid,
+		m.leader,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// ObserveRequest records a request to the API.  It's a
+// wirelesstag.RequestObserver.
+func (m *Metrics) ObserveRequest(method string, statusCode int, duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	code := "none"
+	if statusCode != 0 {
+		code = strconv.Itoa(statusCode)
+	}
+	m.apiRequests.WithLabelValues(method, code).Inc()
+	m.apiDuration.WithLabelValues(method).Observe(duration.Seconds())
+
+	// Any other failure says nothing about the token
+	var authErr *wirelesstag.AuthError
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if errors.As(err, &authErr) {
+		m.tokenRejected = true
+		m.tokenValid.Set(0)
+	} else if err == nil {
+		m.tokenRejected = false
+		m.tokenValid.Set(1)
+	}
+}
+
+// ObserveWrite records a write to a sink.  It's a tsdb.WriteObserver.
+func (m *Metrics) ObserveWrite(sink, valueType string, readings int, duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.sinkWriteDuration.WithLabelValues(sink).Observe(duration.Seconds())
+	if err != nil {
+		m.sinkWriteErrors.WithLabelValues(sink).Inc()
+		return
+	}
+	m.readingsWritten.WithLabelValues(sink, valueType).Add(float64(readings))
+}
+
+// ReadingsFetched records new readings of a stat fetched from the API.
+func (m *Metrics) ReadingsFetched(queryType string, count int) {
+	if m == nil {
+		return
+	}
+	m.readingsFetched.WithLabelValues(queryType).Add(float64(count))
+}
+
+// ReadingsDropped records readings removed by the sanity filter.
+func (m *Metrics) ReadingsDropped(queryType string, dropped []DroppedReading) {
+	if m == nil {
+		return
+	}
+	for _, d := range dropped {
+		m.readingsDropped.WithLabelValues(queryType, d.Reason).Inc()
+	}
+}
+
+// StateSaveFailed records a failure to save the state.
+func (m *Metrics) StateSaveFailed() {
+	if m == nil {
+		return
+	}
+	m.stateSaveFailures.Inc()
+}
+
+// CycleFinished records the end of a poll cycle.  A cycle is successful if
+// every stat of every tag was fetched and stored, and the state was saved.
+func (m *Metrics) CycleFinished(successful bool) {
+	if m == nil {
+		return
+	}
+	m.lastCycle.SetToCurrentTime()
+	if !successful {
+		return
+	}
+	m.lastSuccessfulCycle.SetToCurrentTime()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.lastSuccess = time.Now()
+}
+
+// TicksMissed records scheduled cycles which didn't start on time.
+func (m *Metrics) TicksMissed(count int) {
+	if m == nil {
+		return
+	}
+	m.ticksMissed.Add(float64(count))
+}
+
+// LeaderChanged records which oolong is the leader, when leader election is
+// enabled.  id is this oolong, and leader is "" if there isn't a leader.
+// Only the leader is expected to poll, so a standby is healthy without
+// polling.
+func (m *Metrics) LeaderChanged(id, leader string) {
+	if m == nil {
+		return
+	}
+	isLeader := 0.0
+	if leader == id {
+		isLeader = 1
+	}
+	m.leader.Reset()
+	m.leader.WithLabelValues(id, leader).Set(isLeader)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.standby && leader == id {
+		// Give the new leader staleAfter to poll
+		m.leaderSince = time.Now()
+	}
+	m.standby = leader != id
+}
+
+// Healthy returns why the poller isn't healthy, or nil if it is.  It's
+// unhealthy once the token has been rejected, or if there hasn't been a
+// successful cycle for staleAfter.  Until the first cycle, it's given
+// staleAfter from when it started, or became the leader.
+func (m *Metrics) Healthy() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.tokenRejected {
+		return errors.New("access token rejected, run oolong init")
+	}
+	if m.standby {
+		return nil
+	}
+	since := m.lastSuccess
+	if since.IsZero() {
+		since = m.started
+	}
+	if m.leaderSince.After(since) {
+		since = m.leaderSince
+	}
+	if time.Since(since) > m.staleAfter {
+		return fmt.Errorf("no successful poll since %s", since.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Ready is like Healthy, but also requires a successful cycle, unless this
+// oolong is a standby.
+func (m *Metrics) Ready() error {
+	m.lock.Lock()
+	noPoll := m.lastSuccess.IsZero() && !m.standby
+	m.lock.Unlock()
+
+	if noPoll {
+		return errors.New("no successful poll yet")
+	}
+	return m.Healthy()
+}
+
+func (m *Metrics) HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, m.Healthy())
+}
+
+func (m *Metrics) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, m.Ready())
+}
+
+func writeHealth(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, err.Error())
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// Handler serves /metrics, /healthz and /readyz.
+func (m *Metrics) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/healthz", m.HealthzHandler)
+	mux.HandleFunc("/readyz", m.ReadyzHandler)
+	return mux
+}
+
+// StartMetricsServer serves the metrics on listen in the background.  The
+// caller is responsible for shutting the server down.
+func StartMetricsServer(listen string, m *Metrics) *http.Server {
+	server := &http.Server{Addr: listen, Handler: m.Handler()}
+	go func() {
+		log.WithField("listen", listen).Info("Serving metrics")
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.WithError(err).Error("Metrics server failed")
+		}
+	}()
+	return server
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arcticfoxnv/oolong/wirelesstag"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsObserveRequest(t *testing.T) {
+	m := NewMetrics(time.Hour)
+	m.ObserveRequest("GetStatsRaw", 200, time.Second, nil)
+	m.ObserveRequest("GetStatsRaw", 0, time.Second, &wirelesstag.RequestError{Err: errors.New("connection refused")})
+
+	if testutil.ToFloat64(m.apiRequests.WithLabelValues("GetStatsRaw", "200")) != 1 {
+		t.Fail()
+	}
+	if testutil.ToFloat64(m.apiRequests.WithLabelValues("GetStatsRaw", "none")) != 1 {
+		t.Fail()
+	}
+	// Network failures don't mean the token is bad
+	if testutil.ToFloat64(m.tokenValid) != 1 {
+		t.Fail()
+	}
+
+	m.ObserveRequest("GetStatsRaw", 401, time.Second, &wirelesstag.AuthError{RequestError: wirelesstag.RequestError{StatusCode: 401}})
+	if testutil.ToFloat64(m.tokenValid) != 0 {
+		t.Fail()
+	}
+}
+
+func TestMetricsObserveWrite(t *testing.T) {
+	m := NewMetrics(time.Hour)
+	m.ObserveWrite("postgres", "temperature", 5, time.Millisecond, nil)
+	m.ObserveWrite("postgres", "temperature", 5, time.Millisecond, errors.New("connection refused"))
+
+	if testutil.ToFloat64(m.readingsWritten.WithLabelValues("postgres", "temperature")) != 5 {
+		t.Fail()
+	}
+	if testutil.ToFloat64(m.sinkWriteErrors.WithLabelValues("postgres")) != 1 {
+		t.Fail()
+	}
+}
+
+func TestMetricsNil(t *testing.T) {
+	var m *Metrics
+	m.ObserveRequest("GetStatsRaw", 200, time.Second, nil)
+	m.ReadingsFetched("temperature", 1)
+	m.CycleFinished(true)
+	m.TicksMissed(1)
+}
+
+func TestMetricsHealth(t *testing.T) {
+	m := NewMetrics(time.Hour)
+
+	// Healthy while starting up, but not ready
+	if m.Healthy() != nil || m.Ready() == nil {
+		t.Fail()
+	}
+
+	m.CycleFinished(false)
+	if m.Ready() == nil {
+		t.Fail()
+	}
+
+	m.CycleFinished(true)
+	if m.Healthy() != nil || m.Ready() != nil {
+		t.Fail()
+	}
+
+	m.ObserveRequest("GetStatsRaw", 401, time.Second, &wirelesstag.AuthError{})
+	if m.Healthy() == nil || m.Ready() == nil {
+		t.Fail()
+	}
+}
+
+func TestMetricsHealthStale(t *testing.T) {
+	m := NewMetrics(time.Minute)
+	m.CycleFinished(true)
+	m.lastSuccess = time.Now().Add(-2 * time.Minute)
+	if m.Healthy() == nil {
+		t.Fail()
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	m := NewMetrics(time.Hour)
+	m.ReadingsFetched("temperature", 3)
+	handler := m.Handler()
+
+	resp := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/metrics", nil)
+	handler.ServeHTTP(resp, req)
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.Code != http.StatusOK || !strings.Contains(string(body), `oolong_readings_fetched_total{stat="temperature"} 3`) {
+		t.Fail()
+	}
+
+	resp = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/healthz", nil)
+	handler.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fail()
+	}
+
+	resp = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, "/readyz", nil)
+	handler.ServeHTTP(resp, req)
+	if resp.Code != http.StatusServiceUnavailable {
+		t.Fail()
+	}
+}
+
+func TestMetricsLeaderChanged(t *testing.T) {
+	m := NewMetrics(time.Minute)
+	m.started = time.Now().Add(-2 * time.Minute)
+
+	// A standby doesn't poll, so it's healthy regardless
+	m.LeaderChanged("b", "a")
+	if m.Healthy() != nil || m.Ready() != nil {
+		t.Fail()
+	}
+
+	// Once it takes over, it has staleAfter to poll
+	m.LeaderChanged("b", "b")
+	if m.Healthy() != nil || m.Ready() == nil {
+		t.Fail()
+	}
+	m.leaderSince = time.Now().Add(-2 * time.Minute)
+	if m.Healthy() == nil {
+		t.Fail()
+	}
+}
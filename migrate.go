@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/arcticfoxnv/oolong/logging"
+	"github.com/arcticfoxnv/oolong/tsdb"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+// MigrateOptions limits what is copied by Migrate.
+type MigrateOptions struct {
+	From time.Time
+	To   time.Time
+	// Stats to copy
+	Stats []string
+	// Tag UUIDs or names to copy.  All tags are copied if empty.
+	Tags []string
+	// Maximum readings written per second.  0 is unlimited.
+	Rate int
+}
+
+// MigrateProgress records which days have been copied for each stat, so an
+// interrupted migration can pick up where it left off.
+type MigrateProgress struct {
+	Source      string
+	Destination string
+	// The tag filter, sorted.  Empty if all tags are copied.
+	Tags []string `json:",omitempty"`
+	// stat -> last day (YYYY-MM-DD) copied
+	Completed map[string]string
+	Filename  string `json:"-"`
+}
+
+// LoadMigrateProgress reads the progress file, or starts a new one if it
+// doesn't exist yet.  Progress from a migration between different sinks, or
+// of different tags, is rejected rather than silently skipping days.
+func LoadMigrateProgress(filename, source, destination string, tags []string) (*MigrateProgress, error) {
+	tags = append([]string(nil), tags...)
+	sort.Strings(tags)
+	progress := &MigrateProgress{
+		Source:      source,
+		Destination: destination,
+		Tags:        tags,
+		Completed:   make(map[string]string),
+		Filename:    filename,
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return progress, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	progress.Tags = nil
+	err = json.Unmarshal(data, progress)
+	if err != nil {
+		return nil, err
+	}
+	if progress.Source != source || progress.Destination != destination {
+		return nil, fmt.Errorf("%s is for a migration from %s to %s", filename, progress.Source, progress.Destination)
+	}
+	if strings.Join(progress.Tags, ",") != strings.Join(tags, ",") {
+		return nil, fmt.Errorf("%s is for a migration of tags %s", filename, strings.Join(progress.Tags, ", "))
+	}
+	if progress.Completed == nil {
+		progress.Completed = make(map[string]string)
+	}
+	return progress, nil
+}
+
+// Done returns true if the day has already been copied for the stat.
+func (p *MigrateProgress) Done(stat string, day time.Time) bool {
+	// YYYY-MM-DD sorts the same as the dates themselves
+	return p.Completed[stat] != "" && day.Format("2006-01-02") <= p.Completed[stat]
+}
+
+// Complete records that the day was copied and saves the progress file.
+func (p *MigrateProgress) Complete(stat string, day time.Time) error {
+	p.Completed[stat] = day.Format("2006-01-02")
+	if p.Filename == "" {
+		return nil
+	}
+	data, _ := json.Marshal(p)
+	return ioutil.WriteFile(p.Filename, data, 0600)
+}
+
+// matchesTagFilter returns true if no tags were given, or the uuid or name is one of them.
+func matchesTagFilter(filter []string, series tsdb.Series) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	for _, t := range filter {
+		if t == series.Tag.UUID || t == series.Tag.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// Migrate copies readings from source to destination, one day and stat at a
+// time.  Progress is saved after each day so the copy can be resumed, which
+// includes after ctx is cancelled.
+func Migrate(ctx context.Context, source tsdb.Source, destination tsdb.TSDB, options MigrateOptions, progress *MigrateProgress) error {
+	log := logging.FromContext(ctx)
+	var limiter *rate.Limiter
+	if options.Rate > 0 {
+		limiter = rate.NewLimiter(rate.Limit(options.Rate), options.Rate)
+	}
+
+	for day := options.From; !day.After(options.To); day = day.AddDate(0, 0, 1) {
+		// Inclusive, to the last second of the day
+		dayEnd := day.AddDate(0, 0, 1).Add(-time.Second)
+
+		for _, stat := range options.Stats {
+			if progress.Done(stat, day) {
+				continue
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			series, err := source.GetValues(ctx, stat, day, dayEnd)
+			if err != nil {
+				return err
+			}
+
+			count := 0
+			for _, s := range series {
+				if !matchesTagFilter(options.Tags, s) {
+					continue
+				}
+				tag := s.Tag
+
+				// Write in chunks no bigger than the rate, since that's as
+				// many readings as the limiter will allow at once.
+				for start := 0; start < len(s.Readings); {
+					end := len(s.Readings)
+					if limiter != nil {
+						if end-start > options.Rate {
+							end = start + options.Rate
+						}
+						err = limiter.WaitN(ctx, end-start)
+						if err != nil {
+							return err
+						}
+					}
+
+					err = tsdb.PutValues(destination, &tag, stat, s.Readings[start:end])
+					if err != nil {
+						return err
+					}
+					count += end - start
+					start = end
+				}
+			}
+			log.WithFields(logrus.Fields{"stat": stat, "readings": count, "date": day.Format("2006-01-02")}).Info("Copied readings")
+
+			err = progress.Complete(stat, day)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
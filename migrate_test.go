@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/arcticfoxnv/oolong/tsdb"
+	"github.com/arcticfoxnv/oolong/wirelesstag"
+)
+
+type DummySource struct {
+	Calls int
+}
+
+// Returns one reading per tag, at the start of the requested range
+func (d *DummySource) GetValues(ctx context.Context, valueType string, from, to time.Time) ([]tsdb.Series, error) {
+	d.Calls++
+	return []tsdb.Series{
+		{
+			Tag:      wirelesstag.Tag{UUID: "xxx", Name: "tag1"},
+			Readings: []wirelesstag.Reading{{Timestamp: from, Value: 1}},
+		},
+		{
+			Tag:      wirelesstag.Tag{UUID: "yyy", Name: "tag2"},
+			Readings: []wirelesstag.Reading{{Timestamp: from, Value: 2}},
+		},
+	}, nil
+}
+
+type DummyTSDB struct {
+	Values []wirelesstag.Reading
+}
+
+func (d *DummyTSDB) PutValue(tag *wirelesstag.Tag, valueType string, reading wirelesstag.Reading) error {
+	d.Values = append(d.Values, reading)
+	return nil
+}
+
+var testMigrateOptions = MigrateOptions{
+	From:  time.Date(2006, 1, 1, 0, 0, 0, 0, time.Local),
+	To:    time.Date(2006, 1, 3, 0, 0, 0, 0, time.Local),
+	Stats: []string{"temperature", "cap"},
+}
+
+func TestMigrate(t *testing.T) {
+	source := &DummySource{}
+	destination := &DummyTSDB{}
+	progress, _ := LoadMigrateProgress("", "source", "destination", nil)
+
+	err := Migrate(context.Background(), source, destination, testMigrateOptions, progress)
+	if err != nil {
+		t.Fail()
+	}
+
+	// 3 days, 2 stats, 2 tags
+	if source.Calls != 6 || len(destination.Values) != 12 {
+		t.Fail()
+	}
+}
+
+func TestMigrateTagFilter(t *testing.T) {
+	source := &DummySource{}
+	destination := &DummyTSDB{}
+	progress, _ := LoadMigrateProgress("", "source", "destination", nil)
+
+	options := testMigrateOptions
+	options.Tags = []string{"tag2"}
+	err := Migrate(context.Background(), source, destination, options, progress)
+	if err != nil {
+		t.Fail()
+	}
+
+	if len(destination.Values) != 6 {
+		t.Fail()
+	}
+	for _, reading := range destination.Values {
+		if reading.Value != 2 {
+			t.Fail()
+		}
+	}
+}
+
+func TestMigrateResume(t *testing.T) {
+	defer os.Remove("migrate.json")
+	progress, err := LoadMigrateProgress("migrate.json", "source", "destination", nil)
+	if err != nil {
+		t.FailNow()
+	}
+	progress.Complete("temperature", testMigrateOptions.From.AddDate(0, 0, 1))
+
+	// Reload, as if the migration was restarted
+	progress, err = LoadMigrateProgress("migrate.json", "source", "destination", nil)
+	if err != nil {
+		t.FailNow()
+	}
+
+	source := &DummySource{}
+	err = Migrate(context.Background(), source, &DummyTSDB{}, testMigrateOptions, progress)
+	if err != nil {
+		t.Fail()
+	}
+
+	// The first two days of temperature were already done
+	if source.Calls != 4 {
+		t.Fail()
+	}
+}
+
+func TestLoadMigrateProgressMismatch(t *testing.T) {
+	defer os.Remove("migrate.json")
+	ioutil.WriteFile("migrate.json", []byte(`{"Source": "opentsdb", "Destination": "archive"}`), 0600)
+
+	progress, err := LoadMigrateProgress("migrate.json", "opentsdb", "postgres", nil)
+	if err == nil {
+		t.Fail()
+	}
+	if progress != nil {
+		t.Fail()
+	}
+}
+
+func TestMigrateRate(t *testing.T) {
+	source := &DummySource{}
+	destination := &DummyTSDB{}
+	progress, _ := LoadMigrateProgress("", "source", "destination", nil)
+
+	options := testMigrateOptions
+	options.Stats = []string{"temperature"}
+	options.Rate = 20
+
+	// 6 readings at 20/sec, after the initial burst of 20, shouldn't wait
+	start := time.Now()
+	err := Migrate(context.Background(), source, destination, options, progress)
+	if err != nil {
+		t.Fail()
+	}
+	if time.Since(start) > time.Second {
+		t.Fail()
+	}
+	if len(destination.Values) != 6 {
+		t.Fail()
+	}
+}
+
+func TestLoadMigrateProgressTags(t *testing.T) {
+	defer os.Remove("migrate.json")
+	progress, err := LoadMigrateProgress("migrate.json", "opentsdb", "postgres", []string{"tag2", "tag1"})
+	if err != nil {
+		t.FailNow()
+	}
+	progress.Complete("temperature", testMigrateOptions.From)
+
+	// Days done for some tags aren't done for the others
+	_, err = LoadMigrateProgress("migrate.json", "opentsdb", "postgres", nil)
+	if err == nil {
+		t.Fail()
+	}
+	progress, err = LoadMigrateProgress("migrate.json", "opentsdb", "postgres", []string{"tag1", "tag2"})
+	if err != nil || !progress.Done("temperature", testMigrateOptions.From) {
+		t.Fail()
+	}
+}
+
+func TestMigrateCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	source := &DummySource{}
+	progress, _ := LoadMigrateProgress("", "source", "destination", nil)
+
+	err := Migrate(ctx, source, &DummyTSDB{}, testMigrateOptions, progress)
+	if err != context.Canceled || source.Calls != 0 {
+		t.Fail()
+	}
+}
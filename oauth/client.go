@@ -1,11 +1,12 @@
 package oauth
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strings"
 )
 
 var (
@@ -14,8 +15,12 @@ var (
 )
 
 type OAuthClient interface {
-	GetAuthorizeURL() string
+	// GetAuthorizeURL returns the URL to send the browser to, which sends it
+	// back to the redirect URL along with state
+	GetAuthorizeURL(state string) string
 	GetAccessToken(string) (string, error)
+	// GetAccessTokenContext is GetAccessToken, aborted if the context is done
+	GetAccessTokenContext(context.Context, string) (string, error)
 }
 
 type oauthClient struct {
@@ -32,20 +37,39 @@ func NewOAuthClient(id, secret, redirect string) OAuthClient {
 	}
 }
 
-// GetAuthorizeURL returns the URL the browser should be redirected to.
-func (c *oauthClient) GetAuthorizeURL() string {
-	return fmt.Sprintf("%s?client_id=%s&redirect_uri=%s", urlAuthorize, c.clientId, c.redirectUrl)
+// GetAuthorizeURL returns the URL the browser should be redirected to.  State
+// is left out if it's empty.
+func (c *oauthClient) GetAuthorizeURL(state string) string {
+	params := url.Values{
+		"client_id":    {c.clientId},
+		"redirect_uri": {c.redirectUrl},
+	}
+	if state != "" {
+		params.Set("state", state)
+	}
+	return urlAuthorize + "?" + params.Encode()
 }
 
 // GetAccessToken exchanges the code from the user for an access token from the server
 func (c *oauthClient) GetAccessToken(authCode string) (string, error) {
+	return c.GetAccessTokenContext(context.Background(), authCode)
+}
+
+func (c *oauthClient) GetAccessTokenContext(ctx context.Context, authCode string) (string, error) {
 
 	// Make a request to the server, providing the client id+secret+code from user.
-	resp, err := http.PostForm(urlAccessToken, url.Values{
+	form := url.Values{
 		"client_id":     {c.clientId},
 		"client_secret": {c.clientSecret},
 		"code":          {authCode},
-	})
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, urlAccessToken, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return "", err
 	}
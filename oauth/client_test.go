@@ -1,16 +1,26 @@
 package oauth
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func TestGetAuthorizeURL(t *testing.T) {
 	client := NewOAuthClient("abc", "123", "http://example.com")
-	authUrl := client.GetAuthorizeURL()
-	if authUrl != "https://www.mytaglist.com/oauth2/authorize.aspx?client_id=abc&redirect_uri=http://example.com" {
+	authUrl := client.GetAuthorizeURL("")
+	if authUrl != "https://www.mytaglist.com/oauth2/authorize.aspx?client_id=abc&redirect_uri=http%3A%2F%2Fexample.com" {
+		t.Fail()
+	}
+
+	client = NewOAuthClient("a&b", "123", "http://example.com/authorize?x=1")
+	authUrl = client.GetAuthorizeURL("xyz")
+	if authUrl != "https://www.mytaglist.com/oauth2/authorize.aspx?client_id=a%26b&redirect_uri=http%3A%2F%2Fexample.com%2Fauthorize%3Fx%3D1&state=xyz" {
 		t.Fail()
 	}
 }
@@ -52,3 +62,27 @@ func TestGetAccessTokenBadResponse(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestGetAccessTokenContext(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Hang until the client gives up, which the server only notices
+		// once the body has been read.
+		ioutil.ReadAll(r.Body)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer ts.Close()
+
+	urlAccessToken = ts.URL
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	client := NewOAuthClient("abc", "123", "http://example.com")
+	_, err := client.GetAccessTokenContext(ctx, "xxx")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fail()
+	}
+}
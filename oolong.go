@@ -1,105 +1,641 @@
 package main
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/BurntSushi/toml"
+	"github.com/arcticfoxnv/oolong/logging"
+	"github.com/arcticfoxnv/oolong/oauth"
 	"github.com/arcticfoxnv/oolong/state"
+	"github.com/arcticfoxnv/oolong/tsdb"
 	"github.com/arcticfoxnv/oolong/wirelesstag"
+	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 )
 
 const Version = "0.0.4"
 
-func cmdHTTPServer(c *cli.Context) error {
-	// Read config file
-	config := ReadConfigFile(c.GlobalString("config"))
+// newSink creates the client for a single sink, along with its retry policy
+func newSink(config *Config, name string) (tsdb.TSDB, tsdb.SinkPolicy, error) {
+	switch name {
+	case "opentsdb":
+		client := NewOpenTSDBClient(config.OpenTSDB.Host, config.OpenTSDB.Port, config.OpenTSDB.MetricsPrefix)
+		return client, config.OpenTSDB.Policy(), nil
+	case "postgres":
+		client, err := NewPostgresClient(config.Postgres.DSN, config.Postgres.Timescale)
+		if err != nil {
+			return nil, tsdb.SinkPolicy{}, err
+		}
+		return client, config.Postgres.Policy(), nil
+	case "archive":
+		client, err := NewArchive(config.Archive.Directory, config.Archive.Format)
+		if err != nil {
+			return nil, tsdb.SinkPolicy{}, err
+		}
+		return client, config.Archive.Policy(), nil
+	}
+	return nil, tsdb.SinkPolicy{}, fmt.Errorf("Unknown sink %s", name)
+}
 
-	// Channel to signal setup is complete.
-	setupDone := make(chan int)
-	startChan := make(chan string)
+// sinkPolicyConfig returns the retry and buffer settings for a single sink
+func sinkPolicyConfig(config *Config, name string) SinkPolicyConfig {
+	switch name {
+	case "opentsdb":
+		return config.OpenTSDB.SinkPolicyConfig
+	case "postgres":
+		return config.Postgres.SinkPolicyConfig
+	case "archive":
+		return config.Archive.SinkPolicyConfig
+	}
+	return SinkPolicyConfig{}
+}
 
-	// HTTP server is only needed to do OAuth fun.  The resulting token
-	// is saved to the state file for reuse.
-	log.Printf("Starting HTTP server...\n")
-	go StartHTTPServer(config, startChan, setupDone)
+// sinkAggregateConfig returns the downsampling settings for a single sink
+func sinkAggregateConfig(config *Config, name string) AggregateConfig {
+	switch name {
+	case "opentsdb":
+		return config.OpenTSDB.AggregateConfig
+	case "postgres":
+		return config.Postgres.AggregateConfig
+	case "archive":
+		return config.Archive.AggregateConfig
+	}
+	return AggregateConfig{}
+}
 
-	// Wait for the server to initialize
-	startUrl := <-startChan
+// NewTSDBClient creates a client which writes to all of the configured sinks.
+// OpenTSDB is used if no sinks are set, to match configs written before
+// sinks were selectable.
+func NewTSDBClient(config *Config) (*tsdb.Multiplexer, error) {
+	sinks := config.Sinks
+	if len(sinks) == 0 {
+		sinks = []string{"opentsdb"}
+	}
 
-	// Print the URL for the user to visit to start the OAuth dance.
-	log.Printf("Oolong ready!  Go to %s to begin.", startUrl)
+	multiplexer := tsdb.NewMultiplexer()
+	for _, name := range sinks {
+		client, policy, err := newSink(config, name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err.Error())
+		}
+		aggregate := sinkAggregateConfig(config, name)
+		if aggregate.Resolution > 0 {
+			window := time.Duration(aggregate.Resolution) * time.Second
+			client, err = tsdb.NewAggregator(client, window, aggregate.Aggregates)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", name, err.Error())
+			}
+		}
+		multiplexer.AddSink(name, client, policy)
+	}
+	return multiplexer, nil
+}
 
-	// Wait for setup to complete
-	<-setupDone
+// signalContext returns a context which is cancelled on SIGINT or SIGTERM, so
+// commands can stop cleanly instead of being killed part way through a
+// request.  A second signal exits immediately.  The context carries the
+// logger.
+func signalContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Info("Shutting down")
+		cancel()
+		<-signals
+		os.Exit(1)
+	}()
+	return logging.WithLogger(ctx, log.StandardLogger())
+}
 
+// loadConfig loads the config file given on the command line along with any
+// OOLONG_* environment variables.  The log flags take precedence over both.
+func loadConfig(c *cli.Context) (*Config, error) {
+	config, err := LoadConfig(c.GlobalString("config"), os.Environ())
+	if err != nil {
+		return nil, err
+	}
+	if c.GlobalIsSet("log-level") {
+		config.Log.Level = c.GlobalString("log-level")
+	}
+	if c.GlobalIsSet("log-format") {
+		config.Log.Format = c.GlobalString("log-format")
+	}
+	return config, nil
+}
+
+// ReadConfig loads and validates the config, and sets up logging to match.
+// Exits if the config is invalid.
+func ReadConfig(c *cli.Context) *Config {
+	config, err := loadConfig(c)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to load config")
+	}
+	if errs, ok := config.Validate().(ConfigErrors); ok {
+		for _, problem := range errs {
+			log.WithField("problem", problem).Error("Invalid config")
+		}
+		log.Fatal("Config is invalid, see oolong config check")
+	}
+
+	err = logging.Configure(log.StandardLogger(), config.Log.Level, config.Log.Format, nil)
+	if err != nil {
+		log.WithError(err).Fatal("Invalid log settings")
+	}
+	state.SetLogger(log.StandardLogger())
+
+	// Secrets in the state are encrypted with the key, if there is one
+	if config.StateKey != "" {
+		key, err := state.ParseKey(config.StateKey)
+		if err != nil {
+			log.WithError(err).Fatal("Invalid state key")
+		}
+		state.SetKey(key)
+	}
+	if config.StateKeyPrevious != "" {
+		key, err := state.ParseKey(config.StateKeyPrevious)
+		if err != nil {
+			log.WithError(err).Fatal("Invalid previous state key")
+		}
+		state.SetPreviousKey(key)
+	}
+
+	logging.AddSecret(config.OAuth.Secret)
+	logging.AddSecret(config.StateKey)
+	logging.AddSecret(config.StateKeyPrevious)
+	logging.AddSecret(config.OAuth.AccessToken)
+	logging.AddSecret(config.Redis.Password)
+	return config
+}
+
+// NewState creates an empty state in the configured backend.
+func NewState(config *Config) (state.State, error) {
+	switch config.Backend {
+	case "file":
+		return state.NewFileState(config.File.Filename), nil
+	case "redis":
+		options, err := config.Redis.Options()
+		if err != nil {
+			return nil, err
+		}
+		return state.NewRedisState(options, config.Redis.Key), nil
+	}
+	return nil, fmt.Errorf("Unknown state backend %s", config.Backend)
+}
+
+// loadSavedState restores the state as it was saved in the configured backend.
+func loadSavedState(config *Config) (state.State, error) {
+	switch config.Backend {
+	case "file":
+		return state.NewStateFromFile(config.File.Filename)
+	case "redis":
+		options, err := config.Redis.Options()
+		if err != nil {
+			return nil, err
+		}
+		return state.NewStateFromRedis(options, config.Redis.Key)
+	}
+	return nil, fmt.Errorf("Unknown state backend %s", config.Backend)
+}
+
+// LoadState restores the state from the configured backend.  An access token
+// in the config replaces the saved one, and means oolong init can be skipped.
+// The access token is kept out of the logs from then on.
+func LoadState(config *Config) (state.State, error) {
+	st, err := loadSavedState(config)
+	if err == state.ErrNoState && config.OAuth.AccessToken != "" {
+		st, err = NewState(config)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if config.OAuth.AccessToken != "" {
+		st.SetAccessToken(config.OAuth.AccessToken)
+	}
+	logging.AddSecret(st.GetAccessToken())
+	return st, nil
+}
+
+func cmdHTTPServer(c *cli.Context) error {
+	// Read config file
+	config := ReadConfig(c)
+	if c.IsSet("listen") {
+		config.HTTP.Listen = c.String("listen")
+	}
+	if c.IsSet("public-url") {
+		config.HTTP.PublicURL = c.String("public-url")
+	}
+	if c.Bool("tls") {
+		config.HTTP.TLS = true
+	}
+
+	// Create a new state to save the token in
+	st, err := NewState(config)
+	if err != nil {
+		log.WithError(err).Fatal("Unable to initialize state")
+	}
+
+	// Without a browser that can reach us, the user copies the code over
+	// instead
+	if c.Bool("manual") {
+		redirectURL := manualRedirectURL
+		if config.HTTP.PublicURL != "" {
+			redirectURL = strings.TrimRight(config.HTTP.PublicURL, "/") + "/authorize"
+		}
+		client := oauth.NewOAuthClient(config.OAuth.ID, config.OAuth.Secret, redirectURL)
+		err = ManualInit(signalContext(), client, st, os.Stdin, os.Stdout)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		return nil
+	}
+
+	// HTTP server is only needed to do OAuth fun.  The resulting token
+	// is saved to the state file for reuse.
+	log.Info("Starting HTTP server")
+	err = RunInitServer(signalContext(), config, st)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
 	return nil
 }
 
 func cmdPoller(c *cli.Context) error {
-	var st state.State
-	var err error
 
 	// Read config file
-	config := ReadConfigFile(c.GlobalString("config"))
+	config := ReadConfig(c)
 
-	// Initialize data storage client
-	tsdbClient := NewOpenTSDBClient(config.OpenTSDB.Host, config.OpenTSDB.Port, config.OpenTSDB.MetricsPrefix)
+	// Count API calls and sink writes, and serve them if asked to
+	metrics := NewMetrics(config.StaleAfter())
+	if config.Metrics.Listen != "" {
+		server := StartMetricsServer(config.Metrics.Listen, metrics)
+		defer server.Close()
+	}
+
+	ctx := signalContext()
+
+	// Changes to the config file are applied between cycles
+	var reload <-chan *Config
+	filename := c.GlobalString("config")
+	if filename != "" {
+		var err error
+		reload, err = WatchConfig(ctx, filename, config, func() (*Config, error) {
+			return loadConfig(c)
+		})
+		if err != nil {
+			log.WithError(err).Warn("Unable to watch config, changes need a restart")
+		}
+	}
+
+	if !config.Leader.Enabled {
+		err := runPoller(ctx, config, metrics, reload)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		return nil
+	}
+
+	// Only poll while holding the lock.  Another oolong may have polled in
+	// the meantime, so each turn as leader starts from the saved state, and
+	// the latest config, including changes made while standing by.
+	elector, err := NewElector(config, metrics)
+	if err != nil {
+		log.WithError(err).Fatal("Unable to set up leader election")
+	}
+	relay := RelayConfigs(ctx, config, reload)
+	err = elector.Run(ctx, func(ctx context.Context) error {
+		current, reload := relay.Start()
+		defer relay.Stop()
+		return runPoller(ctx, current, metrics, reload)
+	})
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	return nil
+}
 
+// runPoller polls until ctx is cancelled, starting from the saved state.
+// Returns an error if polling can't start, and the failure doesn't look
+// temporary.  The state is closed when it returns, since with leader
+// election each turn as leader loads it again.
+func runPoller(ctx context.Context, config *Config, metrics *Metrics, reload <-chan *Config) error {
 	// Try to load state from backend
-	switch config.Backend {
-	case "file":
-		st, err = state.NewStateFromFile(config.File.Filename)
-	case "redis":
-		st, err = state.NewStateFromRedis(config.Redis.Host, config.Redis.Port, config.Redis.Key)
+	st, err := LoadState(config)
+	if err != nil {
+		return fmt.Errorf("Unable to restore state: %s", err)
+	}
+	if closer, ok := st.(io.Closer); ok {
+		defer closer.Close()
 	}
+	// Stats are stored concurrently, while the sinks move their checkpoints
+	// forward
+	st = state.Synchronized(st)
+
+	// Initialize data storage client, which tracks how far each sink has
+	// been written up to in the state
+	tsdbClient, err := NewPollerSinks(config, st, metrics)
 	if err != nil {
-		log.Fatalf("Unable to restore state: %s\n", err.Error())
+		return fmt.Errorf("Unable to initialize sink: %s", err)
 	}
 
 	// Use token from state file to initialize the wireless tag client
-	tagClient := wirelesstag.NewClient(st.GetAccessToken())
+	options := config.API.ClientOptions()
+	options.Observer = metrics.ObserveRequest
+	tagClient := wirelesstag.NewClientWithOptions(st.GetAccessToken(), options)
 
-	// Retrieve stats from cloud and push to data storage
-	StatsFetcher(config, st, tagClient, tsdbClient)
+	// Retrieve stats from cloud and push to data storage.  Failed stats are
+	// picked up by later cycles, so polling carries on through them.  If
+	// polling can't start, it's retried while the failure looks temporary.
+	for {
+		err = StatsFetcher(ctx, config, st, tagClient, tsdbClient, metrics, logCycleReport, reload)
+		if err == nil || ctx.Err() != nil {
+			return nil
+		}
+		if FetchErrorAction(err) != endCycle {
+			closeSinks(log.StandardLogger(), tsdbClient)
+			return err
+		}
 
+		log.WithError(err).Warn("Unable to start polling, retrying")
+		select {
+		case <-ctx.Done():
+			closeSinks(log.StandardLogger(), tsdbClient)
+			return nil
+		case <-time.After(time.Duration(config.PollInterval) * time.Second):
+		}
+	}
+}
+
+// logCycleReport logs a summary of a poll cycle, and the stats that failed.
+func logCycleReport(report *CycleReport) error {
+	failed := report.Failed()
+	entry := log.WithFields(log.Fields{
+		"cycle":  report.Cycle,
+		"stats":  len(report.Results),
+		"failed": len(failed),
+		"stored": report.Stored(),
+	})
+	if report.Err() == nil {
+		entry.Info("Poll cycle finished")
+		return nil
+	}
+
+	entry.WithError(report.Err()).Warn("Poll cycle finished with failures")
+	for _, result := range failed {
+		log.WithFields(log.Fields{"cycle": report.Cycle, "tag": result.Tag.UUID, "stat": result.Stat}).WithError(result.Err).Debug("Stat failed")
+	}
 	return nil
 }
 
 func cmdBackfill(c *cli.Context) error {
-	var st state.State
-	var err error
 	if c.String("date") == "" {
-		log.Fatalln("--date is required")
+		log.Fatal("--date is required")
 	}
 	// Read config file
-	config := ReadConfigFile(c.GlobalString("config"))
+	config := ReadConfig(c)
 	date, err := time.Parse("2006-01-02", c.String("date"))
 	if err != nil {
-		log.Fatalf("Failed to parse date: %s\n", err.Error())
+		log.WithError(err).Fatal("Failed to parse date")
 	}
 
 	// Initialize data storage client
-	tsdbClient := NewOpenTSDBClient(config.OpenTSDB.Host, config.OpenTSDB.Port, config.OpenTSDB.MetricsPrefix)
+	tsdbClient, err := NewTSDBClient(config)
+	if err != nil {
+		log.WithError(err).Fatal("Unable to initialize sink")
+	}
 
 	// Try to load state from backend
-	switch config.Backend {
-	case "file":
-		st, err = state.NewStateFromFile(config.File.Filename)
-	case "redis":
-		st, err = state.NewStateFromRedis(config.Redis.Host, config.Redis.Port, config.Redis.Key)
+	st, err := LoadState(config)
+	if err != nil {
+		log.WithError(err).Fatal("Unable to restore state")
+	}
+
+	// Use token from state file to initialize the wireless tag client
+	tagClient := wirelesstag.NewClientWithOptions(st.GetAccessToken(), config.API.ClientOptions())
+
+	// Retrieve stats from cloud and push to data storage.  Anything which
+	// failed can be retried by running the backfill again.
+	ctx := signalContext()
+	report, err := Backfill(ctx, config, st, tagClient, tsdbClient, date)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	logCycleReport(report)
+	if report.Err() != nil || ctx.Err() != nil {
+		return cli.NewExitError("Backfill incomplete, run it again to fill in the rest", 1)
+	}
+
+	return nil
+}
+
+func cmdExport(c *cli.Context) error {
+	if c.String("from") == "" || c.String("to") == "" {
+		log.Fatal("--from and --to are required")
 	}
+	// Read config file
+	config := ReadConfig(c)
+	from, err := time.ParseInLocation("2006-01-02", c.String("from"), time.Local)
 	if err != nil {
-		log.Fatalf("Unable to restore state: %s\n", err.Error())
+		log.WithError(err).Fatal("Failed to parse from date")
+	}
+	to, err := time.ParseInLocation("2006-01-02", c.String("to"), time.Local)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to parse to date")
+	}
+
+	// Write to stdout unless a file was given
+	out := os.Stdout
+	if c.String("output") != "-" {
+		out, err = os.Create(c.String("output"))
+		if err != nil {
+			log.WithError(err).Fatal("Failed to create output file")
+		}
+		defer out.Close()
+	}
+	writer, err := NewRecordWriter(out, c.String("format"), true)
+	if err != nil {
+		log.WithError(err).Fatal("Unable to export")
+	}
+
+	// Try to load state from backend
+	st, err := LoadState(config)
+	if err != nil {
+		log.WithError(err).Fatal("Unable to restore state")
 	}
 
 	// Use token from state file to initialize the wireless tag client
-	tagClient := wirelesstag.NewClient(st.GetAccessToken())
+	tagClient := wirelesstag.NewClientWithOptions(st.GetAccessToken(), config.API.ClientOptions())
+
+	// Retrieve stats from cloud and write them out
+	err = Export(signalContext(), config, tagClient, writer, from, to)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to export stats")
+	}
+
+	return nil
+}
+
+func cmdMigrate(c *cli.Context) error {
+	if c.String("source") == "" || c.String("destination") == "" {
+		log.Fatal("--source and --destination are required")
+	}
+	if c.String("from") == "" || c.String("to") == "" {
+		log.Fatal("--from and --to are required")
+	}
+	// Read config file
+	config := ReadConfig(c)
+	from, err := time.ParseInLocation("2006-01-02", c.String("from"), time.Local)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to parse from date")
+	}
+	to, err := time.ParseInLocation("2006-01-02", c.String("to"), time.Local)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to parse to date")
+	}
+
+	options := MigrateOptions{
+		From:  from,
+		To:    to,
+		Stats: c.StringSlice("stat"),
+		Tags:  c.StringSlice("tag"),
+		Rate:  c.Int("rate"),
+	}
+	if len(options.Stats) == 0 {
+		options.Stats = config.QueryStats
+	}
+
+	// Both ends use the settings from their sections of the config file, but
+	// skip the multiplexer so that any write failure stops the migration.
+	sourceClient, _, err := newSink(config, c.String("source"))
+	if err != nil {
+		log.WithError(err).Fatal("Unable to initialize source")
+	}
+	defer closeSinks(log.StandardLogger(), sourceClient)
+	source, ok := sourceClient.(tsdb.Source)
+	if !ok {
+		return cli.NewExitError(fmt.Sprintf("Unable to read from sink %s", c.String("source")), 1)
+	}
+	destination, _, err := newSink(config, c.String("destination"))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to initialize destination: %s", err), 1)
+	}
+	defer closeSinks(log.StandardLogger(), destination)
+
+	progress, err := LoadMigrateProgress(c.String("progress"), c.String("source"), c.String("destination"), options.Tags)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to load progress: %s", err), 1)
+	}
+
+	ctx := signalContext()
+	err = Migrate(ctx, source, destination, options, progress)
+	if ctx.Err() != nil {
+		log.Info("Migration stopped, re-run to resume")
+		return nil
+	}
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Migration failed, re-run to resume: %s", err), 1)
+	}
+
+	return nil
+}
+
+// cmdStateRekey saves the state again with a new key, or in plain text with
+// --decrypt.  The current key comes from the config as usual.
+func cmdStateRekey(c *cli.Context) error {
+	config := ReadConfig(c)
+
+	// A poller would save the state again with the old key, undoing the
+	// rekey, so make sure no leader is polling.  Pollers without leader
+	// election can't be seen, and have to be stopped first.
+	if !c.Bool("force") {
+		lock, err := leaderLock(config, config.Leader.LeaderID(), time.Duration(config.Leader.TTL)*time.Second)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		holder, err := lock.Holder()
+		if err != nil {
+			log.WithError(err).Warn("Unable to check for a leader polling with this state")
+		} else if holder != "" {
+			return cli.NewExitError(fmt.Sprintf("oolong %s is polling with this state.  Stop it first, or change keys with state_key_previous instead.", holder), 1)
+		}
+	}
+
+	st, err := loadSavedState(config)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to load state: %s", err), 1)
+	}
+
+	var newKey *state.Key
+	generated := ""
+	if !c.Bool("decrypt") {
+		encoded := c.String("new-key")
+		if c.String("new-key-file") != "" {
+			data, err := ioutil.ReadFile(c.String("new-key-file"))
+			if err != nil {
+				return cli.NewExitError(err.Error(), 1)
+			}
+			encoded = string(data)
+		}
+		if encoded == "" {
+			encoded, err = state.GenerateKey()
+			if err != nil {
+				return cli.NewExitError(err.Error(), 1)
+			}
+			generated = encoded
+		}
+		newKey, err = state.ParseKey(encoded)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
+
+	state.SetKey(newKey)
+	err = st.Save()
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("Unable to save state: %s", err), 1)
+	}
+
+	if newKey == nil {
+		log.Info("State saved in plain text, remove state_key from the config")
+		return nil
+	}
+	log.WithField("key_id", newKey.ID()).Info("State encrypted with the new key, set it as state_key in the config")
+	if generated != "" {
+		fmt.Println(generated)
+	}
+	return nil
+}
+
+// cmdConfigCheck prints the config after defaults and overrides have been
+// applied, followed by anything wrong with it.
+func cmdConfigCheck(c *cli.Context) error {
+	config, err := loadConfig(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
 
-	// Retrieve stats from cloud and push to data storage
-	Backfill(config, st, tagClient, tsdbClient, date)
+	err = toml.NewEncoder(os.Stdout).Encode(config.Redacted().Map())
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
 
+	if errs, ok := config.Validate().(ConfigErrors); ok {
+		fmt.Fprintln(os.Stderr)
+		for _, problem := range errs {
+			fmt.Fprintf(os.Stderr, "error: %s\n", problem)
+		}
+		return cli.NewExitError(fmt.Sprintf("%d problems found", len(errs)), 1)
+	}
+	fmt.Fprintln(os.Stderr, "\nConfig is valid")
 	return nil
 }
 
@@ -110,16 +646,85 @@ func main() {
 	app.Version = Version
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
-			Name:  "config",
-			Value: "oolong.toml",
-			Usage: "Specifies path to config file",
+			Name:   "config",
+			Value:  "oolong.toml",
+			Usage:  "Specifies path to config file, or empty to configure from the environment only",
+			EnvVar: "OOLONG_CONFIG",
+		},
+		cli.StringFlag{
+			Name:  "log-level",
+			Value: "info",
+			Usage: "Log level: trace, debug, info, warning or error",
+		},
+		cli.StringFlag{
+			Name:  "log-format",
+			Value: "text",
+			Usage: "Log format: text, logfmt or json",
 		},
 	}
 	app.Commands = []cli.Command{
+		{
+			Name:  "config",
+			Usage: "Inspect the config",
+			Subcommands: []cli.Command{
+				{
+					Name:   "check",
+					Usage:  "Validate the config and print it with defaults and overrides applied",
+					Action: cmdConfigCheck,
+				},
+			},
+		},
+		{
+			Name:  "state",
+			Usage: "Manage the saved state",
+			Subcommands: []cli.Command{
+				{
+					Name:   "rekey",
+					Usage:  "Encrypt the secrets in the state with a new key, printing the key if one is generated",
+					Action: cmdStateRekey,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "new-key",
+							Usage: "Base64 key to encrypt with (default: generate one)",
+						},
+						cli.StringFlag{
+							Name:  "new-key-file",
+							Usage: "File to read the new key from",
+						},
+						cli.BoolFlag{
+							Name:  "decrypt",
+							Usage: "Store the secrets in plain text instead",
+						},
+						cli.BoolFlag{
+							Name:  "force",
+							Usage: "Rekey even if a leader is polling with the state",
+						},
+					},
+				},
+			},
+		},
 		{
 			Name:   "init",
 			Usage:  "Run the HTTP server to setup OAuth",
 			Action: cmdHTTPServer,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "manual",
+					Usage: "Don't run a server, paste the URL the browser is sent back to instead",
+				},
+				cli.StringFlag{
+					Name:  "listen",
+					Usage: "Address for the server to listen on, e.g. 127.0.0.1:10000 (default: http.listen from the config)",
+				},
+				cli.StringFlag{
+					Name:  "public-url",
+					Usage: "URL the browser reaches the server at (default: http.public_url from the config)",
+				},
+				cli.BoolFlag{
+					Name:  "tls",
+					Usage: "Serve HTTPS, with a self-signed certificate unless http.tls_cert is set",
+				},
+			},
 		},
 		{
 			Name:   "run",
@@ -137,6 +742,71 @@ func main() {
 				},
 			},
 		},
+		{
+			Name:   "export",
+			Usage:  "Retrieve a range of days and write them to a file",
+			Action: cmdExport,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "from",
+					Usage: "Specify the first date to retrieve (format: YYYY-MM-DD)",
+				},
+				cli.StringFlag{
+					Name:  "to",
+					Usage: "Specify the last date to retrieve (format: YYYY-MM-DD)",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "csv",
+					Usage: "Output format: csv, jsonl or parquet",
+				},
+				cli.StringFlag{
+					Name:  "output",
+					Value: "-",
+					Usage: "File to write to, or - for stdout",
+				},
+			},
+		},
+		{
+			Name:   "migrate-data",
+			Usage:  "Copy stored readings from one sink to another",
+			Action: cmdMigrate,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "source",
+					Usage: "Sink to read from: opentsdb, postgres or archive",
+				},
+				cli.StringFlag{
+					Name:  "destination",
+					Usage: "Sink to write to",
+				},
+				cli.StringFlag{
+					Name:  "from",
+					Usage: "Specify the first date to copy (format: YYYY-MM-DD)",
+				},
+				cli.StringFlag{
+					Name:  "to",
+					Usage: "Specify the last date to copy (format: YYYY-MM-DD)",
+				},
+				cli.StringSliceFlag{
+					Name:  "stat",
+					Usage: "Stat to copy, can be repeated (default: query_stats from the config)",
+				},
+				cli.StringSliceFlag{
+					Name:  "tag",
+					Usage: "Tag UUID or name to copy, can be repeated (default: all tags)",
+				},
+				cli.IntFlag{
+					Name:  "rate",
+					Usage: "Maximum readings to write per second (default: unlimited)",
+				},
+				cli.StringFlag{
+					Name:  "progress",
+					Value: "migrate.json",
+					Usage: "File to record progress in, so an interrupted migration can be resumed",
+				},
+			},
+		},
 	}
 
 	app.Run(os.Args)
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/arcticfoxnv/oolong/state"
+)
+
+func TestNewTSDBClientDefault(t *testing.T) {
+	config := &Config{}
+	client, err := NewTSDBClient(config)
+	if err != nil {
+		t.Fail()
+	}
+
+	stats := client.Stats()
+	if len(stats) != 1 || stats[0].Name != "opentsdb" {
+		t.Fail()
+	}
+}
+
+func TestNewTSDBClientUnknownSink(t *testing.T) {
+	config := &Config{Sinks: []string{"opentsdb", "nowhere"}}
+	client, err := NewTSDBClient(config)
+	if err == nil {
+		t.Fail()
+	}
+	if client != nil {
+		t.Fail()
+	}
+}
+
+func TestNewTSDBClientAggregate(t *testing.T) {
+	config := &Config{Sinks: []string{"opentsdb"}}
+	config.OpenTSDB.Resolution = 300
+	config.OpenTSDB.Aggregates = []string{"min", "median"}
+	client, err := NewTSDBClient(config)
+	if err == nil || client != nil {
+		t.Fail()
+	}
+
+	config.OpenTSDB.Aggregates = []string{"min", "max"}
+	client, err = NewTSDBClient(config)
+	if err != nil || client == nil {
+		t.Fail()
+	}
+}
+
+func TestLoadStateAccessToken(t *testing.T) {
+	config := &Config{Backend: "file"}
+	config.File.Filename = "missing.json"
+	_, err := LoadState(config)
+	if err != state.ErrNoState {
+		t.Fail()
+	}
+
+	// Without any saved state, the configured token is enough to start
+	config.OAuth.AccessToken = "abc"
+	st, err := LoadState(config)
+	if err != nil || st.GetAccessToken() != "abc" {
+		t.Fail()
+	}
+}
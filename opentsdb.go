@@ -1,25 +1,51 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/arcticfoxnv/oolong/tsdb"
 	"github.com/arcticfoxnv/oolong/wirelesstag"
 	"github.com/bluebreezecf/opentsdb-goclient/client"
 	"github.com/bluebreezecf/opentsdb-goclient/config"
 )
 
+// How long a query for a single day and stat may take
+const openTSDBQueryTimeout = 2 * time.Minute
+
 type OpenTSDB struct {
 	client client.Client
 	prefix string
+	// Base URL of the HTTP API, used for queries
+	url        string
+	httpClient *http.Client
+}
+
+// A single series returned by /api/query
+type openTSDBQueryResult struct {
+	Metric string
+	Tags   map[string]string
+	// unix timestamp -> value
+	Dps map[string]float32
 }
 
 func NewOpenTSDBClient(host string, port int, metricPrefix string) *OpenTSDB {
 	cfg := config.OpenTSDBConfig{OpentsdbHost: fmt.Sprintf("%s:%d", host, port)}
 	c, _ := client.NewClient(cfg)
 	return &OpenTSDB{
-		client: c,
-		prefix: metricPrefix,
+		client:     c,
+		prefix:     metricPrefix,
+		url:        fmt.Sprintf("http://%s:%d", host, port),
+		httpClient: &http.Client{Timeout: openTSDBQueryTimeout},
 	}
 }
 
@@ -46,3 +72,78 @@ func (c *OpenTSDB) PutValue(tag *wirelesstag.Tag, valueType string, reading wire
 	_, err := c.client.Put([]client.DataPoint{data}, "summary")
 	return err
 }
+
+// GetValues queries /api/query for every tag's readings of a stat.  Tag names
+// are returned as stored, with spaces replaced by underscores.
+func (c *OpenTSDB) GetValues(ctx context.Context, valueType string, from, to time.Time) ([]tsdb.Series, error) {
+	query, _ := json.Marshal(map[string]interface{}{
+		"start": from.Unix(),
+		"end":   to.Unix(),
+		"queries": []map[string]interface{}{
+			{
+				// Group by both tags, so each tag is returned as its own series
+				"aggregator": "none",
+				"metric":     fmt.Sprintf("%s.%s", c.prefix, valueType),
+				"tags": map[string]string{
+					"uuid": "*",
+					"name": "*",
+				},
+			},
+		},
+	})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url+"/api/query", bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// OpenTSDB returns 404 when the metric has never been written
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Query failed: " + string(body))
+	}
+
+	var results []openTSDBQueryResult
+	err = json.Unmarshal(body, &results)
+	if err != nil {
+		return nil, err
+	}
+
+	series := []tsdb.Series{}
+	for _, result := range results {
+		s := tsdb.Series{
+			Tag: wirelesstag.Tag{
+				UUID: result.Tags["uuid"],
+				Name: result.Tags["name"],
+			},
+		}
+		for timestamp, value := range result.Dps {
+			unix, err := strconv.ParseInt(timestamp, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			s.Readings = append(s.Readings, wirelesstag.Reading{
+				Timestamp: time.Unix(unix, 0),
+				Value:     value,
+			})
+		}
+		sort.Slice(s.Readings, func(i, j int) bool {
+			return s.Readings[i].Timestamp.Before(s.Readings[j].Timestamp)
+		})
+		series = append(series, s)
+	}
+	return series, nil
+}
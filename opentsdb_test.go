@@ -1,6 +1,10 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -52,3 +56,69 @@ func TestPrepareValue(t *testing.T) {
 	}
 
 }
+
+func TestOpenTSDBGetValues(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/query" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `[{"metric": "test.temperature", "tags": {"uuid": "xxx", "name": "tag_1"}, "dps": {"1136214300": 22.5, "1136214245": 21.5}}]`)
+	}))
+	defer ts.Close()
+
+	c := NewOpenTSDBClient("localhost", 12345, "test")
+	c.url = ts.URL
+	series, err := c.GetValues(context.Background(), "temperature", time.Unix(0, 0), time.Now())
+	if err != nil {
+		t.FailNow()
+	}
+
+	if len(series) != 1 || len(series[0].Readings) != 2 {
+		t.FailNow()
+	}
+	if series[0].Tag.UUID != "xxx" || series[0].Tag.Name != "tag_1" {
+		t.Fail()
+	}
+
+	// Readings should be sorted by time
+	if series[0].Readings[0].Timestamp.Unix() != 1136214245 || series[0].Readings[0].Value != 21.5 {
+		t.Fail()
+	}
+}
+
+func TestOpenTSDBGetValuesUnknownMetric(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	c := NewOpenTSDBClient("localhost", 12345, "test")
+	c.url = ts.URL
+	series, err := c.GetValues(context.Background(), "temperature", time.Unix(0, 0), time.Now())
+	if err != nil {
+		t.Fail()
+	}
+	if len(series) != 0 {
+		t.Fail()
+	}
+}
+
+func TestOpenTSDBGetValuesCancelled(t *testing.T) {
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	c := NewOpenTSDBClient("localhost", 12345, "test")
+	c.url = ts.URL
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := c.GetValues(ctx, "temperature", time.Unix(0, 0), time.Now())
+	if err == nil {
+		t.Fail()
+	}
+}
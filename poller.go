@@ -1,106 +1,667 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
 	"time"
 
+	"github.com/arcticfoxnv/oolong/logging"
 	"github.com/arcticfoxnv/oolong/state"
 	"github.com/arcticfoxnv/oolong/tsdb"
 	"github.com/arcticfoxnv/oolong/wirelesstag"
+	"github.com/sirupsen/logrus"
 )
 
-func StatsFetcher(config *Config, state state.State, tagClient wirelesstag.Client, tsdbClient tsdb.TSDB) {
+// ErrNotFetched is the error for stats which weren't fetched because an
+// earlier failure ended the cycle.
+var ErrNotFetched = errors.New("Not fetched, the cycle ended early")
+
+// StatResult says what happened to one stat of one tag during a cycle.
+type StatResult struct {
+	Tag  wirelesstag.Tag
+	Stat string
+	// New readings stored
+	Stored int
+	// New readings removed by the sanity filter
+	Dropped int
+	// Why the stat couldn't be fetched or stored, if it couldn't
+	Err error
+}
+
+// CycleReport says what happened during a poll cycle.
+type CycleReport struct {
+	Cycle    int
+	Calls    int
+	Failures []FetchFailure
+	// One for each tag and stat
+	Results []StatResult
+	// Set if the state couldn't be saved at the end of the cycle
+	SaveErr error
+}
+
+// Failed returns the results for stats which couldn't be fetched or stored.
+func (r *CycleReport) Failed() []StatResult {
+	var failed []StatResult
+	for _, result := range r.Results {
+		if result.Err != nil {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+// Stored returns the number of new readings stored.
+func (r *CycleReport) Stored() int {
+	stored := 0
+	for _, result := range r.Results {
+		stored += result.Stored
+	}
+	return stored
+}
+
+// Err summarises what went wrong during the cycle, or returns nil if
+// everything worked.
+func (r *CycleReport) Err() error {
+	if r.SaveErr != nil {
+		return fmt.Errorf("Failed to save state: %s", r.SaveErr.Error())
+	}
+	failed := r.Failed()
+	if len(failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d of %d stats failed, e.g. %s for tag %s: %s", len(failed), len(r.Results), failed[0].Stat, failed[0].Tag.UUID, failed[0].Err.Error())
+}
+
+// Poller fetches new readings of the configured stats for a fixed set of
+// tags, and stores them.
+type Poller struct {
+	config     *Config
+	state      state.State
+	tagClient  wirelesstag.Client
+	tsdbClient tsdb.TSDB
+	metrics    *Metrics
+
+	tags   []wirelesstag.Tag
+	groups []TagGroup
+	plan   QueryPlan
+	filter *SanityFilter
+
+	cycle         int
+	lastFetchTime time.Time
+	// stat -> when it was last fetched, as stats with an interval aren't
+	// fetched every cycle
+	statFetchTime map[string]time.Time
+	// stat -> the tick it was last fetched for without failing
+	statTick map[string]time.Time
+	// uuid/stat -> the newest dropped reading reported.  The newest reading
+	// can be held back as a possible spike for several cycles, and is only
+	// reported once.
+	droppedUpTo map[string]time.Time
+	droppedLock sync.Mutex
+}
+
+// NewPoller loads the list of tags and works out how to fetch their stats.
+// Progress is recorded in metrics, if it isn't nil.
+func NewPoller(ctx context.Context, config *Config, state state.State, tagClient wirelesstag.Client, tsdbClient tsdb.TSDB, metrics *Metrics) (*Poller, error) {
+	log := logging.FromContext(ctx)
 
 	// Get tag list
-	log.Printf("Fetching list of tags...\n")
-	tags, err := GetTags(tagClient)
+	log.Info("Fetching list of tags")
+	tags, err := GetTags(ctx, tagClient)
 	if err != nil {
-		log.Fatalf("Failed to load tags: %s\n", err.Error())
+		return nil, fmt.Errorf("Failed to load tags: %w", err)
 	}
 
-	// Extract ids for use later
-	var tagIds []int
-	for _, t := range tags {
-		tagIds = append(tagIds, t.SlaveId)
+	p := &Poller{
+		state:         state,
+		tagClient:     tagClient,
+		metrics:       metrics,
+		tags:          tags,
+		lastFetchTime: time.Now(),
+		statFetchTime: make(map[string]time.Time),
+		statTick:      make(map[string]time.Time),
+		droppedUpTo:   make(map[string]time.Time),
+	}
+	err = p.Reconfigure(ctx, config, tsdbClient)
+	if err != nil {
+		return nil, err
 	}
-	lastFetchTime := time.Now()
+	return p, nil
+}
 
-	for {
-		startDay := time.Now()
-		endDay := startDay
-
-		// Check if we started a new day.  If so, we need to include yesterday
-		// in the next fetch to grab any readings added between the last fetch
-		// and end of day.
-		if startDay.Hour() < lastFetchTime.Hour() {
-			startDay = startDay.Add(-24 * time.Hour)
-			log.Printf("New day started.  Adjusting query to include end of day %s", startDay.Format("2006-01-02"))
-		}
-
-		// We need to do a separate query for each of the stats we want.
-		// The GetStatsRaw API method gets all of these (except battery it seems)
-		// in one call, but only for a single tag.  The GetMultiTagStatsRaw API
-		// method only returns one stat, but for multiple tags.
-		// We're using the Multi method, which should save on total API calls
-		// once the number of tags we query per call is more than 3.
-		for _, queryType := range config.QueryStats {
-			stats, err := GetStats(tagClient, queryType, tagIds, startDay, endDay)
-			if err != nil {
-				log.Printf("Failed to load raw %s stats: %s\n", queryType, err.Error())
+// Reconfigure switches the poller to a new config and sinks, which are used
+// from the next cycle.  The poller is left as it was if the new config can't
+// be used.
+func (p *Poller) Reconfigure(ctx context.Context, config *Config, tsdbClient tsdb.TSDB) error {
+	log := logging.FromContext(ctx)
+
+	// Readings are fetched separately for tag managers in different time
+	// zones, since the API works in local time.
+	groups, err := GroupTagsByLocation(config, p.tags)
+	if err != nil {
+		return fmt.Errorf("Invalid time zone: %w", err)
+	}
+
+	// Work out which API methods to fetch the stats with
+	plan, err := PlanQueries(config.PollingStrategy, config.QueryStats, len(p.tags))
+	if err != nil {
+		return err
+	}
+	plannedCalls := 0
+	for _, group := range groups {
+		plannedCalls += plan.Calls(len(group.Tags))
+	}
+	log.WithFields(logrus.Fields{"strategy": plan.Strategy, "calls": plannedCalls}).Info("Planned API calls per cycle")
+
+	// Some sinks keep tag and tag manager details as well as readings
+	if tsdbClient != p.tsdbClient {
+		err = StoreTagMetadata(ctx, p.tagClient, tsdbClient)
+		if err != nil {
+			log.WithError(err).Warn("Failed to store tag metadata")
+		}
+	}
+
+	p.config = config
+	p.tsdbClient = tsdbClient
+	p.groups = groups
+	p.plan = plan
+	p.filter = NewSanityFilter(config.Filter)
+	return nil
+}
+
+// RunCycle fetches and stores any new readings of the stats due now, then
+// saves the state.
+func (p *Poller) RunCycle(ctx context.Context) *CycleReport {
+	return p.RunCycleAt(ctx, time.Now())
+}
+
+// RunCycleAt fetches and stores any new readings of the stats due at tick,
+// then saves the state.  Failures are recorded in the report rather than
+// stopping the cycle, and the readings missed are picked up by a later cycle.
+func (p *Poller) RunCycleAt(ctx context.Context, tick time.Time) *CycleReport {
+	p.cycle++
+	report := &CycleReport{Cycle: p.cycle}
+
+	// Everything logged during the cycle can be picked out by its id
+	ctx = logging.WithFields(ctx, logrus.Fields{"cycle": p.cycle})
+	log := logging.FromContext(ctx)
+
+	queryStats := p.dueStats(tick)
+	if len(queryStats) < len(p.config.QueryStats) {
+		log.WithField("stats", queryStats).Debug("Only fetching the stats which are due")
+	}
+
+	// Fetch from the start of the last cycle which fetched the stat without
+	// failing.  The API is queried by date, so if a new day has started since
+	// (in the tag manager's time zone), yesterday is included to grab any
+	// readings added between the last fetch and end of day.
+	endDay := time.Now()
+	starts := make(map[string]time.Time)
+	for _, queryType := range queryStats {
+		startDay, ok := p.statFetchTime[queryType]
+		if !ok {
+			startDay = p.lastFetchTime
+		}
+		// Kept until the stat is fetched, so it isn't moved on by a later
+		// lastFetchTime
+		p.statFetchTime[queryType] = startDay
+
+		starts[queryType] = CatchUpStart(p.config, p.tsdbClient, p.tags, queryType, startDay)
+		if starts[queryType].Before(startDay) {
+			log.WithFields(logrus.Fields{"stat": queryType, "from": starts[queryType].Format("2006-01-02")}).Info("Catching up stats")
+		}
+	}
+	p.lastFetchTime = endDay
+
+	// Stats are stored as they're fetched, by as many workers as there are
+	// fetching.  Each tag's stat comes from a single call, so a tag and
+	// stat's state is only updated by one worker.
+	fetched := make(chan FetchedStat)
+	var (
+		calls    int
+		failures []FetchFailure
+	)
+	go func() {
+		defer close(fetched)
+		calls, failures = FetchStats(ctx, p.config, p.state, p.tagClient, p.plan.Only(queryStats), p.groups, starts, endDay, fetched)
+	}()
+
+	// Stats return tags by SlaveId, but we store tags in state/datastore by
+	// UUID.
+	tags := make(map[int]wirelesstag.Tag)
+	for _, tag := range p.tags {
+		tags[tag.SlaveId] = tag
+	}
+	results := make(map[string]map[int]StatResult)
+	for _, queryType := range queryStats {
+		results[queryType] = make(map[int]StatResult)
+	}
+	var lock sync.Mutex
+	workers := p.config.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for stat := range fetched {
+				tag, ok := tags[stat.Value.SlaveId]
+				if !ok {
+					continue
+				}
+				result := p.storeStat(log, tag, stat.Stat, stat.Value)
+				lock.Lock()
+				results[stat.Stat][tag.SlaveId] = result
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	report.Calls = calls
+	report.Failures = failures
+	log.WithFields(logrus.Fields{"calls": calls, "failed": len(failures)}).Info("Fetched stats")
+
+	for _, queryType := range queryStats {
+		ok := true
+		for _, tag := range p.tags {
+			result, fetched := results[queryType][tag.SlaveId]
+			if !fetched {
+				result = StatResult{Tag: tag, Stat: queryType, Err: fetchError(failures, tag, queryType)}
+			}
+			ok = ok && result.Err == nil
+			report.Results = append(report.Results, result)
+		}
+		// Failed stats are tried again on the next tick, from the same start
+		if ok {
+			p.statTick[queryType] = tick
+			p.statFetchTime[queryType] = endDay
+		}
+	}
+
+	// Once all of the stats have been processed, update the state file on disk
+	report.SaveErr = p.state.Save()
+	if report.SaveErr != nil {
+		log.WithError(report.SaveErr).Error("Failed to save state")
+		p.metrics.StateSaveFailed()
+	}
+	p.metrics.CycleFinished(report.Err() == nil)
+
+	// Log how each of the sinks is doing
+	if multiplexer, ok := p.tsdbClient.(*tsdb.Multiplexer); ok {
+		for _, s := range multiplexer.Stats() {
+			log.WithFields(logrus.Fields{
+				"sink":     s.Name,
+				"written":  s.Written,
+				"failed":   s.Failed,
+				"buffered": s.Buffered,
+				"dropped":  s.Dropped,
+			}).Info("Sink stats")
+		}
+	}
+
+	return report
+}
+
+// dueStats returns the stats to fetch in the cycle for tick: those without an
+// interval of their own, and those whose interval is up since the tick they
+// were last fetched for.
+func (p *Poller) dueStats(tick time.Time) []string {
+	var due []string
+	for _, queryType := range p.config.QueryStats {
+		last, ok := p.statTick[queryType]
+		if !ok || tick.Sub(last) >= p.config.StatInterval(queryType) {
+			due = append(due, queryType)
+		}
+	}
+	return due
+}
+
+// storeStat filters the new readings of a stat and stores them.
+func (p *Poller) storeStat(log logrus.FieldLogger, tag wirelesstag.Tag, queryType string, stat wirelesstag.Stat) StatResult {
+	result := StatResult{Tag: tag, Stat: queryType}
+	log = log.WithFields(logrus.Fields{"tag": tag.UUID, "stat": queryType, "manager": tag.ManagerMac})
+
+	// Determine the last time this stat for this tag was updated
+	lastUpdated := LastUpdateTime(p.state, p.tsdbClient, tag.UUID, queryType)
+
+	// Drop readings which can't be right.  The whole fetch is filtered so
+	// spikes can be judged against the readings around them, but only new
+	// readings are reported.
+	var dropped []DroppedReading
+	stat.Readings, dropped = p.filter.Filter(queryType, stat.Readings)
+	dropped = ReportDroppedReadings(log, dropped, p.reportedDrops(tag.UUID, queryType, lastUpdated, dropped))
+	p.metrics.ReadingsDropped(queryType, dropped)
+	result.Dropped = len(dropped)
+
+	// Filter out old readings
+	newStat := FilterNewStats(stat, lastUpdated)
+	p.metrics.ReadingsFetched(queryType, len(newStat.Readings))
+	log.WithField("readings", len(newStat.Readings)).Debug("Fetched new readings")
+
+	// Special handling for temperature - values are returned from the API
+	// in celsius, but for those unlucky few who grew up learning fahrenheit
+	// instead, convert to something we can read
+	if queryType == "temperature" && p.config.ConvertToF {
+		ConvertReadingsCToF(newStat.Readings)
+	}
+
+	// Store all of the remaining readings for this stat/tag.  The state
+	// isn't moved forward if this fails, so they're fetched again next time.
+	result.Err = tsdb.PutValues(p.tsdbClient, &tag, queryType, newStat.Readings)
+	if result.Err != nil {
+		log.WithError(result.Err).Error("Failed to store values")
+		return result
+	}
+	result.Stored = len(newStat.Readings)
+
+	// Update the state with the newest timestamp
+	if len(newStat.Readings) > 0 {
+		p.state.Update(tag.UUID, queryType, newStat.Readings[len(newStat.Readings)-1].Timestamp)
+	}
+	return result
+}
+
+// reportedDrops returns the time dropped readings of a tag's stat have been
+// reported up to, at least since, and moves it on past those in dropped.
+func (p *Poller) reportedDrops(uuid, queryType string, since time.Time, dropped []DroppedReading) time.Time {
+	p.droppedLock.Lock()
+	defer p.droppedLock.Unlock()
+	key := uuid + "/" + queryType
+	upTo := p.droppedUpTo[key]
+	if since.After(upTo) {
+		upTo = since
+	}
+	for _, d := range dropped {
+		if d.Timestamp.After(p.droppedUpTo[key]) {
+			p.droppedUpTo[key] = d.Timestamp
+		}
+	}
+	return upTo
+}
+
+// fetchError returns the error from the call which should have fetched a
+// tag's stat.
+func fetchError(failures []FetchFailure, tag wirelesstag.Tag, queryType string) error {
+	for _, failure := range failures {
+		for _, t := range failure.Tags {
+			if t.SlaveId != tag.SlaveId {
 				continue
 			}
-			log.Printf("Fetched %s stats for %d tags\n", queryType, len(stats))
-			// Iterate through each returned stat (one stat per tag)
-			for _, stat := range stats {
-				// Stats return tags by SlaveId, but we store tags in state/datastore
-				// by UUID.
-				tag := GetTagBySlaveId(tags, stat.SlaveId)
-
-				// Determine the last time this stat for this tag was updated
-				lastUpdated := time.Time{}
-				if !state.GetLastUpdateTime(tag.UUID, queryType).Equal(lastUpdated) {
-					lastUpdated = state.GetLastUpdateTime(tag.UUID, queryType)
+			for _, s := range failure.Stats {
+				if s == queryType {
+					return failure.Err
 				}
+			}
+		}
+	}
+	return ErrNotFetched
+}
+
+// CycleHandler is given the report of each poll cycle.  Returning an error
+// stops polling.
+type CycleHandler func(*CycleReport) error
+
+// NewPollerSinks creates the sinks for the poller, keeping their checkpoints in
+// the state and recording writes in metrics.
+func NewPollerSinks(config *Config, state state.State, metrics *Metrics) (*tsdb.Multiplexer, error) {
+	tsdbClient, err := NewTSDBClient(config)
+	if err != nil {
+		return nil, err
+	}
+	tsdbClient.SetCheckpointer(state)
+	tsdbClient.SetObserver(metrics.ObserveWrite)
+	return tsdbClient, nil
+}
+
+// StatsFetcher polls the API for new readings on the configured schedule
+// until the context is cancelled or handle returns an error, which it then
+// returns.  It also returns an error if polling couldn't start.  Progress is
+// recorded in metrics, if it isn't nil, and configs received from reload, if
+// it isn't nil, are applied between cycles.  Once polling has started, the
+// sinks are closed when it returns, including any created for a reloaded
+// config.
+func StatsFetcher(ctx context.Context, config *Config, state state.State, tagClient wirelesstag.Client, tsdbClient tsdb.TSDB, metrics *Metrics, handle CycleHandler, reload <-chan *Config) error {
+	log := logging.FromContext(ctx)
+
+	// The first cycle runs straight away, and the schedule is kept from then
+	start := time.Now()
+	schedule, err := NewSchedule(config, start)
+	if err != nil {
+		return err
+	}
+
+	poller, err := NewPoller(ctx, config, state, tagClient, tsdbClient, metrics)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		closeSinks(log, poller.tsdbClient)
+	}()
+
+	tick := start
+	for {
+		report := poller.RunCycleAt(ctx, tick)
+		if handle != nil {
+			err := handle(report)
+			if err != nil {
+				return err
+			}
+		}
 
-				// Filter out old readings
-				newStat := FilterNewStats(stat, lastUpdated)
-				log.Printf("  * Fetched %d new %s stats for tag %s (%d)", len(newStat.Readings), queryType, tag.UUID, stat.SlaveId)
-
-				// Process all of the remaining readings for this stat/tag
-				for _, reading := range newStat.Readings {
-
-					// Special handling for temperature - values are returned from
-					// the API in celsius, but for those unlucky few who grew up
-					// learning fahrenheit instead, convert to something we can read
-					if queryType == "temperature" && config.ConvertToF {
-						reading.Value = ConvertCToF(reading.Value)
-					}
-
-					// Store value in the data store
-					err := tsdbClient.PutValue(tag, queryType, reading)
-					if err != nil {
-						log.Fatalf("Failed to store value: %s\n", err.Error())
-					}
-					// Update the state with new timestamp
-					state.Update(tag.UUID, queryType, reading.Timestamp)
+		// Wait for the next tick, unless we're being shut down.  A new
+		// schedule applies to the current wait.
+		last := tick
+		tick = nextCycle(log, schedule, last, metrics)
+		if tick.IsZero() {
+			return errors.New("The schedule has no more ticks")
+		}
+		wait := time.NewTimer(time.Until(tick.Add(config.Jitter())))
+	sleep:
+		for {
+			select {
+			case <-ctx.Done():
+				wait.Stop()
+				log.Info("Stopping poller")
+				return nil
+			case newConfig := <-reload:
+				newSchedule, err := NewSchedule(newConfig, start)
+				if err != nil {
+					log.WithError(err).Error("Unable to apply config, keeping the previous one")
+					continue
+				}
+				if !applyConfig(ctx, poller, config, newConfig) {
+					continue
 				}
+				config, schedule = newConfig, newSchedule
+				tick = nextCycle(log, schedule, last, metrics)
+				if tick.IsZero() {
+					return errors.New("The schedule has no more ticks")
+				}
+				wait.Stop()
+				wait = time.NewTimer(time.Until(tick.Add(config.Jitter())))
+			case <-wait.C:
+				break sleep
 			}
 		}
+	}
+}
+
+// nextCycle returns the tick to run the cycle after the one for last, logging
+// and counting any ticks missed.
+func nextCycle(log logrus.FieldLogger, schedule Schedule, last time.Time, metrics *Metrics) time.Time {
+	now := time.Now()
+	tick, skipped := NextTick(schedule, last, now)
+	if !tick.IsZero() && tick.Before(now) {
+		log.WithFields(logrus.Fields{"tick": tick.Format(time.RFC3339), "skipped": skipped}).Warn("Poll cycle overran the schedule, starting the next one now")
+		metrics.TicksMissed(skipped + 1)
+	}
+	return tick
+}
+
+// applyConfig switches the poller over to a reloaded config, recreating the
+// sinks if they've changed.  Returns false if the poller is still using the
+// old config.
+func applyConfig(ctx context.Context, poller *Poller, config, newConfig *Config) bool {
+	log := logging.FromContext(ctx)
+
+	oldClient := poller.tsdbClient
+	tsdbClient := oldClient
+	if sinksChanged(config, newConfig) {
+		multiplexer, err := NewPollerSinks(newConfig, poller.state, poller.metrics)
+		if err != nil {
+			log.WithError(err).Error("Unable to initialize sinks, keeping the previous config")
+			return false
+		}
+		tsdbClient = multiplexer
+	}
+
+	err := poller.Reconfigure(ctx, newConfig, tsdbClient)
+	if err != nil {
+		log.WithError(err).Error("Unable to apply config, keeping the previous one")
+		if tsdbClient != oldClient {
+			closeSinks(log, tsdbClient)
+		}
+		return false
+	}
+
+	// Only the new sinks are written to from now on
+	if tsdbClient != oldClient {
+		closeSinks(log, oldClient)
+	}
+	log.Info("Applied new config")
+	return true
+}
+
+// closeSinks closes tsdbClient, if it needs closing.
+func closeSinks(log logrus.FieldLogger, tsdbClient tsdb.TSDB) {
+	closer, ok := tsdbClient.(io.Closer)
+	if !ok {
+		return
+	}
+	err := closer.Close()
+	if err != nil {
+		log.WithError(err).Warn("Failed to close sinks")
+	}
+}
+
+// What the poller does after a failed API call.  Readings missed because of a
+// failure are picked up by the next successful fetch of the stat.
+type fetchErrorAction int
+
+const (
+	// Carry on with the next stat
+	skipStat fetchErrorAction = iota
+	// Stop calling the API until the next cycle
+	endCycle
+	// Look for a new access token, then end the cycle
+	reauthenticate
+)
 
-		// Once all of the stats have been processed, update the state file on disk
-		state.Save()
-		lastFetchTime = time.Now()
+// FetchErrorAction decides what to do about an error from the API.  Rejected
+// tokens need replacing, and there's no point making more calls while the
+// server is struggling or limiting us.  Anything else (a bad argument or an
+// unexpected response) is specific to the call, so other stats may still work.
+func FetchErrorAction(err error) fetchErrorAction {
+	var authErr *wirelesstag.AuthError
+	var rateErr *wirelesstag.RateLimitError
+	var serverErr *wirelesstag.ServerError
+	var reqErr *wirelesstag.RequestError
 
-		// Sleep to avoid excessive calls to the API server.
-		time.Sleep(time.Duration(config.PollInterval) * time.Second)
+	switch {
+	case errors.As(err, &authErr):
+		return reauthenticate
+	case errors.As(err, &rateErr):
+		return endCycle
+	case errors.As(err, &serverErr):
+		return endCycle
+	case errors.As(err, &reqErr) && reqErr.StatusCode == 0:
+		// Network failure
+		return endCycle
 	}
+	return skipStat
 }
 
-func GetTags(tagClient wirelesstag.Client) ([]wirelesstag.Tag, error) {
+// ReloadAccessToken picks up a new access token from the state backend, in
+// case oolong init was run again after the old one was rejected.  Returns
+// true if a new token was found.
+func ReloadAccessToken(ctx context.Context, config *Config, st state.State, tagClient wirelesstag.Client) bool {
+	log := logging.FromContext(ctx)
+	fresh, err := LoadState(config)
+	if err != nil {
+		log.WithError(err).Error("Unable to reload state")
+		return false
+	}
+	token := fresh.GetAccessToken()
+	// Only the token is wanted, so don't keep the redis connections open
+	if closer, ok := fresh.(io.Closer); ok {
+		closer.Close()
+	}
+
+	if token == "" || token == st.GetAccessToken() {
+		log.Error("Access token was rejected.  Run oolong init to get a new one.")
+		return false
+	}
+	logging.AddSecret(token)
+
+	// Keep the state in step too, otherwise saving it would put the old
+	// token back.
+	st.SetAccessToken(token)
+	tagClient.SetAccessToken(token)
+	log.Info("Loaded new access token")
+	return true
+}
+
+// LastUpdateTime returns the time of the newest reading stored for a tag/stat.
+// When each sink keeps its own checkpoint, this is the oldest of those, so
+// that sinks which are behind get all of the readings they're missing.
+func LastUpdateTime(state state.State, tsdbClient tsdb.TSDB, uuid, queryType string) time.Time {
+	if multiplexer, ok := tsdbClient.(*tsdb.Multiplexer); ok {
+		return multiplexer.Checkpoint(uuid, queryType)
+	}
+	return state.GetLastUpdateTime(uuid, queryType)
+}
+
+// CatchUpStart returns the day to start fetching a stat from.  Sinks which are
+// behind (newly added, or down for longer than they could buffer) need
+// readings from before today, so go back as far as the oldest sink
+// checkpoint, but no more than catchup_days.
+func CatchUpStart(config *Config, tsdbClient tsdb.TSDB, tags []wirelesstag.Tag, queryType string, startDay time.Time) time.Time {
+	multiplexer, ok := tsdbClient.(*tsdb.Multiplexer)
+	if !ok || config.CatchUpDays <= 0 {
+		return startDay
+	}
+
+	start := startDay
+	for _, tag := range tags {
+		// Tags without any readings of the stat, e.g. ones without the
+		// sensor, have nothing for a sink to catch up on
+		if multiplexer.Newest(tag.UUID, queryType).IsZero() {
+			continue
+		}
+		checkpoint := multiplexer.Checkpoint(tag.UUID, queryType)
+		if checkpoint.Before(start) {
+			start = checkpoint
+		}
+	}
+
+	limit := startDay.AddDate(0, 0, -config.CatchUpDays)
+	if start.Before(limit) {
+		start = limit
+	}
+	return start
+}
+
+func GetTags(ctx context.Context, tagClient wirelesstag.Client) ([]wirelesstag.Tag, error) {
 	// We could probably call GetTagList instead, and simply this function,
 	// but we might want to add support later on for tracking which tags are
 	// connected to which tag managers.
-	tagManagersAndTags, err := tagClient.GetTagManagerTagList()
+	tagManagersAndTags, err := tagClient.GetTagManagerTagListContext(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -114,6 +675,58 @@ func GetTags(tagClient wirelesstag.Client) ([]wirelesstag.Tag, error) {
 	return tagList, nil
 }
 
+// StoreTagMetadata saves the tag managers and their tags, if the sink supports it.
+func StoreTagMetadata(ctx context.Context, tagClient wirelesstag.Client, tsdbClient tsdb.TSDB) error {
+	metadataClient, ok := tsdbClient.(tsdb.MetadataTSDB)
+	if !ok {
+		return nil
+	}
+
+	managers, err := tagClient.GetTagManagersContext(ctx)
+	if err != nil {
+		return err
+	}
+	tags, err := tagClient.GetTagManagerTagListContext(ctx)
+	if err != nil {
+		return err
+	}
+	return metadataClient.PutTagManagers(managers, tags)
+}
+
+// TagGroup is a set of tags whose tag managers share a time zone.
+type TagGroup struct {
+	Location *time.Location
+	Tags     []wirelesstag.Tag
+}
+
+// GroupTagsByLocation groups tags by the configured time zone of their tag
+// manager.  Groups are in the order their first tag appears.
+func GroupTagsByLocation(config *Config, tags []wirelesstag.Tag) ([]TagGroup, error) {
+	var groups []TagGroup
+	index := make(map[string]int)
+	for _, tag := range tags {
+		loc, err := config.Location(tag.ManagerMac)
+		if err != nil {
+			return nil, err
+		}
+		i, ok := index[loc.String()]
+		if !ok {
+			i = len(groups)
+			index[loc.String()] = i
+			groups = append(groups, TagGroup{Location: loc})
+		}
+		groups[i].Tags = append(groups[i].Tags, tag)
+	}
+	return groups, nil
+}
+
+// Day returns midnight of t's date in loc.  Unlike t.In(loc), the date is
+// kept, which is what's wanted when t came from a date given by the user.
+func Day(t time.Time, loc *time.Location) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, loc)
+}
+
 func GetTagBySlaveId(tags []wirelesstag.Tag, slaveId int) *wirelesstag.Tag {
 	for _, t := range tags {
 		if t.SlaveId == slaveId {
@@ -123,9 +736,11 @@ func GetTagBySlaveId(tags []wirelesstag.Tag, slaveId int) *wirelesstag.Tag {
 	return nil
 }
 
-func GetStats(tagClient wirelesstag.Client, queryType string, ids []int, start, end time.Time) ([]wirelesstag.Stat, error) {
+// GetStats fetches a stat for the tags, for the dates start and end fall on in
+// loc, the time zone of the tags' account.
+func GetStats(ctx context.Context, tagClient wirelesstag.Client, queryType string, ids []int, start, end time.Time, loc *time.Location) ([]wirelesstag.Stat, error) {
 	// Query the API server for the specified stat (temp, humidity, battery, etc) and tags.
-	rawStats, err := tagClient.GetMultiTagStatsRaw(ids, queryType, start, end)
+	rawStats, err := tagClient.GetMultiTagStatsRawContext(ctx, ids, queryType, start.In(loc), end.In(loc))
 	if err != nil {
 		return nil, err
 	}
@@ -133,7 +748,34 @@ func GetStats(tagClient wirelesstag.Client, queryType string, ids []int, start,
 	// The results are returned in a set of nested arrays, with timestamps as offsets
 	// starting from midnight of the requested day.
 	// Let's transform that into something easier to handle.
-	return wirelesstag.NormalizeRawMultiStat(rawStats)
+	return wirelesstag.NormalizeRawMultiStat(rawStats, loc)
+}
+
+// GetTagStats fetches temperature and humidity for a single tag, keyed by stat.
+// Like GetStats, start and end are converted to dates in loc.
+func GetTagStats(ctx context.Context, tagClient wirelesstag.Client, id int, start, end time.Time, loc *time.Location) (map[string]wirelesstag.Stat, error) {
+	rawStats, err := tagClient.GetStatsRawContext(ctx, id, start.In(loc), end.In(loc))
+	if err != nil {
+		return nil, err
+	}
+	return wirelesstag.NormalizeRawStat(id, rawStats, loc)
+}
+
+// ReportDroppedReadings logs the readings removed by the sanity filter which
+// are newer than since, and returns them.  log should carry the tag and stat.
+func ReportDroppedReadings(log logrus.FieldLogger, dropped []DroppedReading, since time.Time) []DroppedReading {
+	var reported []DroppedReading
+	for _, d := range dropped {
+		if d.Timestamp.After(since) {
+			log.WithFields(logrus.Fields{
+				"value":     d.Value,
+				"timestamp": d.Timestamp.Format(time.RFC3339),
+				"reason":    d.Reason,
+			}).Warn("Dropped reading")
+			reported = append(reported, d)
+		}
+	}
+	return reported
 }
 
 func FilterNewStats(stat wirelesstag.Stat, lastReadTime time.Time) wirelesstag.Stat {
@@ -152,6 +794,13 @@ func ConvertCToF(temp float32) float32 {
 	return (temp * 9 / 5) + 32
 }
 
+// Converts a set of readings in place
+func ConvertReadingsCToF(readings []wirelesstag.Reading) {
+	for i := range readings {
+		readings[i].Value = ConvertCToF(readings[i].Value)
+	}
+}
+
 // Might as well have a function to convert back.
 func ConvertFToC(temp float32) float32 {
 	return (temp - 32) * 5 / 9
@@ -1,41 +1,97 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/arcticfoxnv/oolong/state"
+	"github.com/arcticfoxnv/oolong/tsdb"
 	"github.com/arcticfoxnv/oolong/wirelesstag"
 )
 
 type DummyTagClient struct {
-	Stats []wirelesstag.RawMultiStat
+	Stats       []wirelesstag.RawMultiStat
+	RawStats    []wirelesstag.RawStat
+	AccessToken string
+	// Number of stats calls made
+	Calls int
+	// The start of the last stats call's range
+	From time.Time
+	// Returned by the stats calls, if set
+	Err error
+
+	lock sync.Mutex
 }
 
 func (c *DummyTagClient) GetTagManagerTagList() (map[string][]wirelesstag.Tag, error) {
 	tags := make(map[string][]wirelesstag.Tag)
 	tags["abc"] = []wirelesstag.Tag{
 		{
-			Name: "tag1",
+			Name:    "tag1",
+			UUID:    "xxx",
+			SlaveId: 0,
 		},
 		{
-			Name: "tag2",
+			Name:    "tag2",
+			UUID:    "yyy",
+			SlaveId: 1,
 		},
 	}
 	return tags, nil
 }
 
-func (c *DummyTagClient) GetMultiTagStatsRaw([]int, string, time.Time, time.Time) ([]wirelesstag.RawMultiStat, error) {
+func (c *DummyTagClient) GetMultiTagStatsRaw(ids []int, statType string, from, to time.Time) ([]wirelesstag.RawMultiStat, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.Calls++
+	c.From = from
+	if c.Err != nil {
+		return nil, c.Err
+	}
 	return c.Stats, nil
 }
 
-func (c *DummyTagClient) GetStatsRaw(int, time.Time, time.Time) ([]wirelesstag.RawStat, error) {
-	return nil, nil
+func (c *DummyTagClient) GetStatsRaw(id int, from, to time.Time) ([]wirelesstag.RawStat, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.Calls++
+	c.From = from
+	if c.Err != nil {
+		return nil, c.Err
+	}
+	return c.RawStats, nil
 }
 
 func (c *DummyTagClient) GetTagManagers() ([]wirelesstag.TagManager, error) {
 	return nil, nil
 }
 
+func (c *DummyTagClient) GetTagManagerTagListContext(ctx context.Context) (map[string][]wirelesstag.Tag, error) {
+	return c.GetTagManagerTagList()
+}
+
+func (c *DummyTagClient) GetMultiTagStatsRawContext(ctx context.Context, ids []int, statType string, from, to time.Time) ([]wirelesstag.RawMultiStat, error) {
+	return c.GetMultiTagStatsRaw(ids, statType, from, to)
+}
+
+func (c *DummyTagClient) GetStatsRawContext(ctx context.Context, id int, from, to time.Time) ([]wirelesstag.RawStat, error) {
+	return c.GetStatsRaw(id, from, to)
+}
+
+func (c *DummyTagClient) GetTagManagersContext(ctx context.Context) ([]wirelesstag.TagManager, error) {
+	return c.GetTagManagers()
+}
+
+func (c *DummyTagClient) SetAccessToken(accessToken string) {
+	c.AccessToken = accessToken
+}
+
 var conversionTests = [][]float32{
 	[]float32{-40, -40},
 	[]float32{0, 32},
@@ -160,7 +216,7 @@ func TestGetTagBySlaveIdNilTags(t *testing.T) {
 
 func TestGetTags(t *testing.T) {
 	client := &DummyTagClient{}
-	tags, err := GetTags(client)
+	tags, err := GetTags(context.Background(), client)
 
 	if err != nil {
 		t.Fail()
@@ -204,7 +260,7 @@ func TestGetStats(t *testing.T) {
 		},
 	}
 
-	stats, err := GetStats(client, "whatever", []int{0, 1}, time.Now(), time.Now())
+	stats, err := GetStats(context.Background(), client, "whatever", []int{0, 1}, time.Now(), time.Now(), time.Local)
 	if err != nil {
 		t.Fail()
 	}
@@ -217,3 +273,458 @@ func TestGetStats(t *testing.T) {
 		t.Fail()
 	}
 }
+
+type DummyMetadataTSDB struct {
+	Managers []wirelesstag.TagManager
+	Tags     map[string][]wirelesstag.Tag
+}
+
+func (d *DummyMetadataTSDB) PutValue(*wirelesstag.Tag, string, wirelesstag.Reading) error {
+	return nil
+}
+
+func (d *DummyMetadataTSDB) PutTagManagers(managers []wirelesstag.TagManager, tags map[string][]wirelesstag.Tag) error {
+	d.Managers = managers
+	d.Tags = tags
+	return nil
+}
+
+func TestStoreTagMetadata(t *testing.T) {
+	client := &DummyTagClient{}
+	db := &DummyMetadataTSDB{}
+	err := StoreTagMetadata(context.Background(), client, db)
+	if err != nil {
+		t.Fail()
+	}
+
+	if len(db.Tags["abc"]) != 2 {
+		t.Fail()
+	}
+}
+
+func TestConvertReadingsCToF(t *testing.T) {
+	readings := []wirelesstag.Reading{
+		{Value: 0},
+		{Value: 100},
+	}
+	ConvertReadingsCToF(readings)
+	if readings[0].Value != 32 || readings[1].Value != 212 {
+		t.Fail()
+	}
+}
+
+func TestCatchUpStart(t *testing.T) {
+	now := time.Now()
+	st := state.NewFileState("state.json")
+	st.UpdateSink("opentsdb", "xxx", "temperature", now)
+	st.UpdateSink("archive", "xxx", "temperature", now.AddDate(0, 0, -2))
+
+	multiplexer := tsdb.NewMultiplexer()
+	multiplexer.AddSink("opentsdb", &DummyMetadataTSDB{}, tsdb.SinkPolicy{})
+	multiplexer.AddSink("archive", &DummyMetadataTSDB{}, tsdb.SinkPolicy{})
+	multiplexer.SetCheckpointer(st)
+
+	tags := []wirelesstag.Tag{{UUID: "xxx"}}
+	config := &Config{CatchUpDays: 7}
+	start := CatchUpStart(config, multiplexer, tags, "temperature", now)
+	if !start.Equal(now.AddDate(0, 0, -2)) {
+		t.Fail()
+	}
+
+	// A new sink goes back as far as allowed
+	multiplexer.AddSink("postgres", &DummyMetadataTSDB{}, tsdb.SinkPolicy{})
+	start = CatchUpStart(config, multiplexer, tags, "temperature", now)
+	if !start.Equal(now.AddDate(0, 0, -7)) {
+		t.Fail()
+	}
+
+	// Tags which no sink has readings for don't need catching up
+	start = CatchUpStart(config, multiplexer, []wirelesstag.Tag{{UUID: "yyy"}}, "temperature", now)
+	if !start.Equal(now) {
+		t.Error(start)
+	}
+	start = CatchUpStart(config, multiplexer, append(tags, wirelesstag.Tag{UUID: "yyy"}), "light", now)
+	if !start.Equal(now) {
+		t.Error(start)
+	}
+
+	// Unless catching up is disabled
+	config.CatchUpDays = 0
+	start = CatchUpStart(config, multiplexer, tags, "temperature", now)
+	if !start.Equal(now) {
+		t.Fail()
+	}
+}
+
+func TestFetchErrorAction(t *testing.T) {
+	if FetchErrorAction(&wirelesstag.AuthError{}) != reauthenticate {
+		t.Fail()
+	}
+	if FetchErrorAction(&wirelesstag.RateLimitError{}) != endCycle {
+		t.Fail()
+	}
+	if FetchErrorAction(&wirelesstag.ServerError{}) != endCycle {
+		t.Fail()
+	}
+	if FetchErrorAction(&wirelesstag.RequestError{Err: errors.New("connection refused")}) != endCycle {
+		t.Fail()
+	}
+	if FetchErrorAction(&wirelesstag.FaultError{}) != skipStat {
+		t.Fail()
+	}
+	if FetchErrorAction(&wirelesstag.DecodeError{Err: errors.New("bad json")}) != skipStat {
+		t.Fail()
+	}
+	if FetchErrorAction(errors.New("something else")) != skipStat {
+		t.Fail()
+	}
+}
+
+func TestReloadAccessToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oolong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := &Config{Backend: "file"}
+	config.File.Filename = filepath.Join(dir, "state.json")
+	st := state.NewFileState(config.File.Filename)
+	st.SetAccessToken("old")
+	st.Save()
+	client := &DummyTagClient{AccessToken: "old"}
+
+	// Nothing new yet
+	if ReloadAccessToken(context.Background(), config, st, client) {
+		t.Fail()
+	}
+
+	// oolong init was run again
+	fresh := state.NewFileState(config.File.Filename)
+	fresh.SetAccessToken("new")
+	fresh.Save()
+	if !ReloadAccessToken(context.Background(), config, st, client) {
+		t.Fail()
+	}
+	if client.AccessToken != "new" || st.GetAccessToken() != "new" {
+		t.Fail()
+	}
+}
+
+func TestGroupTagsByLocation(t *testing.T) {
+	config := &Config{
+		TimeZone:  "America/Denver",
+		TimeZones: map[string]string{"bb": "Europe/London"},
+	}
+	tags := []wirelesstag.Tag{
+		{UUID: "1", ManagerMac: "aa"},
+		{UUID: "2", ManagerMac: "bb"},
+		{UUID: "3", ManagerMac: "cc"},
+	}
+
+	groups, err := GroupTagsByLocation(config, tags)
+	if err != nil {
+		t.FailNow()
+	}
+	if len(groups) != 2 {
+		t.FailNow()
+	}
+	if groups[0].Location.String() != "America/Denver" || len(groups[0].Tags) != 2 {
+		t.Fail()
+	}
+	if groups[1].Location.String() != "Europe/London" || groups[1].Tags[0].UUID != "2" {
+		t.Fail()
+	}
+
+	config.TimeZones["bb"] = "Nowhere/Special"
+	_, err = GroupTagsByLocation(config, tags)
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func TestDay(t *testing.T) {
+	loc, err := time.LoadLocation("America/Denver")
+	if err != nil {
+		t.Skip(err)
+	}
+	// Midnight UTC on the 2nd is still the 1st in Denver, but the date is kept
+	day := Day(time.Date(2006, 1, 2, 0, 0, 0, 0, time.UTC), loc)
+	if !day.Equal(time.Date(2006, 1, 2, 7, 0, 0, 0, time.UTC)) {
+		t.Fail()
+	}
+}
+
+// Two readings for each of the dummy client's tags
+var pollerTestStats = []wirelesstag.RawMultiStat{
+	{
+		Date:             "1/2/2006",
+		SlaveIds:         []int{0, 1},
+		Values:           [][]float32{{20, 21}, {22, 23}},
+		TimeOfDaySeconds: [][]int{{0, 60}, {0, 60}},
+	},
+}
+
+func newTestPoller(t *testing.T, client *DummyTagClient, queryStats []string) *Poller {
+	dir, err := ioutil.TempDir("", "oolong")
+	if err != nil {
+		t.FailNow()
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	config := &Config{QueryStats: queryStats}
+	st := state.NewFileState(filepath.Join(dir, "state.json"))
+	poller, err := NewPoller(context.Background(), config, st, client, &DummyMetadataTSDB{}, nil)
+	if err != nil {
+		t.FailNow()
+	}
+	return poller
+}
+
+func TestPollerRunCycle(t *testing.T) {
+	poller := newTestPoller(t, &DummyTagClient{Stats: pollerTestStats}, []string{"temperature"})
+
+	report := poller.RunCycle(context.Background())
+	if report.Err() != nil || report.Cycle != 1 || report.Calls != 1 {
+		t.Fail()
+	}
+	if len(report.Results) != 2 || report.Stored() != 4 {
+		t.Fail()
+	}
+
+	// Nothing new the second time around
+	report = poller.RunCycle(context.Background())
+	if report.Err() != nil || report.Cycle != 2 || report.Stored() != 0 {
+		t.Fail()
+	}
+}
+
+func TestPollerRunCycleConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oolong")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	config := &Config{QueryStats: []string{"temperature", "cap", "light"}, Concurrency: 4}
+	st := state.Synchronized(state.NewFileState(filepath.Join(dir, "state.json")))
+	multiplexer := tsdb.NewMultiplexer()
+	multiplexer.AddSink("sink1", &DummyMetadataTSDB{}, tsdb.SinkPolicy{})
+	multiplexer.AddSink("sink2", &DummyMetadataTSDB{}, tsdb.SinkPolicy{})
+	multiplexer.SetCheckpointer(st)
+	client := &DummyTagClient{Stats: pollerTestStats}
+	poller, err := NewPoller(context.Background(), config, st, client, multiplexer, nil)
+	if err != nil {
+		t.FailNow()
+	}
+
+	report := poller.RunCycle(context.Background())
+	if report.Err() != nil || report.Calls != 3 || client.Calls != 3 || report.Stored() != 12 {
+		t.Fail()
+	}
+	// Results are in the same order however the calls finish
+	if len(report.Results) != 6 || report.Results[0].Stat != "temperature" || report.Results[5].Stat != "light" || report.Results[5].Tag.UUID != "yyy" {
+		t.Fail()
+	}
+	for _, stat := range config.QueryStats {
+		if st.GetSinkLastUpdateTime("sink2", "yyy", stat).IsZero() || st.GetLastUpdateTime("xxx", stat).IsZero() {
+			t.Fail()
+		}
+	}
+}
+
+func TestPollerRunCycleIntervals(t *testing.T) {
+	client := &DummyTagClient{Stats: pollerTestStats}
+	poller := newTestPoller(t, client, []string{"temperature", "batteryVolt"})
+	poller.config.Schedule.Intervals = map[string]int{"batteryVolt": 3600}
+	start := time.Now()
+
+	// Everything is fetched on the first tick, then batteryVolt waits for
+	// its interval
+	report := poller.RunCycleAt(context.Background(), start)
+	if report.Err() != nil || len(report.Results) != 4 || client.Calls != 2 {
+		t.Fail()
+	}
+	report = poller.RunCycleAt(context.Background(), start.Add(5*time.Minute))
+	if report.Err() != nil || len(report.Results) != 2 || report.Results[0].Stat != "temperature" || client.Calls != 3 {
+		t.Fail()
+	}
+
+	// A failed stat is tried again on the next tick
+	client.Err = errors.New("Bad request")
+	report = poller.RunCycleAt(context.Background(), start.Add(time.Hour))
+	if len(report.Failed()) != 4 || client.Calls != 5 {
+		t.Fail()
+	}
+	client.Err = nil
+	report = poller.RunCycleAt(context.Background(), start.Add(65*time.Minute))
+	if report.Err() != nil || len(report.Results) != 4 {
+		t.Fail()
+	}
+	report = poller.RunCycleAt(context.Background(), start.Add(70*time.Minute))
+	if len(report.Results) != 2 {
+		t.Fail()
+	}
+}
+
+func TestPollerRunCycleFailed(t *testing.T) {
+	client := &DummyTagClient{Err: &wirelesstag.ServerError{RequestError: wirelesstag.RequestError{StatusCode: 503}}}
+	poller := newTestPoller(t, client, []string{"temperature", "batteryVolt"})
+
+	// A server error ends the cycle after the first call
+	report := poller.RunCycle(context.Background())
+	if report.Err() == nil || report.Calls != 1 || len(report.Failures) != 1 {
+		t.Fail()
+	}
+	failed := report.Failed()
+	if len(failed) != 4 {
+		t.FailNow()
+	}
+	if failed[0].Stat != "temperature" || failed[0].Err != client.Err {
+		t.Fail()
+	}
+	if failed[3].Stat != "batteryVolt" || failed[3].Err != ErrNotFetched {
+		t.Fail()
+	}
+}
+
+func TestPollerRunCycleFailedKeepsStart(t *testing.T) {
+	client := &DummyTagClient{Stats: pollerTestStats}
+	poller := newTestPoller(t, client, []string{"temperature"})
+	// Last fetched yesterday, so today's first cycle includes yesterday
+	yesterday := time.Now().AddDate(0, 0, -1)
+	poller.lastFetchTime = yesterday
+
+	client.Err = errors.New("Bad request")
+	report := poller.RunCycle(context.Background())
+	if len(report.Failed()) != 2 || !client.From.Equal(yesterday) {
+		t.Error(client.From)
+	}
+
+	// The next cycle still starts from yesterday, so none of its readings
+	// are missed
+	client.Err = nil
+	report = poller.RunCycle(context.Background())
+	if report.Err() != nil || !client.From.Equal(yesterday) {
+		t.Error(client.From)
+	}
+
+	// and moves on once they've been fetched
+	report = poller.RunCycle(context.Background())
+	if report.Err() != nil || !client.From.After(yesterday) {
+		t.Error(client.From)
+	}
+}
+
+func TestPollerRunCycleDroppedOnce(t *testing.T) {
+	// The newest reading looks like a spike, and is held back until a later
+	// one shows whether it was
+	stats := []wirelesstag.RawMultiStat{
+		{
+			Date:             "1/2/2006",
+			SlaveIds:         []int{0},
+			Values:           [][]float32{{20, 21, 22, 60}},
+			TimeOfDaySeconds: [][]int{{0, 60, 120, 180}},
+		},
+	}
+	poller := newTestPoller(t, &DummyTagClient{Stats: stats}, []string{"temperature"})
+	poller.filter = NewSanityFilter(FilterConfig{Spikes: map[string]float64{"temperature": 5}})
+
+	dropped := func(report *CycleReport) int {
+		total := 0
+		for _, result := range report.Results {
+			total += result.Dropped
+		}
+		return total
+	}
+	report := poller.RunCycle(context.Background())
+	if report.Err() != nil || report.Stored() != 3 || dropped(report) != 1 {
+		t.Error(report.Stored(), dropped(report))
+	}
+
+	// Still held back, but not reported again
+	report = poller.RunCycle(context.Background())
+	if report.Err() != nil || report.Stored() != 0 || dropped(report) != 0 {
+		t.Error(report.Stored(), dropped(report))
+	}
+}
+
+func TestStatsFetcherHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oolong")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	config := &Config{QueryStats: []string{"temperature"}}
+	st := state.NewFileState(filepath.Join(dir, "state.json"))
+	client := &DummyTagClient{Stats: pollerTestStats}
+
+	// The handler decides when to stop
+	stop := errors.New("Stop")
+	cycles := 0
+	err = StatsFetcher(context.Background(), config, st, client, &DummyMetadataTSDB{}, nil, func(report *CycleReport) error {
+		cycles++
+		if cycles == 2 {
+			return stop
+		}
+		return nil
+	}, nil)
+	if err != stop || cycles != 2 {
+		t.Fail()
+	}
+}
+
+func TestStatsFetcherReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oolong")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	config := &Config{PollInterval: 3600, QueryStats: []string{"temperature"}}
+	st := state.NewFileState(filepath.Join(dir, "state.json"))
+	client := &DummyTagClient{Stats: pollerTestStats}
+
+	// The new config is picked up while waiting for the second cycle, and
+	// its shorter interval ends the wait
+	reload := make(chan *Config, 1)
+	reload <- &Config{PollInterval: 0, QueryStats: []string{"temperature", "cap"}}
+
+	stop := errors.New("Stop")
+	var stats []int
+	err = StatsFetcher(context.Background(), config, st, client, &DummyMetadataTSDB{}, nil, func(report *CycleReport) error {
+		stats = append(stats, len(report.Results))
+		if len(stats) == 2 {
+			return stop
+		}
+		return nil
+	}, reload)
+	if err != stop {
+		t.Fail()
+	}
+	// Two tags, one then two stats
+	if len(stats) != 2 || stats[0] != 2 || stats[1] != 4 {
+		t.Error(stats)
+	}
+}
+
+func TestBackfillReport(t *testing.T) {
+	config := &Config{QueryStats: []string{"temperature", "cap"}}
+	client := &DummyTagClient{Err: errors.New("Bad request")}
+
+	// Failures don't stop the backfill
+	report, err := Backfill(context.Background(), config, nil, client, &DummyMetadataTSDB{}, time.Now())
+	if err != nil {
+		t.FailNow()
+	}
+	if report.Calls != 2 || len(report.Failed()) != 4 || report.Err() == nil {
+		t.Fail()
+	}
+
+	client = &DummyTagClient{Stats: pollerTestStats}
+	report, err = Backfill(context.Background(), config, nil, client, &DummyMetadataTSDB{}, time.Now())
+	if err != nil || report.Err() != nil || report.Stored() != 8 {
+		t.Fail()
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/arcticfoxnv/oolong/tsdb"
+	"github.com/arcticfoxnv/oolong/wirelesstag"
+	"github.com/lib/pq"
+)
+
+// Tables are created on startup if they don't already exist.  Readings are
+// keyed on (uuid, stat, timestamp) so that re-running a backfill for a day
+// that was already stored doesn't create duplicates.
+var postgresSchema = []string{
+	`CREATE TABLE IF NOT EXISTS tag_managers (
+		mac        TEXT PRIMARY KEY,
+		name       TEXT NOT NULL DEFAULT '',
+		online     BOOLEAN NOT NULL DEFAULT FALSE,
+		radio_id   TEXT NOT NULL DEFAULT '',
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS tags (
+		uuid        TEXT PRIMARY KEY,
+		slave_id    INTEGER NOT NULL,
+		name        TEXT NOT NULL DEFAULT '',
+		comment     TEXT NOT NULL DEFAULT '',
+		tag_type    INTEGER NOT NULL DEFAULT 0,
+		manager_mac TEXT REFERENCES tag_managers (mac),
+		updated_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS readings (
+		uuid      TEXT NOT NULL REFERENCES tags (uuid),
+		stat      TEXT NOT NULL,
+		timestamp TIMESTAMPTZ NOT NULL,
+		value     DOUBLE PRECISION NOT NULL,
+		PRIMARY KEY (uuid, stat, timestamp)
+	)`,
+}
+
+// Only used when the timescale option is enabled.  The extension has to be
+// available on the server, but doesn't need to be created ahead of time.
+var timescaleSchema = []string{
+	`CREATE EXTENSION IF NOT EXISTS timescaledb`,
+	`SELECT create_hypertable('readings', 'timestamp', if_not_exists => TRUE, migrate_data => TRUE)`,
+}
+
+const (
+	postgresUpsertTagManager = `INSERT INTO tag_managers (mac, name, online, radio_id, updated_at)
+		VALUES ($1, $2, $3, $4, now())
+		ON CONFLICT (mac) DO UPDATE SET
+			name = EXCLUDED.name,
+			online = EXCLUDED.online,
+			radio_id = EXCLUDED.radio_id,
+			updated_at = EXCLUDED.updated_at`
+
+	postgresUpsertTag = `INSERT INTO tags (uuid, slave_id, name, comment, tag_type, updated_at)
+		VALUES ($1, $2, $3, $4, $5, now())
+		ON CONFLICT (uuid) DO UPDATE SET
+			slave_id = EXCLUDED.slave_id,
+			name = EXCLUDED.name,
+			comment = EXCLUDED.comment,
+			tag_type = EXCLUDED.tag_type,
+			updated_at = EXCLUDED.updated_at`
+
+	// Readings only carry what the sink they came from knew about the tag,
+	// e.g. when migrating from OpenTSDB, so they never overwrite a tag's
+	// details.  Those come from PutTagManagers.
+	postgresInsertTag = `INSERT INTO tags (uuid, slave_id, name, comment, tag_type, updated_at)
+		VALUES ($1, $2, $3, $4, $5, now())
+		ON CONFLICT (uuid) DO NOTHING`
+
+	// Tags can reference a tag manager that wasn't returned by GetTagManagers
+	// (e.g. a shared manager), so make sure a row exists before linking them.
+	postgresEnsureTagManager = `INSERT INTO tag_managers (mac) VALUES ($1)
+		ON CONFLICT (mac) DO NOTHING`
+
+	postgresSetTagManager = `UPDATE tags SET manager_mac = $1 WHERE uuid = $2`
+
+	postgresInsertReading = `INSERT INTO readings (uuid, stat, timestamp, value)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (uuid, stat, timestamp) DO NOTHING`
+
+	// COPY can't skip rows that already exist, so bulk inserts are copied
+	// into a temporary table first and then merged.
+	postgresCreateImportTable = `CREATE TEMP TABLE readings_import
+		(LIKE readings INCLUDING DEFAULTS) ON COMMIT DROP`
+
+	postgresMergeImportTable = `INSERT INTO readings (uuid, stat, timestamp, value)
+		SELECT uuid, stat, timestamp, value FROM readings_import
+		ON CONFLICT (uuid, stat, timestamp) DO NOTHING`
+
+	postgresSelectReadings = `SELECT t.uuid, t.slave_id, t.name, t.comment, t.tag_type, r.timestamp, r.value
+		FROM readings r JOIN tags t ON t.uuid = r.uuid
+		WHERE r.stat = $1 AND r.timestamp BETWEEN $2 AND $3
+		ORDER BY t.uuid, r.timestamp`
+)
+
+type Postgres struct {
+	db *sql.DB
+	// Tags which have already been written to the tags table.  Each tag is
+	// only upserted once per run, the first time a reading is stored for it.
+	knownTags map[string]bool
+}
+
+// NewPostgresClient connects to the database and creates any missing tables.
+func NewPostgresClient(dsn string, timescale bool) (*Postgres, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	statements := postgresSchema
+	if timescale {
+		statements = append(statements, timescaleSchema...)
+	}
+	for _, statement := range statements {
+		_, err = db.Exec(statement)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	return &Postgres{
+		db:        db,
+		knownTags: make(map[string]bool),
+	}, nil
+}
+
+// putTag makes sure the tag exists in the tags table before readings that
+// reference it are inserted.  A tag which is already there is left as it is.
+func (c *Postgres) putTag(tag *wirelesstag.Tag) error {
+	if c.knownTags[tag.UUID] {
+		return nil
+	}
+
+	_, err := c.db.Exec(postgresInsertTag, tag.UUID, tag.SlaveId, tag.Name, tag.Comment, tag.TagType)
+	if err != nil {
+		return err
+	}
+	c.knownTags[tag.UUID] = true
+	return nil
+}
+
+func (c *Postgres) PutValue(tag *wirelesstag.Tag, valueType string, reading wirelesstag.Reading) error {
+	err := c.putTag(tag)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.db.Exec(postgresInsertReading, tag.UUID, valueType, reading.Timestamp, reading.Value)
+	return err
+}
+
+func (c *Postgres) PutValues(tag *wirelesstag.Tag, valueType string, readings []wirelesstag.Reading) error {
+	err := c.putTag(tag)
+	if err != nil {
+		return err
+	}
+
+	txn, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op once the transaction has been committed
+	defer txn.Rollback()
+
+	_, err = txn.Exec(postgresCreateImportTable)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := txn.Prepare(pq.CopyIn("readings_import", "uuid", "stat", "timestamp", "value"))
+	if err != nil {
+		return err
+	}
+	for _, reading := range readings {
+		_, err = stmt.Exec(tag.UUID, valueType, reading.Timestamp, reading.Value)
+		if err != nil {
+			stmt.Close()
+			return err
+		}
+	}
+
+	// An Exec with no arguments flushes the buffered rows to the server
+	_, err = stmt.Exec()
+	if err != nil {
+		stmt.Close()
+		return err
+	}
+	err = stmt.Close()
+	if err != nil {
+		return err
+	}
+
+	_, err = txn.Exec(postgresMergeImportTable)
+	if err != nil {
+		return err
+	}
+	return txn.Commit()
+}
+
+// PutTagManagers upserts each tag manager, along with the tags connected to
+// it (keyed by tag manager mac address).
+func (c *Postgres) PutTagManagers(managers []wirelesstag.TagManager, tags map[string][]wirelesstag.Tag) error {
+	txn, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	for _, manager := range managers {
+		_, err = txn.Exec(postgresUpsertTagManager, manager.Mac, manager.Name, manager.Online, manager.RadioId)
+		if err != nil {
+			return err
+		}
+	}
+
+	for mac, managerTags := range tags {
+		_, err = txn.Exec(postgresEnsureTagManager, mac)
+		if err != nil {
+			return err
+		}
+		for _, tag := range managerTags {
+			_, err = txn.Exec(postgresUpsertTag, tag.UUID, tag.SlaveId, tag.Name, tag.Comment, tag.TagType)
+			if err != nil {
+				return err
+			}
+			_, err = txn.Exec(postgresSetTagManager, mac, tag.UUID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		return err
+	}
+
+	for _, managerTags := range tags {
+		for _, tag := range managerTags {
+			c.knownTags[tag.UUID] = true
+		}
+	}
+	return nil
+}
+
+func (c *Postgres) GetValues(ctx context.Context, valueType string, from, to time.Time) ([]tsdb.Series, error) {
+	rows, err := c.db.QueryContext(ctx, postgresSelectReadings, valueType, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	series := []tsdb.Series{}
+	for rows.Next() {
+		tag := wirelesstag.Tag{}
+		reading := wirelesstag.Reading{}
+		err = rows.Scan(&tag.UUID, &tag.SlaveId, &tag.Name, &tag.Comment, &tag.TagType, &reading.Timestamp, &reading.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		// Rows are ordered by tag, so a new uuid starts a new series
+		if len(series) == 0 || series[len(series)-1].Tag.UUID != tag.UUID {
+			series = append(series, tsdb.Series{Tag: tag})
+		}
+		last := &series[len(series)-1]
+		last.Readings = append(last.Readings, reading)
+	}
+	return series, rows.Err()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/arcticfoxnv/oolong/wirelesstag"
+)
+
+// The tests which need a database only run when this is set, e.g. to
+// postgres://localhost/oolong_test?sslmode=disable
+const testPostgresDSNVar = "TEST_POSTGRES_DSN"
+
+var testPostgresTag = wirelesstag.Tag{UUID: "oolong-test-tag", SlaveId: 1, Name: "Fridge", TagType: 13}
+
+const testPostgresManager = "oolong-test-manager"
+
+func newTestPostgresClient(t *testing.T) *Postgres {
+	dsn := os.Getenv(testPostgresDSNVar)
+	if dsn == "" {
+		t.Skip(testPostgresDSNVar + " isn't set")
+	}
+	c, err := NewPostgresClient(dsn, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleteTestPostgresData(c)
+	return c
+}
+
+func deleteTestPostgresData(c *Postgres) {
+	c.db.Exec(`DELETE FROM readings WHERE uuid = $1`, testPostgresTag.UUID)
+	c.db.Exec(`DELETE FROM tags WHERE uuid = $1`, testPostgresTag.UUID)
+	c.db.Exec(`DELETE FROM tag_managers WHERE mac = $1`, testPostgresManager)
+}
+
+func countTestPostgresReadings(t *testing.T, c *Postgres) int {
+	var count int
+	err := c.db.QueryRow(`SELECT count(*) FROM readings WHERE uuid = $1`, testPostgresTag.UUID).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func testPostgresTagName(t *testing.T, c *Postgres) string {
+	var name string
+	err := c.db.QueryRow(`SELECT name FROM tags WHERE uuid = $1`, testPostgresTag.UUID).Scan(&name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestNewPostgresClientBadServer(t *testing.T) {
+	c, err := NewPostgresClient("postgres://localhost:1/oolong?sslmode=disable", false)
+	if err == nil {
+		t.Fail()
+	}
+	if c != nil {
+		t.Fail()
+	}
+}
+
+func TestPostgresBackfillTwice(t *testing.T) {
+	c := newTestPostgresClient(t)
+	defer c.db.Close()
+	defer deleteTestPostgresData(c)
+
+	day := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	readings := []wirelesstag.Reading{
+		{Timestamp: day.Add(time.Hour), Value: 4.5},
+		{Timestamp: day.Add(2 * time.Hour), Value: 4.25},
+		{Timestamp: day.Add(3 * time.Hour), Value: 4},
+	}
+	for i := 0; i < 2; i++ {
+		err := c.PutValues(&testPostgresTag, "temperature", readings)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := c.PutValue(&testPostgresTag, "temperature", readings[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count := countTestPostgresReadings(t, c); count != 3 {
+		t.Error(count)
+	}
+}
+
+func TestPostgresPutTagManagers(t *testing.T) {
+	c := newTestPostgresClient(t)
+	defer c.db.Close()
+	defer deleteTestPostgresData(c)
+
+	managers := []wirelesstag.TagManager{{Mac: testPostgresManager, Name: "Kitchen"}}
+	tag := testPostgresTag
+	for _, name := range []string{"Fridge", "Freezer"} {
+		tag.Name = name
+		err := c.PutTagManagers(managers, map[string][]wirelesstag.Tag{testPostgresManager: {tag}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if name := testPostgresTagName(t, c); name != "Freezer" {
+		t.Error(name)
+	}
+	var mac string
+	c.db.QueryRow(`SELECT manager_mac FROM tags WHERE uuid = $1`, testPostgresTag.UUID).Scan(&mac)
+	if mac != testPostgresManager {
+		t.Error(mac)
+	}
+}
+
+func TestPostgresPutValuesKeepsTagDetails(t *testing.T) {
+	c := newTestPostgresClient(t)
+	defer c.db.Close()
+	defer deleteTestPostgresData(c)
+
+	err := c.PutTagManagers(nil, map[string][]wirelesstag.Tag{testPostgresManager: {testPostgresTag}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Readings migrated from OpenTSDB only know the tag's uuid and name,
+	// with spaces replaced, and come from a client which hasn't seen the tag
+	dsn := os.Getenv(testPostgresDSNVar)
+	migrated, err := NewPostgresClient(dsn, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer migrated.db.Close()
+	tag := wirelesstag.Tag{UUID: testPostgresTag.UUID, Name: "Fridge_door"}
+	err = migrated.PutValue(&tag, "temperature", wirelesstag.Reading{Timestamp: time.Now(), Value: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name := testPostgresTagName(t, c); name != "Fridge" {
+		t.Error(name)
+	}
+	var tagType int
+	c.db.QueryRow(`SELECT tag_type FROM tags WHERE uuid = $1`, testPostgresTag.UUID).Scan(&tagType)
+	if tagType != testPostgresTag.TagType {
+		t.Error(tagType)
+	}
+}
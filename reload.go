@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arcticfoxnv/oolong/logging"
+	"github.com/fsnotify/fsnotify"
+)
+
+// How long the config file has to stay unchanged before it's reloaded, so an
+// editor saving in several steps only causes one reload.
+var configReloadDelay = 500 * time.Millisecond
+
+// Sections of the config which are only read at startup.  Changes to these
+// are logged, but need a restart to apply.
+var restartSections = []string{"oauth", "http", "api", "log", "metrics", "backend", "state_key", "state_key_file", "state_key_previous", "state_key_previous_file", "file", "redis", "leader"}
+
+// ConfigDiff lists the settings which differ between two configs, as
+// "key: old -> new", with the secrets redacted.  Secrets are compared before
+// being redacted, so a changed secret is listed even though both values look
+// the same.
+func ConfigDiff(before, after *Config) []string {
+	oldValues := make(map[string]string)
+	flattenConfig(oldValues, "", before.Map())
+	newValues := make(map[string]string)
+	flattenConfig(newValues, "", after.Map())
+	oldShown := make(map[string]string)
+	flattenConfig(oldShown, "", before.Redacted().Map())
+	newShown := make(map[string]string)
+	flattenConfig(newShown, "", after.Redacted().Map())
+
+	var diff []string
+	for key, value := range oldValues {
+		if newValue, ok := newValues[key]; !ok {
+			diff = append(diff, fmt.Sprintf("%s: %s -> (unset)", key, oldShown[key]))
+		} else if newValue != value {
+			diff = append(diff, fmt.Sprintf("%s: %s -> %s", key, oldShown[key], newShown[key]))
+		}
+	}
+	for key := range newValues {
+		if _, ok := oldValues[key]; !ok {
+			diff = append(diff, fmt.Sprintf("%s: (unset) -> %s", key, newShown[key]))
+		}
+	}
+	sort.Strings(diff)
+	return diff
+}
+
+// flattenConfig turns the nested maps from Config.Map into dotted keys.
+func flattenConfig(values map[string]string, prefix string, m map[string]interface{}) {
+	for key, value := range m {
+		if nested, ok := value.(map[string]interface{}); ok {
+			flattenConfig(values, prefix+key+".", nested)
+			continue
+		}
+		values[prefix+key] = fmt.Sprintf("%v", value)
+	}
+}
+
+// needsRestart returns the changed settings which are only read at startup.
+func needsRestart(diff []string) []string {
+	var restart []string
+	for _, change := range diff {
+		key := strings.SplitN(change, ":", 2)[0]
+		section := strings.SplitN(key, ".", 2)[0]
+		if contains(restartSections, section) {
+			restart = append(restart, key)
+		}
+	}
+	return restart
+}
+
+// WatchConfig reloads the config whenever filename changes, using load, and
+// sends it on the returned channel if it's valid and differs from the last
+// one.  Invalid configs are logged and otherwise ignored, so the last valid
+// config stays in use.  If the receiver falls behind, only the newest config
+// is kept.  Watching stops when ctx is cancelled.
+func WatchConfig(ctx context.Context, filename string, current *Config, load func() (*Config, error)) (<-chan *Config, error) {
+	log := logging.FromContext(ctx).WithField("config", filename)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	// Watch the directory rather than the file, since editors and Kubernetes
+	// replace the file instead of writing to it.
+	err = watcher.Add(filepath.Dir(filename))
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	configs := make(chan *Config, 1)
+	go func() {
+		defer watcher.Close()
+		var settle <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case err := <-watcher.Errors:
+				log.WithError(err).Warn("Error watching config")
+			case event := <-watcher.Events:
+				if !isConfigEvent(event, filename) {
+					continue
+				}
+				settle = time.After(configReloadDelay)
+			case <-settle:
+				settle = nil
+				config, err := load()
+				if err == nil {
+					err = config.Validate()
+				}
+				if err != nil {
+					log.WithError(err).Error("Ignoring invalid config, keeping the previous one")
+					continue
+				}
+
+				diff := ConfigDiff(current, config)
+				if len(diff) == 0 {
+					continue
+				}
+				current = config
+				log.WithField("changes", strings.Join(diff, ", ")).Info("Config changed")
+				if restart := needsRestart(diff); len(restart) > 0 {
+					log.WithField("settings", strings.Join(restart, ", ")).Warn("Restart oolong to apply these settings")
+				}
+
+				// Replace any config which hasn't been picked up yet
+				select {
+				case <-configs:
+				default:
+				}
+				configs <- config
+			}
+		}
+	}()
+	return configs, nil
+}
+
+// isConfigEvent returns whether event, from watching the config's directory,
+// could have changed the config.  Other files there, like the state, are
+// ignored.  Kubernetes updates mounted configs by replacing the ..data link
+// the file points through, so changes to that count too.
+func isConfigEvent(event fsnotify.Event, filename string) bool {
+	name := filepath.Clean(event.Name)
+	return name == filepath.Clean(filename) || filepath.Base(name) == "..data"
+}
+
+// ConfigRelay keeps the latest config received from a reload channel, and
+// passes later ones on to whoever is polling.  With leader election, configs
+// keep arriving while standing by, and each turn as leader should start from
+// the newest of them.
+type ConfigRelay struct {
+	lock    sync.Mutex
+	latest  *Config
+	polling chan *Config
+}
+
+// RelayConfigs starts reading configs from reload, which may be nil, until
+// ctx is cancelled.  config is the latest until another is received.
+func RelayConfigs(ctx context.Context, config *Config, reload <-chan *Config) *ConfigRelay {
+	relay := &ConfigRelay{latest: config}
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case config, ok := <-reload:
+				if !ok {
+					return
+				}
+				relay.received(config)
+			}
+		}
+	}()
+	return relay
+}
+
+func (r *ConfigRelay) received(config *Config) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.latest = config
+	if r.polling == nil {
+		return
+	}
+	// Replace any config which hasn't been picked up yet
+	select {
+	case <-r.polling:
+	default:
+	}
+	r.polling <- config
+}
+
+// Start returns the latest config, and a channel for the configs received
+// from now until Stop is called.
+func (r *ConfigRelay) Start() (*Config, <-chan *Config) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.polling = make(chan *Config, 1)
+	return r.latest, r.polling
+}
+
+// Stop stops passing configs on to the channel returned by Start.  They're
+// still kept, for the next call to Start.
+func (r *ConfigRelay) Stop() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.polling = nil
+}
+
+// sinksChanged returns whether the sinks need to be recreated to apply the
+// new config.
+func sinksChanged(before, after *Config) bool {
+	return !reflect.DeepEqual(before.Sinks, after.Sinks) ||
+		!reflect.DeepEqual(before.OpenTSDB, after.OpenTSDB) ||
+		!reflect.DeepEqual(before.Postgres, after.Postgres) ||
+		!reflect.DeepEqual(before.Archive, after.Archive)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestConfigDiff(t *testing.T) {
+	before := defaultConfig()
+	after := defaultConfig()
+	if len(ConfigDiff(before, after)) != 0 {
+		t.Fail()
+	}
+
+	after.PollInterval = 60
+	after.OAuth.Secret = "0123456789abcdef"
+	after.Redis.Port = 6380
+	diff := ConfigDiff(before, after)
+	if len(diff) != 3 || diff[0] != "oauth.secret:  -> [redacted]" || diff[1] != "poll_interval: 300 -> 60" {
+		t.Error(diff)
+	}
+
+	// A changed secret is still a change, though it's shown the same
+	before.OAuth.Secret = "fedcba9876543210"
+	diff = ConfigDiff(before, after)
+	if len(diff) != 3 || diff[0] != "oauth.secret: [redacted] -> [redacted]" {
+		t.Error(diff)
+	}
+
+	restart := needsRestart(diff)
+	if len(restart) != 2 || restart[0] != "oauth.secret" || restart[1] != "redis.port" {
+		t.Error(restart)
+	}
+}
+
+func TestSinksChanged(t *testing.T) {
+	before := defaultConfig()
+	after := defaultConfig()
+	after.PollInterval = 60
+	if sinksChanged(before, after) {
+		t.Fail()
+	}
+
+	after.OpenTSDB.Retries = 3
+	if !sinksChanged(before, after) {
+		t.Fail()
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oolong")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "oolong.toml")
+	ioutil.WriteFile(filename, []byte("[oauth]\nid = \"x\"\n"), 0600)
+
+	load := func() (*Config, error) {
+		return LoadConfig(filename, nil)
+	}
+	current, err := load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	configs, err := WatchConfig(ctx, filename, current, load)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Invalid configs are skipped
+	ioutil.WriteFile(filename, []byte("poll_interval = 1\n[oauth]\nid = \"x\"\n"), 0600)
+	select {
+	case <-configs:
+		t.Error("invalid config was sent")
+	case <-time.After(2 * configReloadDelay):
+	}
+
+	ioutil.WriteFile(filename, []byte("poll_interval = 60\n[oauth]\nid = \"x\"\n"), 0600)
+	select {
+	case config := <-configs:
+		if config.PollInterval != 60 {
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("config wasn't reloaded")
+	}
+}
+
+func TestWatchConfigOtherFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oolong")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "oolong.toml")
+	ioutil.WriteFile(filename, []byte("[oauth]\nid = \"x\"\n"), 0600)
+
+	var loads int32
+	load := func() (*Config, error) {
+		atomic.AddInt32(&loads, 1)
+		return LoadConfig(filename, nil)
+	}
+	current, err := LoadConfig(filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err = WatchConfig(ctx, filename, current, load)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The state saved next to the config doesn't cause a reload
+	ioutil.WriteFile(filepath.Join(dir, "state.json"), []byte("{}"), 0600)
+	time.Sleep(2 * configReloadDelay)
+	if atomic.LoadInt32(&loads) != 0 {
+		t.Error(loads)
+	}
+}
+
+func TestIsConfigEvent(t *testing.T) {
+	filename := "/etc/oolong/oolong.toml"
+	if !isConfigEvent(fsnotify.Event{Name: "/etc/oolong/./oolong.toml"}, filename) {
+		t.Fail()
+	}
+	if !isConfigEvent(fsnotify.Event{Name: "/etc/oolong/..data"}, filename) {
+		t.Fail()
+	}
+	if isConfigEvent(fsnotify.Event{Name: "/etc/oolong/state.json"}, filename) {
+		t.Fail()
+	}
+}
+
+func TestConfigRelay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reload := make(chan *Config)
+	relay := RelayConfigs(ctx, &Config{PollInterval: 300}, reload)
+
+	// Configs received while standing by are kept for the next turn
+	reload <- &Config{PollInterval: 60}
+	reload <- &Config{PollInterval: 120}
+	if !relayedConfig(relay, 120) {
+		t.Error("config wasn't kept")
+	}
+	_, configs := relay.Start()
+
+	// and passed on during it
+	reload <- &Config{PollInterval: 180}
+	select {
+	case config := <-configs:
+		if config.PollInterval != 180 {
+			t.Error(config.PollInterval)
+		}
+	case <-time.After(time.Second):
+		t.Error("config wasn't passed on")
+	}
+	relay.Stop()
+
+	reload <- &Config{PollInterval: 240}
+	select {
+	case <-configs:
+		t.Error("config was passed on after Stop")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if !relayedConfig(relay, 240) {
+		t.Error("config wasn't kept")
+	}
+}
+
+// relayedConfig waits for the relay's latest config to have the given poll
+// interval, since configs are received in the background.
+func relayedConfig(relay *ConfigRelay, interval int) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		relay.lock.Lock()
+		latest := relay.latest
+		relay.lock.Unlock()
+		if latest.PollInterval == interval {
+			return true
+		}
+	}
+	return false
+}
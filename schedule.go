@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// Schedule says when poll cycles start.
+type Schedule interface {
+	// Next returns the first tick after t, or the zero time if there aren't
+	// any more.
+	Next(t time.Time) time.Time
+}
+
+// NewSchedule returns the schedule in the config.  If there are any cron
+// expressions, there's a tick whenever one of them matches.  Otherwise
+// there's a tick every poll_interval, counted from start, or from midnight if
+// schedule.align is set.  Times are in the configured time zone.
+func NewSchedule(config *Config, start time.Time) (Schedule, error) {
+	loc, err := config.Location("")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(config.Schedule.Cron) > 0 {
+		schedule := cronSchedule{loc: loc}
+		for _, spec := range config.Schedule.Cron {
+			s, err := cron.ParseStandard(spec)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid cron expression %s: %w", spec, err)
+			}
+			schedule.specs = append(schedule.specs, s)
+		}
+		return schedule, nil
+	}
+
+	schedule := intervalSchedule{
+		interval: time.Duration(config.PollInterval) * time.Second,
+		anchor:   start,
+		loc:      loc,
+	}
+	if config.Schedule.Align {
+		schedule.anchor = time.Time{}
+	}
+	return schedule, nil
+}
+
+// A tick every interval.  Fixed rate, so the time taken by cycles doesn't
+// push the ticks back.
+type intervalSchedule struct {
+	interval time.Duration
+	// Ticks are counted from here, or from midnight each day if it's zero.
+	// Intervals which don't divide a day start again at midnight.
+	anchor time.Time
+	loc    *time.Location
+}
+
+func (s intervalSchedule) Next(t time.Time) time.Time {
+	if s.interval <= 0 {
+		return t
+	}
+
+	anchor := s.anchor
+	var midnight time.Time
+	if anchor.IsZero() {
+		anchor = Day(t.In(s.loc), s.loc)
+		midnight = Day(t.In(s.loc).AddDate(0, 0, 1), s.loc)
+	}
+	if t.Before(anchor) {
+		return anchor
+	}
+
+	next := anchor.Add((t.Sub(anchor)/s.interval + 1) * s.interval)
+	if !midnight.IsZero() && next.After(midnight) {
+		return midnight
+	}
+	return next
+}
+
+// A tick whenever any of the cron expressions match, in loc.
+type cronSchedule struct {
+	specs []cron.Schedule
+	loc   *time.Location
+}
+
+func (s cronSchedule) Next(t time.Time) time.Time {
+	var next time.Time
+	for _, spec := range s.specs {
+		n := spec.Next(t.In(s.loc))
+		if !n.IsZero() && (next.IsZero() || n.Before(next)) {
+			next = n
+		}
+	}
+	return next
+}
+
+// NextTick returns the tick to run the cycle after the one for last.  Ticks
+// missed by now, because a cycle overran them or the host was asleep, aren't
+// made up one by one.  They're run as a single cycle for the latest of them,
+// straight away, and the ticks after it are kept to.  Nothing is lost by this,
+// as each cycle fetches everything since the stats were last fetched.  Returns
+// the tick and the number of ticks skipped.
+func NextTick(schedule Schedule, last, now time.Time) (time.Time, int) {
+	tick := schedule.Next(last)
+	skipped := 0
+	for !tick.IsZero() && !tick.After(now) {
+		following := schedule.Next(tick)
+		if following.IsZero() || !following.After(tick) || following.After(now) {
+			break
+		}
+		tick = following
+		skipped++
+	}
+	return tick, skipped
+}
+
+// Jitter returns a random delay of up to schedule.jitter seconds, to add to a
+// tick so that oolongs on the same schedule don't all call the API at once.
+func (c *Config) Jitter() time.Duration {
+	if c.Schedule.Jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(c.Schedule.Jitter) * int64(time.Second)))
+}
+
+// StatInterval returns the shortest time between fetches of a stat, or 0 if
+// it's fetched every tick.
+func (c *Config) StatInterval(stat string) time.Duration {
+	return time.Duration(c.Schedule.Intervals[stat]) * time.Second
+}
+
+// longestGap returns the longest time between ticks of the schedule, over
+// span from the first tick after start.
+func longestGap(schedule Schedule, start time.Time, span time.Duration) time.Duration {
+	var gap time.Duration
+	first := schedule.Next(start)
+	end := first.Add(span)
+	for t := first; !t.IsZero() && t.Before(end); {
+		next := schedule.Next(t)
+		if next.IsZero() || !next.After(t) {
+			break
+		}
+		if next.Sub(t) > gap {
+			gap = next.Sub(t)
+		}
+		t = next
+	}
+	return gap
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// 10:03:20 in UTC
+var scheduleTestTime = time.Date(2021, 6, 1, 10, 3, 20, 0, time.UTC)
+
+func TestIntervalSchedule(t *testing.T) {
+	config := &Config{PollInterval: 300, TimeZone: "UTC"}
+	schedule, err := NewSchedule(config, scheduleTestTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Counted from start, however late the last tick was asked about
+	next := schedule.Next(scheduleTestTime)
+	if !next.Equal(scheduleTestTime.Add(5 * time.Minute)) {
+		t.Error(next)
+	}
+	next = schedule.Next(scheduleTestTime.Add(9 * time.Minute))
+	if !next.Equal(scheduleTestTime.Add(10 * time.Minute)) {
+		t.Error(next)
+	}
+}
+
+func TestIntervalScheduleAligned(t *testing.T) {
+	config := &Config{PollInterval: 300, TimeZone: "UTC", Schedule: ScheduleConfig{Align: true}}
+	schedule, err := NewSchedule(config, scheduleTestTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := schedule.Next(scheduleTestTime)
+	if !next.Equal(time.Date(2021, 6, 1, 10, 5, 0, 0, time.UTC)) {
+		t.Error(next)
+	}
+	if !schedule.Next(next).Equal(next.Add(5 * time.Minute)) {
+		t.Fail()
+	}
+
+	// Intervals which don't divide a day start again at midnight
+	config.PollInterval = 7 * 60 * 60
+	schedule, _ = NewSchedule(config, scheduleTestTime)
+	next = schedule.Next(scheduleTestTime)
+	if !next.Equal(time.Date(2021, 6, 1, 14, 0, 0, 0, time.UTC)) {
+		t.Error(next)
+	}
+	next = schedule.Next(time.Date(2021, 6, 1, 21, 0, 0, 0, time.UTC))
+	if !next.Equal(time.Date(2021, 6, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Error(next)
+	}
+}
+
+func TestCronSchedule(t *testing.T) {
+	// Every 5 minutes during the day, hourly overnight, in Denver
+	config := &Config{TimeZone: "America/Denver", Schedule: ScheduleConfig{Cron: []string{"*/5 7-22 * * *", "0 23,0-6 * * *"}}}
+	schedule, err := NewSchedule(config, scheduleTestTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	denver, _ := time.LoadLocation("America/Denver")
+
+	next := schedule.Next(time.Date(2021, 6, 1, 10, 3, 20, 0, denver))
+	if !next.Equal(time.Date(2021, 6, 1, 10, 5, 0, 0, denver)) {
+		t.Error(next)
+	}
+	next = schedule.Next(time.Date(2021, 6, 1, 23, 3, 0, 0, denver))
+	if !next.Equal(time.Date(2021, 6, 2, 0, 0, 0, 0, denver)) {
+		t.Error(next)
+	}
+
+	if gap := longestGap(schedule, scheduleTestTime, 7*24*time.Hour); gap != time.Hour {
+		t.Error(gap)
+	}
+}
+
+func TestNewScheduleInvalid(t *testing.T) {
+	config := &Config{Schedule: ScheduleConfig{Cron: []string{"*/5 * * *"}}}
+	if _, err := NewSchedule(config, scheduleTestTime); err == nil {
+		t.Fail()
+	}
+}
+
+func TestNextTick(t *testing.T) {
+	config := &Config{PollInterval: 300, TimeZone: "UTC"}
+	schedule, _ := NewSchedule(config, scheduleTestTime)
+
+	// On time
+	tick, skipped := NextTick(schedule, scheduleTestTime, scheduleTestTime.Add(time.Minute))
+	if !tick.Equal(scheduleTestTime.Add(5*time.Minute)) || skipped != 0 {
+		t.Error(tick, skipped)
+	}
+
+	// The cycle overran the next tick, which runs late
+	tick, skipped = NextTick(schedule, scheduleTestTime, scheduleTestTime.Add(6*time.Minute))
+	if !tick.Equal(scheduleTestTime.Add(5*time.Minute)) || skipped != 0 {
+		t.Error(tick, skipped)
+	}
+
+	// Asleep for an hour, so only the latest of the ticks missed is run
+	tick, skipped = NextTick(schedule, scheduleTestTime, scheduleTestTime.Add(61*time.Minute))
+	if !tick.Equal(scheduleTestTime.Add(60*time.Minute)) || skipped != 11 {
+		t.Error(tick, skipped)
+	}
+}
+
+func TestConfigJitter(t *testing.T) {
+	config := &Config{}
+	if config.Jitter() != 0 {
+		t.Fail()
+	}
+	config.Schedule.Jitter = 10
+	for i := 0; i < 100; i++ {
+		if jitter := config.Jitter(); jitter < 0 || jitter >= 10*time.Second {
+			t.Fatal(jitter)
+		}
+	}
+}
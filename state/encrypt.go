@@ -0,0 +1,230 @@
+package state
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// KeySize is the length of a state key in bytes, for AES-256.
+const KeySize = 32
+
+// ErrKeyRequired is returned when loading encrypted state without a key.
+var ErrKeyRequired = errors.New("State is encrypted, but no state key is set")
+
+// Key encrypts the secrets in the state.  Each save encrypts the secrets with
+// a new random data key, and stores the data key encrypted with the Key
+// alongside them, so the Key only ever encrypts data keys.
+type Key struct {
+	key []byte
+	// Identifies the key without giving it away, to tell which key the
+	// state was saved with
+	id string
+}
+
+// NewKey wraps KeySize random bytes as a Key.
+func NewKey(key []byte) (*Key, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("State key must be %d bytes, got %d", KeySize, len(key))
+	}
+	sum := sha256.Sum256(key)
+	return &Key{key: key, id: hex.EncodeToString(sum[:4])}, nil
+}
+
+// ParseKey decodes a base64 key, as made by GenerateKey or
+// `openssl rand -base64 32`.
+func ParseKey(encoded string) (*Key, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("State key isn't valid base64: %s", err)
+	}
+	return NewKey(key)
+}
+
+// GenerateKey returns a new random key, base64 encoded.
+func GenerateKey() (string, error) {
+	key := make([]byte, KeySize)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// ID identifies the key, without giving it away.
+func (k *Key) ID() string {
+	return k.id
+}
+
+var stateKey, previousKey *Key
+
+// SetKey sets the key the backends encrypt secrets with when saving, and
+// decrypt them with when loading.  Secrets are stored in plain text if it's
+// nil.  Loading plain text state works either way, so setting a key encrypts
+// existing state the next time it's saved.
+func SetKey(key *Key) {
+	stateKey = key
+}
+
+// SetPreviousKey sets a key which secrets are still decrypted with, but never
+// encrypted with, so the key can be changed without stopping every oolong at
+// once.  State saved with it is encrypted with the key from SetKey the next
+// time it's saved.
+func SetPreviousKey(key *Key) {
+	previousKey = key
+}
+
+// currentKeyID returns the ID of the key set with SetKey, or "" if there
+// isn't one.
+func currentKeyID() string {
+	if stateKey == nil {
+		return ""
+	}
+	return stateKey.id
+}
+
+// EncryptedSecrets is how the secrets are stored when a key is set.
+type EncryptedSecrets struct {
+	// ID of the key the data key is encrypted with
+	KeyID string
+	// Data key, encrypted with the key
+	DataKey []byte
+	// Secrets as JSON, encrypted with the data key
+	Secrets []byte
+}
+
+// secrets holds the fields of the state which are encrypted when saved.
+type secrets struct {
+	AccessToken string `json:",omitempty"`
+	// Replaces the fields above when saved with a key set
+	Encrypted *EncryptedSecrets `json:",omitempty"`
+}
+
+func (s *secrets) GetAccessToken() string {
+	return s.AccessToken
+}
+
+func (s *secrets) SetAccessToken(token string) {
+	s.AccessToken = token
+}
+
+// keyID returns the ID of the key the secrets were saved with, or "" if they
+// were saved in plain text.
+func (s *secrets) keyID() string {
+	if s.Encrypted == nil {
+		return ""
+	}
+	return s.Encrypted.KeyID
+}
+
+// sealed returns the secrets as they should be saved, encrypted if a key is
+// set.
+func (s secrets) sealed() (secrets, error) {
+	if stateKey == nil {
+		return secrets{AccessToken: s.AccessToken}, nil
+	}
+
+	plaintext, err := json.Marshal(secrets{AccessToken: s.AccessToken})
+	if err != nil {
+		return secrets{}, err
+	}
+	dataKey := make([]byte, KeySize)
+	_, err = rand.Read(dataKey)
+	if err != nil {
+		return secrets{}, err
+	}
+
+	encrypted := &EncryptedSecrets{KeyID: stateKey.id}
+	encrypted.DataKey, err = seal(stateKey.key, dataKey)
+	if err != nil {
+		return secrets{}, err
+	}
+	encrypted.Secrets, err = seal(dataKey, plaintext)
+	if err != nil {
+		return secrets{}, err
+	}
+	return secrets{Encrypted: encrypted}, nil
+}
+
+// open decrypts secrets which were saved encrypted.
+func (s *secrets) open() error {
+	if s.Encrypted == nil {
+		return nil
+	}
+	var key *Key
+	var ids []string
+	for _, k := range []*Key{stateKey, previousKey} {
+		if k == nil {
+			continue
+		}
+		if k.id == s.Encrypted.KeyID {
+			key = k
+		}
+		ids = append(ids, k.id)
+	}
+	if len(ids) == 0 {
+		return ErrKeyRequired
+	}
+	if key == nil {
+		return fmt.Errorf("State was encrypted with key %s, not %s", s.Encrypted.KeyID, strings.Join(ids, " or "))
+	}
+
+	dataKey, err := unseal(key.key, s.Encrypted.DataKey)
+	if err != nil {
+		return fmt.Errorf("Failed to decrypt data key: %s", err)
+	}
+	plaintext, err := unseal(dataKey, s.Encrypted.Secrets)
+	if err != nil {
+		return fmt.Errorf("Failed to decrypt secrets: %s", err)
+	}
+	var opened secrets
+	err = json.Unmarshal(plaintext, &opened)
+	if err != nil {
+		return err
+	}
+	*s = opened
+	return nil
+}
+
+// seal encrypts plaintext with AES-GCM, returning the nonce followed by the
+// ciphertext.
+func seal(key, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func unseal(key, sealed []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,201 @@
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"gopkg.in/redis.v5"
+)
+
+func testKey(t *testing.T) *Key {
+	encoded, err := GenerateKey()
+	if err != nil {
+		t.FailNow()
+	}
+	key, err := ParseKey(encoded)
+	if err != nil {
+		t.FailNow()
+	}
+	return key
+}
+
+func TestParseKey(t *testing.T) {
+	_, err := ParseKey("not base64!")
+	if err == nil {
+		t.Fail()
+	}
+
+	// Too short for AES-256
+	_, err = ParseKey("c2hvcnQ=")
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func TestFileStateEncrypted(t *testing.T) {
+	defer os.Remove("test.json")
+	defer SetKey(nil)
+	key := testKey(t)
+	SetKey(key)
+
+	state := NewFileState("test.json")
+	state.SetAccessToken("secret-token")
+	err := state.Save()
+	if err != nil {
+		t.FailNow()
+	}
+
+	data, _ := ioutil.ReadFile("test.json")
+	if strings.Contains(string(data), "secret-token") || !strings.Contains(string(data), key.ID()) {
+		t.Fail()
+	}
+
+	loaded, err := NewStateFromFile("test.json")
+	if err != nil || loaded.GetAccessToken() != "secret-token" {
+		t.Fail()
+	}
+
+	// The key is needed to load it again
+	SetKey(nil)
+	_, err = NewStateFromFile("test.json")
+	if err != ErrKeyRequired {
+		t.Fail()
+	}
+	SetKey(testKey(t))
+	_, err = NewStateFromFile("test.json")
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func TestFileStateRekey(t *testing.T) {
+	defer os.Remove("test.json")
+	defer SetKey(nil)
+
+	// Plain text state is encrypted once a key is set
+	ioutil.WriteFile("test.json", []byte(`{"AccessToken": "abc"}`), 0600)
+	oldKey := testKey(t)
+	SetKey(oldKey)
+	state, err := NewStateFromFile("test.json")
+	if err != nil || state.GetAccessToken() != "abc" {
+		t.FailNow()
+	}
+	state.Save()
+
+	// Then moved to a new key
+	state, err = NewStateFromFile("test.json")
+	if err != nil {
+		t.FailNow()
+	}
+	newKey := testKey(t)
+	SetKey(newKey)
+	state.Save()
+
+	state, err = NewStateFromFile("test.json")
+	if err != nil || state.GetAccessToken() != "abc" {
+		t.Fail()
+	}
+	SetKey(oldKey)
+	_, err = NewStateFromFile("test.json")
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func TestRedisStateEncrypted(t *testing.T) {
+	defer deleteTestRedisState()
+	defer SetKey(nil)
+	SetKey(testKey(t))
+
+	state := NewRedisState(testRedisOptions, testRedisKey)
+	state.SetAccessToken("secret-token")
+	state.Save()
+
+	loaded, err := NewStateFromRedis(testRedisOptions, testRedisKey)
+	if err != nil || loaded.GetAccessToken() != "secret-token" {
+		t.Fail()
+	}
+	if loaded.(*redisState).Encrypted != nil {
+		t.Fail()
+	}
+}
+
+func TestRedisStateRekey(t *testing.T) {
+	defer deleteTestRedisState()
+	defer SetKey(nil)
+	client := redis.NewClient(&redis.Options{Addr: testRedisOptions.Addr})
+	client.Set(testRedisKey, `{"AccessToken":"tok"}`, 0)
+
+	// Plain text state is encrypted once a key is set, even though nothing
+	// else changed
+	oldKey := testKey(t)
+	SetKey(oldKey)
+	state, err := NewStateFromRedis(testRedisOptions, testRedisKey)
+	if err != nil {
+		t.FailNow()
+	}
+	err = state.Save()
+	data, _ := client.Get(testRedisKey).Result()
+	if err != nil || strings.Contains(data, "tok") || !strings.Contains(data, oldKey.ID()) {
+		t.Error(data)
+	}
+
+	// As oolong state rekey does
+	state, err = NewStateFromRedis(testRedisOptions, testRedisKey)
+	if err != nil {
+		t.FailNow()
+	}
+	newKey := testKey(t)
+	SetKey(newKey)
+	err = state.Save()
+	data, _ = client.Get(testRedisKey).Result()
+	if err != nil || !strings.Contains(data, newKey.ID()) || strings.Contains(data, oldKey.ID()) {
+		t.Error(data)
+	}
+
+	// And oolong state rekey --decrypt
+	state, err = NewStateFromRedis(testRedisOptions, testRedisKey)
+	if err != nil {
+		t.FailNow()
+	}
+	SetKey(nil)
+	err = state.Save()
+	data, _ = client.Get(testRedisKey).Result()
+	if err != nil || data != `{"AccessToken":"tok"}` {
+		t.Error(data)
+	}
+}
+
+func TestFileStatePreviousKey(t *testing.T) {
+	defer os.Remove("test.json")
+	defer SetKey(nil)
+	defer SetPreviousKey(nil)
+
+	oldKey := testKey(t)
+	SetKey(oldKey)
+	state := NewFileState("test.json")
+	state.SetAccessToken("abc")
+	state.Save()
+
+	// Loaded with the previous key, then saved with the new one
+	newKey := testKey(t)
+	SetKey(newKey)
+	SetPreviousKey(oldKey)
+	loaded, err := NewStateFromFile("test.json")
+	if err != nil || loaded.GetAccessToken() != "abc" {
+		t.FailNow()
+	}
+	loaded.Save()
+	data, _ := ioutil.ReadFile("test.json")
+	if !strings.Contains(string(data), newKey.ID()) {
+		t.Fail()
+	}
+
+	SetPreviousKey(nil)
+	loaded, err = NewStateFromFile("test.json")
+	if err != nil || loaded.GetAccessToken() != "abc" {
+		t.Fail()
+	}
+}
@@ -0,0 +1,77 @@
+package state
+
+import (
+	"time"
+
+	"gopkg.in/redis.v5"
+)
+
+// Lock is held by one oolong at a time, for picking which of several
+// replicas polls.  Each oolong identifies itself with an id.
+type Lock interface {
+	// Acquire takes the lock if it's free, or renews it if it's already
+	// held, returning whether it's held.
+	Acquire() (bool, error)
+	// Holder returns the id of the oolong holding the lock, or "" if it's
+	// free.
+	Holder() (string, error)
+	// Release frees the lock, if it's held.
+	Release() error
+}
+
+// Takes KEYS[1] for ARGV[1] for ARGV[2] milliseconds, if it's free or
+// already held by ARGV[1].
+var acquireScript = `
+local holder = redis.call('GET', KEYS[1])
+if not holder or holder == ARGV[1] then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+	return 1
+end
+return 0
+`
+
+// Deletes KEYS[1] if it's held by ARGV[1].
+var releaseScript = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`
+
+type redisLock struct {
+	client *redis.Client
+	key    string
+	id     string
+	ttl    time.Duration
+}
+
+// NewRedisLock returns a lock held by setting key to id.  It expires after
+// ttl unless it's acquired again, so it's freed if the holder dies.
+func NewRedisLock(options RedisOptions, key, id string, ttl time.Duration) Lock {
+	return &redisLock{
+		client: newRedisClient(options),
+		key:    key,
+		id:     id,
+		ttl:    ttl,
+	}
+}
+
+func (l *redisLock) Acquire() (bool, error) {
+	result, err := l.client.Eval(acquireScript, []string{l.key}, l.id, int64(l.ttl/time.Millisecond)).Result()
+	if err != nil {
+		return false, err
+	}
+	return result == int64(1), nil
+}
+
+func (l *redisLock) Holder() (string, error) {
+	holder, err := l.client.Get(l.key).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return holder, err
+}
+
+func (l *redisLock) Release() error {
+	return l.client.Eval(releaseScript, []string{l.key}, l.id).Err()
+}
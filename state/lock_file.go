@@ -0,0 +1,95 @@
+//go:build !windows
+// +build !windows
+
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+)
+
+type fileLock struct {
+	filename string
+	id       string
+	// Open while the lock is held
+	file *os.File
+}
+
+// NewFileLock returns a lock held with flock on filename, which also holds
+// the id of the holder.  The lock is freed when the holder exits, however it
+// exits.  Only oolongs on the same host, or sharing a filesystem with working
+// flock, see each other's locks.
+func NewFileLock(filename, id string) Lock {
+	return &fileLock{filename: filename, id: id}
+}
+
+func (l *fileLock) Acquire() (bool, error) {
+	if l.file != nil {
+		return true, nil
+	}
+
+	file, err := os.OpenFile(l.filename, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return false, err
+	}
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		file.Close()
+		return false, nil
+	}
+	if err != nil {
+		file.Close()
+		return false, err
+	}
+
+	err = file.Truncate(0)
+	if err == nil {
+		_, err = file.WriteAt([]byte(l.id), 0)
+	}
+	if err != nil {
+		file.Close()
+		return false, err
+	}
+	l.file = file
+	return true, nil
+}
+
+func (l *fileLock) Holder() (string, error) {
+	if l.file != nil {
+		return l.id, nil
+	}
+
+	file, err := os.Open(l.filename)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	// The id is left behind by a holder that died, so only trust it while
+	// the lock is held
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+	if err == nil {
+		return "", nil
+	}
+	if err != syscall.EWOULDBLOCK {
+		return "", err
+	}
+	data, err := ioutil.ReadAll(file)
+	return strings.TrimSpace(string(data)), err
+}
+
+func (l *fileLock) Release() error {
+	if l.file == nil {
+		return nil
+	}
+	l.file.Truncate(0)
+	// Closing the file releases the lock
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
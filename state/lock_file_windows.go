@@ -0,0 +1,25 @@
+package state
+
+import "errors"
+
+type fileLock struct{}
+
+// NewFileLock isn't supported on Windows, which doesn't have flock.  Acquiring
+// the lock always fails.
+func NewFileLock(filename, id string) Lock {
+	return fileLock{}
+}
+
+var errFileLock = errors.New("File locks aren't supported on Windows, use the redis backend")
+
+func (fileLock) Acquire() (bool, error) {
+	return false, errFileLock
+}
+
+func (fileLock) Holder() (string, error) {
+	return "", errFileLock
+}
+
+func (fileLock) Release() error {
+	return nil
+}
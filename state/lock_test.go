@@ -0,0 +1,77 @@
+package state
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFileLock(t *testing.T) {
+	defer os.Remove("test.lock")
+	first := NewFileLock("test.lock", "first")
+	second := NewFileLock("test.lock", "second")
+
+	held, err := first.Acquire()
+	if err != nil || !held {
+		t.FailNow()
+	}
+	held, err = second.Acquire()
+	if err != nil || held {
+		t.Fail()
+	}
+	if holder, _ := second.Holder(); holder != "first" {
+		t.Error(holder)
+	}
+
+	// Acquiring again renews it
+	held, _ = first.Acquire()
+	if !held {
+		t.Fail()
+	}
+
+	first.Release()
+	if holder, _ := second.Holder(); holder != "" {
+		t.Error(holder)
+	}
+	held, _ = second.Acquire()
+	if !held {
+		t.Fail()
+	}
+	second.Release()
+}
+
+func TestRedisLock(t *testing.T) {
+	key := testRedisKey + ":leader"
+	first := NewRedisLock(testRedisOptions, key, "first", 100*time.Millisecond)
+	second := NewRedisLock(testRedisOptions, key, "second", 100*time.Millisecond)
+	defer first.Release()
+	defer second.Release()
+
+	held, err := first.Acquire()
+	if err != nil || !held {
+		t.FailNow()
+	}
+	held, err = second.Acquire()
+	if err != nil || held {
+		t.Fail()
+	}
+	if holder, _ := second.Holder(); holder != "first" {
+		t.Error(holder)
+	}
+
+	// Releasing someone else's lock does nothing
+	second.Release()
+	if holder, _ := first.Holder(); holder != "first" {
+		t.Error(holder)
+	}
+
+	// The lock expires unless it's renewed
+	time.Sleep(150 * time.Millisecond)
+	if holder, _ := first.Holder(); holder != "" {
+		t.Error(holder)
+	}
+	held, _ = second.Acquire()
+	if !held {
+		t.Fail()
+	}
+}
@@ -1,58 +1,371 @@
 package state
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"net"
+	"strings"
 	"time"
 
+	"github.com/sirupsen/logrus"
 	"gopkg.in/redis.v5"
 )
 
+// RedisOptions says how to connect to redis.
+type RedisOptions struct {
+	// host:port of the server.  Ignored when using Sentinel.
+	Addr string
+	// ACL user to log in as, for redis 6 and later.  If empty, AUTH is sent
+	// with just the password.
+	Username string
+	Password string
+	DB       int
+	// Connect with TLS if set
+	TLS *tls.Config
+	// Find the master called MasterName through these Sentinels, instead of
+	// connecting to Addr
+	MasterName string
+	Sentinels  []string
+}
+
+// Timeout for connecting and logging in, when oolong does it itself.
+var redisDialTimeout = 5 * time.Second
+
+// Number of times Save tries again when the state changes under it.
+const redisSaveRetries = 5
+
+// Timestamps are stored in this format, in UTC.  It's fixed width, so later
+// timestamps compare greater as strings.
+const redisTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+// Sets each field of the hash KEYS[1] to its value in ARGV, given as field,
+// value pairs, unless it already has a later value.  This keeps another
+// oolong saving at the same time from moving timestamps back.
+var forwardScript = `
+for i = 1, #ARGV, 2 do
+	local current = redis.call('HGET', KEYS[1], ARGV[i])
+	if not current or current < ARGV[i + 1] then
+		redis.call('HSET', KEYS[1], ARGV[i], ARGV[i + 1])
+	end
+end
+return 0
+`
+
+// The redis backend stores the secrets as JSON in key, and the timestamps in
+// the hashes key:last_updated, with uuid/reading_type fields, and
+// key:sink_last_updated, with sink/uuid/reading_type fields.  Save only
+// writes what changed, so several oolongs can share the state.
 type redisState struct {
-	AccessToken string
-	client      *redis.Client `json:"-"`
-	key         string        `json:"-"`
+	secrets
+	client *redis.Client
+	key    string
 	// uuid -> reading_type -> timestamp
 	LastUpdated map[string]map[string]time.Time
+	// sink -> uuid -> reading_type -> timestamp
+	SinkLastUpdated map[string]map[string]map[string]time.Time
+
+	// What needs saving, by hash field
+	changed        map[string]time.Time
+	sinkChanged    map[string]time.Time
+	secretsChanged bool
+	// ID of the key the stored secrets are encrypted with, "" for plain
+	// text.  They're saved again whenever the key changes.
+	savedKeyID string
 }
 
-func NewRedisState(host string, port int, key string) State {
+// Before the timestamps moved to hashes, the whole state was stored as JSON
+// in key.
+type legacyRedisState struct {
+	secrets
+	LastUpdated     map[string]map[string]time.Time
+	SinkLastUpdated map[string]map[string]map[string]time.Time
+}
+
+func NewRedisState(options RedisOptions, key string) State {
+	return newRedisState(newRedisClient(options), key)
+}
+
+func newRedisState(client *redis.Client, key string) *redisState {
 	return &redisState{
-		client:      redis.NewClient(&redis.Options{Addr: fmt.Sprintf("%s:%d", host, port)}),
-		key:         key,
-		LastUpdated: make(map[string]map[string]time.Time),
+		client:          client,
+		key:             key,
+		LastUpdated:     make(map[string]map[string]time.Time),
+		SinkLastUpdated: make(map[string]map[string]map[string]time.Time),
+		changed:         make(map[string]time.Time),
+		sinkChanged:     make(map[string]time.Time),
+		secretsChanged:  true,
 	}
 }
 
-func NewStateFromRedis(host string, port int, key string) (State, error) {
-	client := redis.NewClient(&redis.Options{Addr: fmt.Sprintf("%s:%d", host, port)})
+func NewStateFromRedis(options RedisOptions, key string) (State, error) {
+	client := newRedisClient(options)
+	state, err := loadRedisState(client, key)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return state, nil
+}
+
+func loadRedisState(client *redis.Client, key string) (*redisState, error) {
 	data, err := client.Get(key).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNoState
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	state := new(redisState)
-	err = json.Unmarshal(data, state)
+	var saved legacyRedisState
+	err = json.Unmarshal(data, &saved)
+	if err != nil {
+		return nil, err
+	}
+	savedKeyID := saved.keyID()
+	err = saved.open()
 	if err != nil {
 		return nil, err
 	}
-	state.client = client
-	state.key = key
 
+	state := newRedisState(client, key)
+	state.secrets = saved.secrets
+	state.secretsChanged = false
+	state.savedKeyID = savedKeyID
+
+	lastUpdated, err := client.HGetAll(state.lastUpdatedKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	for field, value := range lastUpdated {
+		parts := strings.SplitN(field, "/", 2)
+		timestamp, err := time.Parse(redisTimeFormat, value)
+		if len(parts) != 2 || err != nil {
+			return nil, fmt.Errorf("Invalid timestamp %s %s in %s", field, value, state.lastUpdatedKey())
+		}
+		state.LastUpdated[parts[0]] = setTime(state.LastUpdated[parts[0]], parts[1], timestamp)
+	}
+	sinkLastUpdated, err := client.HGetAll(state.sinkLastUpdatedKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	for field, value := range sinkLastUpdated {
+		parts := strings.SplitN(field, "/", 3)
+		timestamp, err := time.Parse(redisTimeFormat, value)
+		if len(parts) != 3 || err != nil {
+			return nil, fmt.Errorf("Invalid timestamp %s %s in %s", field, value, state.sinkLastUpdatedKey())
+		}
+		updateSink(state.SinkLastUpdated, parts[0], parts[1], parts[2], timestamp)
+	}
+
+	// Timestamps from the old format are moved to the hashes by the next save
+	if state.mergeLegacy(&saved) {
+		state.secretsChanged = true
+	}
+
+	logger.WithFields(logrus.Fields{"backend": "redis", "key": key, "tags": len(state.LastUpdated)}).Debug("Loaded state")
 	return state, nil
 }
 
+func newRedisClient(options RedisOptions) *redis.Client {
+	if options.MasterName != "" {
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    options.MasterName,
+			SentinelAddrs: options.Sentinels,
+			Password:      options.Password,
+			DB:            options.DB,
+		})
+	}
+
+	redisOptions := &redis.Options{
+		Addr:      options.Addr,
+		Password:  options.Password,
+		DB:        options.DB,
+		TLSConfig: options.TLS,
+	}
+	if options.Username != "" {
+		// redis.v5 only knows AUTH with a password, so log in as the user
+		// while connecting instead.  The dialer handles TLS as well.
+		redisOptions.Password = ""
+		redisOptions.TLSConfig = nil
+		redisOptions.Dialer = func() (net.Conn, error) {
+			return dialRedis(options)
+		}
+	}
+	return redis.NewClient(redisOptions)
+}
+
+// dialRedis connects to redis and logs in as options.Username.
+func dialRedis(options RedisOptions) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", options.Addr, redisDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if options.TLS != nil {
+		tlsConn := tls.Client(conn, options.TLS)
+		err = tlsConn.Handshake()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	err = redisAuth(conn, options.Username, options.Password)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// redisAuth sends AUTH with a username, which redis 6 added for ACL users.
+func redisAuth(conn net.Conn, username, password string) error {
+	conn.SetDeadline(time.Now().Add(redisDialTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	var cmd bytes.Buffer
+	args := []string{"AUTH", username, password}
+	fmt.Fprintf(&cmd, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&cmd, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := conn.Write(cmd.Bytes())
+	if err != nil {
+		return err
+	}
+
+	// Nothing else is sent until the next command, so nothing is lost by
+	// buffering here
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(reply, "+OK") {
+		return fmt.Errorf("Redis AUTH as %s failed: %s", username, strings.TrimSpace(strings.TrimPrefix(reply, "-")))
+	}
+	return nil
+}
+
+func (s *redisState) lastUpdatedKey() string {
+	return s.key + ":last_updated"
+}
+
+func (s *redisState) sinkLastUpdatedKey() string {
+	return s.key + ":sink_last_updated"
+}
+
+// mergeLegacy adds the timestamps from state in the old format, returning
+// whether there were any.
+func (s *redisState) mergeLegacy(saved *legacyRedisState) bool {
+	if saved.LastUpdated == nil && saved.SinkLastUpdated == nil {
+		return false
+	}
+	for uuid, readings := range saved.LastUpdated {
+		for readingType, timestamp := range readings {
+			if timestamp.After(s.GetLastUpdateTime(uuid, readingType)) {
+				s.Update(uuid, readingType, timestamp)
+			}
+		}
+	}
+	for sink, tags := range saved.SinkLastUpdated {
+		for uuid, readings := range tags {
+			for readingType, timestamp := range readings {
+				s.UpdateSink(sink, uuid, readingType, timestamp)
+			}
+		}
+	}
+	return true
+}
+
+// Save writes the secrets and changed timestamps in a transaction.  The key
+// holding the secrets is watched, so the transaction is tried again if
+// another oolong saves in the meantime, e.g. an older version writing the
+// whole state as JSON.
 func (s *redisState) Save() error {
-	data, _ := json.Marshal(s)
-	return s.client.Set(s.key, data, 0).Err()
+	// Setting a key, or changing it, encrypts the secrets with it
+	if s.savedKeyID != currentKeyID() {
+		s.secretsChanged = true
+	}
+	if !s.secretsChanged && len(s.changed) == 0 && len(s.sinkChanged) == 0 {
+		return nil
+	}
+
+	var err error
+	for i := 0; i <= redisSaveRetries; i++ {
+		err = s.client.Watch(s.save, s.key)
+		if err != redis.TxFailedErr {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	s.changed = make(map[string]time.Time)
+	s.sinkChanged = make(map[string]time.Time)
+	s.secretsChanged = false
+	s.savedKeyID = currentKeyID()
+	logger.WithFields(logrus.Fields{"backend": "redis", "key": s.key}).Debug("Saved state")
+	return nil
+}
+
+func (s *redisState) save(tx *redis.Tx) error {
+	data, err := tx.Get(s.key).Bytes()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	var saved legacyRedisState
+	if err == nil && json.Unmarshal(data, &saved) == nil && s.mergeLegacy(&saved) {
+		s.secretsChanged = true
+	}
+
+	sealed, err := s.secrets.sealed()
+	if err != nil {
+		return err
+	}
+	secretsData, _ := json.Marshal(sealed)
+
+	_, err = tx.Pipelined(func(pipe *redis.Pipeline) error {
+		if len(s.changed) > 0 {
+			pipe.Eval(forwardScript, []string{s.lastUpdatedKey()}, redisTimeArgs(s.changed)...)
+		}
+		if len(s.sinkChanged) > 0 {
+			pipe.Eval(forwardScript, []string{s.sinkLastUpdatedKey()}, redisTimeArgs(s.sinkChanged)...)
+		}
+		if s.secretsChanged {
+			pipe.Set(s.key, secretsData, 0)
+		}
+		return nil
+	})
+	return err
+}
+
+// redisTimeArgs flattens timestamps into field, value arguments for
+// forwardScript.
+func redisTimeArgs(timestamps map[string]time.Time) []interface{} {
+	args := make([]interface{}, 0, 2*len(timestamps))
+	for field, timestamp := range timestamps {
+		args = append(args, field, timestamp.UTC().Format(redisTimeFormat))
+	}
+	return args
+}
+
+// Close closes the connections to redis.
+func (s *redisState) Close() error {
+	return s.client.Close()
+}
+
+func (s *redisState) SetAccessToken(token string) {
+	s.secrets.SetAccessToken(token)
+	s.secretsChanged = true
 }
 
 // Helper func to make interacting with the LastUpdated map easierr
 func (s *redisState) Update(uuid string, readingType string, timestamp time.Time) {
-	if s.LastUpdated[uuid] == nil {
-		s.LastUpdated[uuid] = make(map[string]time.Time)
-	}
-	s.LastUpdated[uuid][readingType] = timestamp
+	s.LastUpdated[uuid] = setTime(s.LastUpdated[uuid], readingType, timestamp)
+	s.changed[uuid+"/"+readingType] = timestamp
 }
 
 func (s *redisState) GetLastUpdateTime(uuid string, queryType string) time.Time {
@@ -62,10 +375,28 @@ func (s *redisState) GetLastUpdateTime(uuid string, queryType string) time.Time
 	return s.LastUpdated[uuid][queryType]
 }
 
-func (s *redisState) GetAccessToken() string {
-	return s.AccessToken
+func (s *redisState) UpdateSink(sink, uuid, readingType string, timestamp time.Time) {
+	updateSink(s.SinkLastUpdated, sink, uuid, readingType, timestamp)
+	s.sinkChanged[sink+"/"+uuid+"/"+readingType] = s.SinkLastUpdated[sink][uuid][readingType]
+	if timestamp.After(s.GetLastUpdateTime(uuid, readingType)) {
+		s.Update(uuid, readingType, timestamp)
+	}
 }
 
-func (s *redisState) SetAccessToken(token string) {
-	s.AccessToken = token
+func (s *redisState) GetSinkLastUpdateTime(sink, uuid, readingType string) time.Time {
+	// State saved before sinks were tracked separately only has the overall
+	// timestamps, which every sink was written up to.
+	if len(s.SinkLastUpdated) == 0 {
+		return s.GetLastUpdateTime(uuid, readingType)
+	}
+	return getSinkLastUpdateTime(s.SinkLastUpdated, sink, uuid, readingType)
+}
+
+// setTime sets a reading type's timestamp, creating the map if needed.
+func setTime(timestamps map[string]time.Time, readingType string, timestamp time.Time) map[string]time.Time {
+	if timestamps == nil {
+		timestamps = make(map[string]time.Time)
+	}
+	timestamps[readingType] = timestamp
+	return timestamps
 }
@@ -2,7 +2,9 @@ package state
 
 import (
 	"fmt"
+	"net"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -13,8 +15,15 @@ const testRedisHost = "localhost"
 const testRedisPort = 6379
 const testRedisKey = "oolong.test"
 
+var testRedisOptions = RedisOptions{Addr: fmt.Sprintf("%s:%d", testRedisHost, testRedisPort)}
+
+func deleteTestRedisState() {
+	redisClient := redis.NewClient(&redis.Options{Addr: testRedisOptions.Addr})
+	redisClient.Del(testRedisKey, testRedisKey+":last_updated", testRedisKey+":sink_last_updated")
+}
+
 func TestNewRedisState(t *testing.T) {
-	state := NewRedisState(testRedisHost, testRedisPort, testRedisKey).(*redisState)
+	state := NewRedisState(testRedisOptions, testRedisKey).(*redisState)
 	if state.client == nil {
 		t.Fail()
 	}
@@ -33,7 +42,7 @@ func TestNewStateFromRedis(t *testing.T) {
 	redisClient := redis.NewClient(&redis.Options{Addr: fmt.Sprintf("%s:%d", testRedisHost, testRedisPort)})
 	redisClient.Set(testRedisKey, []byte(testData), 0)
 
-	stateIface, err := NewStateFromRedis(testRedisHost, testRedisPort, testRedisKey)
+	stateIface, err := NewStateFromRedis(testRedisOptions, testRedisKey)
 	if err != nil {
 		t.FailNow()
 	}
@@ -50,9 +59,27 @@ func TestNewStateFromRedis(t *testing.T) {
 	redisClient.Del(testRedisKey)
 }
 
+func TestRedisStateClose(t *testing.T) {
+	redisClient := redis.NewClient(&redis.Options{Addr: testRedisOptions.Addr})
+	redisClient.Set(testRedisKey, []byte(`{"AccessToken": "abc"}`), 0)
+	defer deleteTestRedisState()
+
+	state, err := NewStateFromRedis(testRedisOptions, testRedisKey)
+	if err != nil {
+		t.FailNow()
+	}
+	err = state.(*redisState).Close()
+	if err != nil {
+		t.Error(err)
+	}
+	if state.(*redisState).client.Get(testRedisKey).Err() == nil {
+		t.Fail()
+	}
+}
+
 func TestNewStateFromRedisMissingKey(t *testing.T) {
-	state, err := NewStateFromRedis(testRedisHost, testRedisPort, testRedisKey)
-	if err == nil {
+	state, err := NewStateFromRedis(testRedisOptions, testRedisKey)
+	if err != ErrNoState {
 		t.Fail()
 	}
 
@@ -66,7 +93,7 @@ func TestNewStateFromRedisCorruptKey(t *testing.T) {
 	redisClient := redis.NewClient(&redis.Options{Addr: fmt.Sprintf("%s:%d", testRedisHost, testRedisPort)})
 	redisClient.Set(testRedisKey, []byte(testData), 0)
 
-	state, err := NewStateFromRedis(testRedisHost, testRedisPort, testRedisKey)
+	state, err := NewStateFromRedis(testRedisOptions, testRedisKey)
 	if err == nil {
 		t.Fail()
 	}
@@ -79,7 +106,7 @@ func TestNewStateFromRedisCorruptKey(t *testing.T) {
 }
 
 func TestRedisStateFirstUpdate(t *testing.T) {
-	state := NewRedisState(testRedisHost, testRedisPort, testRedisKey)
+	state := NewRedisState(testRedisOptions, testRedisKey)
 	now := time.Now()
 	state.Update("xxx", "test", now)
 	updateTime := state.GetLastUpdateTime("xxx", "test")
@@ -89,7 +116,7 @@ func TestRedisStateFirstUpdate(t *testing.T) {
 }
 
 func TestRedisStateSecondUpdate(t *testing.T) {
-	state := NewRedisState(testRedisHost, testRedisPort, testRedisKey)
+	state := NewRedisState(testRedisOptions, testRedisKey)
 	now := time.Now()
 	state.Update("xxx", "test", now)
 
@@ -103,7 +130,7 @@ func TestRedisStateSecondUpdate(t *testing.T) {
 }
 
 func TestRedisStateGetLastUptimeTimeNil(t *testing.T) {
-	state := NewRedisState(testRedisHost, testRedisPort, testRedisKey)
+	state := NewRedisState(testRedisOptions, testRedisKey)
 	lastUpdate := state.GetLastUpdateTime("xxx", "test")
 	if !lastUpdate.Equal(time.Time{}) {
 		t.Fail()
@@ -111,7 +138,7 @@ func TestRedisStateGetLastUptimeTimeNil(t *testing.T) {
 }
 
 func TestRedisStateAccessToken(t *testing.T) {
-	state := NewRedisState(testRedisHost, testRedisPort, testRedisKey)
+	state := NewRedisState(testRedisOptions, testRedisKey)
 	state.SetAccessToken("xxx")
 	if state.GetAccessToken() != "xxx" {
 		t.Fail()
@@ -119,11 +146,12 @@ func TestRedisStateAccessToken(t *testing.T) {
 }
 
 func TestRedisStateSave(t *testing.T) {
-	state := NewRedisState(testRedisHost, testRedisPort, testRedisKey)
+	defer deleteTestRedisState()
+	state := NewRedisState(testRedisOptions, testRedisKey)
 	state.SetAccessToken("xxx")
 	state.Save()
 
-	stateIface, err := NewStateFromRedis(testRedisHost, testRedisPort, testRedisKey)
+	stateIface, err := NewStateFromRedis(testRedisOptions, testRedisKey)
 	if err != nil {
 		t.FailNow()
 	}
@@ -134,3 +162,135 @@ func TestRedisStateSave(t *testing.T) {
 
 	os.Remove("test.json")
 }
+
+func TestRedisStateSinkUpdate(t *testing.T) {
+	state := NewRedisState(testRedisOptions, testRedisKey)
+	now := time.Now()
+	state.UpdateSink("sink1", "xxx", "test", now)
+	state.UpdateSink("sink1", "xxx", "test", now.Add(-5*time.Minute))
+
+	if !state.GetSinkLastUpdateTime("sink1", "xxx", "test").Equal(now) {
+		t.Fail()
+	}
+
+	if !state.GetSinkLastUpdateTime("sink2", "xxx", "test").Equal(time.Time{}) {
+		t.Fail()
+	}
+}
+
+func TestRedisStateSaveTimestamps(t *testing.T) {
+	defer deleteTestRedisState()
+	state := NewRedisState(testRedisOptions, testRedisKey)
+	now := time.Now()
+	state.Update("xxx", "test", now)
+	state.UpdateSink("sink1", "xxx", "test", now)
+	err := state.Save()
+	if err != nil {
+		t.FailNow()
+	}
+
+	redisClient := redis.NewClient(&redis.Options{Addr: testRedisOptions.Addr})
+	data, _ := redisClient.Get(testRedisKey).Bytes()
+	if strings.Contains(string(data), "LastUpdated") {
+		t.Error(string(data))
+	}
+	fields, _ := redisClient.HGetAll(testRedisKey + ":sink_last_updated").Result()
+	if fields["sink1/xxx/test"] != now.UTC().Format(redisTimeFormat) {
+		t.Error(fields)
+	}
+
+	loaded, err := NewStateFromRedis(testRedisOptions, testRedisKey)
+	if err != nil {
+		t.FailNow()
+	}
+	if !loaded.GetLastUpdateTime("xxx", "test").Equal(now) || !loaded.GetSinkLastUpdateTime("sink1", "xxx", "test").Equal(now) {
+		t.Fail()
+	}
+}
+
+func TestRedisStateSaveForwardOnly(t *testing.T) {
+	defer deleteTestRedisState()
+	now := time.Now()
+	NewRedisState(testRedisOptions, testRedisKey).Save()
+
+	// Two oolongs sharing the state, where the second is behind
+	first, _ := NewStateFromRedis(testRedisOptions, testRedisKey)
+	second, _ := NewStateFromRedis(testRedisOptions, testRedisKey)
+	first.UpdateSink("sink1", "xxx", "test", now)
+	first.UpdateSink("sink1", "yyy", "test", now)
+	first.Save()
+	second.UpdateSink("sink1", "xxx", "test", now.Add(-time.Hour))
+	second.UpdateSink("sink1", "zzz", "test", now)
+	second.Save()
+
+	loaded, err := NewStateFromRedis(testRedisOptions, testRedisKey)
+	if err != nil {
+		t.FailNow()
+	}
+	for _, uuid := range []string{"xxx", "yyy", "zzz"} {
+		if !loaded.GetSinkLastUpdateTime("sink1", uuid, "test").Equal(now) {
+			t.Error(uuid)
+		}
+		if !loaded.GetLastUpdateTime(uuid, "test").Equal(now) {
+			t.Error(uuid)
+		}
+	}
+}
+
+func TestNewStateFromRedisLegacy(t *testing.T) {
+	defer deleteTestRedisState()
+	testData := `{"AccessToken": "abc", "LastUpdated": {"xxx": {"test": "2019-01-02T03:04:05Z"}}}`
+	redisClient := redis.NewClient(&redis.Options{Addr: testRedisOptions.Addr})
+	redisClient.Set(testRedisKey, []byte(testData), 0)
+
+	state, err := NewStateFromRedis(testRedisOptions, testRedisKey)
+	if err != nil {
+		t.FailNow()
+	}
+	timestamp := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	if state.GetAccessToken() != "abc" || !state.GetLastUpdateTime("xxx", "test").Equal(timestamp) {
+		t.Fail()
+	}
+
+	// Saving moves the timestamps to the hash
+	state.Save()
+	data, _ := redisClient.Get(testRedisKey).Bytes()
+	if strings.Contains(string(data), "LastUpdated") || !strings.Contains(string(data), "abc") {
+		t.Error(string(data))
+	}
+	fields, _ := redisClient.HGetAll(testRedisKey + ":last_updated").Result()
+	if fields["xxx/test"] != timestamp.Format(redisTimeFormat) {
+		t.Error(fields)
+	}
+}
+
+func TestRedisAuth(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		buf := make([]byte, 1024)
+		n, _ := server.Read(buf)
+		if string(buf[:n]) == "*3\r\n$4\r\nAUTH\r\n$6\r\noolong\r\n$6\r\nsecret\r\n" {
+			server.Write([]byte("+OK\r\n"))
+		} else {
+			server.Write([]byte("-WRONGPASS invalid username-password pair\r\n"))
+		}
+	}()
+	err := redisAuth(client, "oolong", "secret")
+	if err != nil {
+		t.Error(err)
+	}
+
+	client, server = net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		server.Read(make([]byte, 1024))
+		server.Write([]byte("-WRONGPASS invalid username-password pair\r\n"))
+	}()
+	err = redisAuth(client, "oolong", "wrong")
+	if err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Fail()
+	}
+}
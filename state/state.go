@@ -2,10 +2,24 @@ package state
 
 import (
 	"encoding/json"
+	"errors"
 	"io/ioutil"
+	"os"
 	"time"
+
+	"github.com/sirupsen/logrus"
 )
 
+// ErrNoState is returned when there isn't any saved state to load.
+var ErrNoState = errors.New("No saved state, run oolong init")
+
+var logger logrus.FieldLogger = logrus.StandardLogger()
+
+// SetLogger sets where the state backends log to.
+func SetLogger(l logrus.FieldLogger) {
+	logger = l
+}
+
 type State interface {
 	GetAccessToken() string
 	SetAccessToken(string)
@@ -13,25 +27,36 @@ type State interface {
 	Save() error
 	Update(string, string, time.Time)
 	GetLastUpdateTime(string, string) time.Time
+
+	// Per-sink versions of Update and GetLastUpdateTime.  Sink timestamps only
+	// ever move forward.
+	UpdateSink(string, string, string, time.Time)
+	GetSinkLastUpdateTime(string, string, string) time.Time
 }
 
 type fileState struct {
-	AccessToken string
-	Filename    string `json:"-"`
+	secrets
+	Filename string `json:"-"`
 	// uuid -> reading_type -> timestamp
 	LastUpdated map[string]map[string]time.Time
+	// sink -> uuid -> reading_type -> timestamp
+	SinkLastUpdated map[string]map[string]map[string]time.Time
 }
 
 func NewFileState(filename string) State {
 	return &fileState{
-		Filename:    filename,
-		LastUpdated: make(map[string]map[string]time.Time),
+		Filename:        filename,
+		LastUpdated:     make(map[string]map[string]time.Time),
+		SinkLastUpdated: make(map[string]map[string]map[string]time.Time),
 	}
 }
 
 // Tries to read state from file
 func NewStateFromFile(filename string) (State, error) {
 	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, ErrNoState
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -40,15 +65,36 @@ func NewStateFromFile(filename string) (State, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = state.open()
+	if err != nil {
+		return nil, err
+	}
 	state.Filename = filename
+	if state.LastUpdated == nil {
+		state.LastUpdated = make(map[string]map[string]time.Time)
+	}
+	if state.SinkLastUpdated == nil {
+		state.SinkLastUpdated = make(map[string]map[string]map[string]time.Time)
+	}
 
+	logger.WithFields(logrus.Fields{"backend": "file", "filename": filename, "tags": len(state.LastUpdated)}).Debug("Loaded state")
 	return state, nil
 }
 
 // Overwrites the state file with the current state
 func (s *fileState) Save() error {
-	data, _ := json.Marshal(s)
-	return ioutil.WriteFile(s.Filename, data, 0600)
+	saved := *s
+	var err error
+	saved.secrets, err = s.secrets.sealed()
+	if err != nil {
+		return err
+	}
+	data, _ := json.Marshal(&saved)
+	err = ioutil.WriteFile(s.Filename, data, 0600)
+	if err == nil {
+		logger.WithFields(logrus.Fields{"backend": "file", "filename": s.Filename}).Debug("Saved state")
+	}
+	return err
 }
 
 // Helper func to make interacting with the LastUpdated map easierr
@@ -66,10 +112,38 @@ func (s *fileState) GetLastUpdateTime(uuid string, queryType string) time.Time {
 	return s.LastUpdated[uuid][queryType]
 }
 
-func (s *fileState) GetAccessToken() string {
-	return s.AccessToken
+func (s *fileState) UpdateSink(sink, uuid, readingType string, timestamp time.Time) {
+	updateSink(s.SinkLastUpdated, sink, uuid, readingType, timestamp)
+	if timestamp.After(s.GetLastUpdateTime(uuid, readingType)) {
+		s.Update(uuid, readingType, timestamp)
+	}
 }
 
-func (s *fileState) SetAccessToken(token string) {
-	s.AccessToken = token
+func (s *fileState) GetSinkLastUpdateTime(sink, uuid, readingType string) time.Time {
+	// State saved before sinks were tracked separately only has the overall
+	// timestamps, which every sink was written up to.
+	if len(s.SinkLastUpdated) == 0 {
+		return s.GetLastUpdateTime(uuid, readingType)
+	}
+	return getSinkLastUpdateTime(s.SinkLastUpdated, sink, uuid, readingType)
+}
+
+// Shared by the backends to update the sink -> uuid -> reading_type map
+func updateSink(lastUpdated map[string]map[string]map[string]time.Time, sink, uuid, readingType string, timestamp time.Time) {
+	if lastUpdated[sink] == nil {
+		lastUpdated[sink] = make(map[string]map[string]time.Time)
+	}
+	if lastUpdated[sink][uuid] == nil {
+		lastUpdated[sink][uuid] = make(map[string]time.Time)
+	}
+	if timestamp.After(lastUpdated[sink][uuid][readingType]) {
+		lastUpdated[sink][uuid][readingType] = timestamp
+	}
+}
+
+func getSinkLastUpdateTime(lastUpdated map[string]map[string]map[string]time.Time, sink, uuid, readingType string) time.Time {
+	if lastUpdated[sink] == nil || lastUpdated[sink][uuid] == nil {
+		return time.Time{}
+	}
+	return lastUpdated[sink][uuid][readingType]
 }
@@ -41,7 +41,7 @@ func TestNewStateFromFile(t *testing.T) {
 
 func TestNewStateFromFileMissingFile(t *testing.T) {
 	state, err := NewStateFromFile("test.json")
-	if err == nil {
+	if err != ErrNoState {
 		t.Fail()
 	}
 
@@ -122,3 +122,51 @@ func TestFileStateSave(t *testing.T) {
 
 	os.Remove("test.json")
 }
+
+func TestFileStateSinkUpdate(t *testing.T) {
+	state := NewFileState("test.json")
+	now := time.Now()
+	state.UpdateSink("sink1", "xxx", "test", now)
+
+	if !state.GetSinkLastUpdateTime("sink1", "xxx", "test").Equal(now) {
+		t.Fail()
+	}
+
+	// Other sinks are tracked separately
+	if !state.GetSinkLastUpdateTime("sink2", "xxx", "test").Equal(time.Time{}) {
+		t.Fail()
+	}
+
+	// The overall timestamp follows the newest sink
+	if !state.GetLastUpdateTime("xxx", "test").Equal(now) {
+		t.Fail()
+	}
+}
+
+func TestFileStateSinkUpdateBackwards(t *testing.T) {
+	state := NewFileState("test.json")
+	now := time.Now()
+	state.UpdateSink("sink1", "xxx", "test", now)
+	state.UpdateSink("sink1", "xxx", "test", now.Add(-5*time.Minute))
+
+	if !state.GetSinkLastUpdateTime("sink1", "xxx", "test").Equal(now) {
+		t.Fail()
+	}
+}
+
+func TestFileStateSinkLegacy(t *testing.T) {
+	testData := `{"AccessToken": "abc", "LastUpdated": {"xxx": {"test": "2006-01-02T15:04:05Z"}}}`
+	ioutil.WriteFile("test.json", []byte(testData), 0600)
+	defer os.Remove("test.json")
+
+	state, err := NewStateFromFile("test.json")
+	if err != nil {
+		t.FailNow()
+	}
+
+	// Without any sink timestamps, every sink is assumed to be up to date
+	expected := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+	if !state.GetSinkLastUpdateTime("sink1", "xxx", "test").Equal(expected) {
+		t.Fail()
+	}
+}
@@ -0,0 +1,63 @@
+package state
+
+import (
+	"sync"
+	"time"
+)
+
+type syncState struct {
+	state State
+	lock  sync.Mutex
+}
+
+// Synchronized wraps a state so it can be used from several goroutines at
+// once, e.g. by the poller while the sinks move their checkpoints forward.
+// Wrapping a state which is already synchronized returns it unchanged.
+func Synchronized(state State) State {
+	if _, ok := state.(*syncState); ok {
+		return state
+	}
+	return &syncState{state: state}
+}
+
+func (s *syncState) GetAccessToken() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.state.GetAccessToken()
+}
+
+func (s *syncState) SetAccessToken(token string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.state.SetAccessToken(token)
+}
+
+func (s *syncState) Save() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.state.Save()
+}
+
+func (s *syncState) Update(uuid, readingType string, timestamp time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.state.Update(uuid, readingType, timestamp)
+}
+
+func (s *syncState) GetLastUpdateTime(uuid, readingType string) time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.state.GetLastUpdateTime(uuid, readingType)
+}
+
+func (s *syncState) UpdateSink(sink, uuid, readingType string, timestamp time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.state.UpdateSink(sink, uuid, readingType, timestamp)
+}
+
+func (s *syncState) GetSinkLastUpdateTime(sink, uuid, readingType string) time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.state.GetSinkLastUpdateTime(sink, uuid, readingType)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/arcticfoxnv/oolong/logging"
+	"github.com/arcticfoxnv/oolong/state"
+	"github.com/arcticfoxnv/oolong/wirelesstag"
+	"github.com/sirupsen/logrus"
+)
+
+// Polling strategies.  The GetMultiTagStatsRaw API method only returns one
+// stat, but for all tags.  The GetStatsRaw API method returns temperature and
+// humidity together, but only for a single tag.
+const (
+	// One GetMultiTagStatsRaw call per stat
+	StrategyMulti = "multi"
+	// One GetStatsRaw call per tag for temperature and humidity, plus
+	// GetMultiTagStatsRaw for any other stats
+	StrategyPerTag = "per-tag"
+	// Whichever of the two makes fewer calls for the tags and stats
+	StrategyAuto = "auto"
+)
+
+// QueryPlan says which API method each stat is fetched with.
+type QueryPlan struct {
+	// The strategy the plan follows, multi or per-tag
+	Strategy string
+	// Stats fetched with one GetMultiTagStatsRaw call each
+	Multi []string
+	// Stats fetched together with one GetStatsRaw call per tag
+	PerTag []string
+}
+
+// Calls returns the number of API calls the plan makes each cycle.
+func (p QueryPlan) Calls(tagCount int) int {
+	calls := len(p.Multi)
+	if len(p.PerTag) > 0 {
+		calls += tagCount
+	}
+	return calls
+}
+
+// Only returns the plan for just the given stats, keeping the API method each
+// is fetched with.
+func (p QueryPlan) Only(stats []string) QueryPlan {
+	plan := QueryPlan{Strategy: p.Strategy}
+	for _, queryType := range p.Multi {
+		if contains(stats, queryType) {
+			plan.Multi = append(plan.Multi, queryType)
+		}
+	}
+	for _, queryType := range p.PerTag {
+		if contains(stats, queryType) {
+			plan.PerTag = append(plan.PerTag, queryType)
+		}
+	}
+	return plan
+}
+
+func isRawStatType(queryType string) bool {
+	for _, t := range wirelesstag.RawStatTypes {
+		if t == queryType {
+			return true
+		}
+	}
+	return false
+}
+
+// PlanQueries works out how to fetch the stats with the given strategy.  Multi
+// is used if the strategy isn't set.
+func PlanQueries(strategy string, queryStats []string, tagCount int) (QueryPlan, error) {
+	multiPlan := QueryPlan{Strategy: StrategyMulti, Multi: queryStats}
+	perTagPlan := QueryPlan{Strategy: StrategyPerTag}
+	for _, queryType := range queryStats {
+		if isRawStatType(queryType) {
+			perTagPlan.PerTag = append(perTagPlan.PerTag, queryType)
+		} else {
+			perTagPlan.Multi = append(perTagPlan.Multi, queryType)
+		}
+	}
+
+	switch strategy {
+	case "", StrategyMulti:
+		return multiPlan, nil
+	case StrategyPerTag:
+		return perTagPlan, nil
+	case StrategyAuto:
+		// Per tag only wins with fewer tags than combined stats, so prefer
+		// multi when it's a tie.
+		if perTagPlan.Calls(tagCount) < multiPlan.Calls(tagCount) {
+			return perTagPlan, nil
+		}
+		return multiPlan, nil
+	}
+	return QueryPlan{}, fmt.Errorf("Unknown polling strategy %s", strategy)
+}
+
+// FetchFailure is a failed API call, along with the tags and stats it was
+// fetching.
+type FetchFailure struct {
+	Tags  []wirelesstag.Tag
+	Stats []string
+	Err   error
+}
+
+// FetchedStat is one tag's readings of a stat, as fetched by FetchStats.
+type FetchedStat struct {
+	Stat  string
+	Value wirelesstag.Stat
+}
+
+// A single API call for FetchStats.
+type fetchCall struct {
+	tags  []wirelesstag.Tag
+	stats []string
+	fetch func() (map[string][]wirelesstag.Stat, error)
+	log   logrus.FieldLogger
+}
+
+// FetchStats fetches the stats in the plan for each group of tags, from each
+// stat's start time until end, making up to config.Concurrency API calls at
+// once.  Each stat is sent on out as soon as the call that fetched it
+// returns, so it can be stored while the other calls are still being made.
+// Returns the number of API calls made and the calls which failed.  Every tag
+// covered by a successful call has a stat, even if it has no readings, so
+// tags without a stat either failed or weren't fetched because the cycle
+// ended early.
+func FetchStats(ctx context.Context, config *Config, state state.State, tagClient wirelesstag.Client, plan QueryPlan, groups []TagGroup, starts map[string]time.Time, end time.Time, out chan<- FetchedStat) (int, []FetchFailure) {
+	calls := planCalls(ctx, tagClient, plan, groups, starts, end)
+
+	var (
+		lock     sync.Mutex
+		failures []FetchFailure
+		stopped  bool
+		reloaded bool
+	)
+	// Records a failed call and decides whether to carry on.  Calls already
+	// being made when the cycle ends are left to finish.
+	carryOn := func(failure FetchFailure) {
+		lock.Lock()
+		defer lock.Unlock()
+		failures = append(failures, failure)
+		action := FetchErrorAction(failure.Err)
+		if action == reauthenticate && !reloaded {
+			reloaded = true
+			ReloadAccessToken(ctx, config, state, tagClient)
+		}
+		if action != skipStat {
+			stopped = true
+		}
+	}
+	isStopped := func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return stopped
+	}
+
+	workers := config.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	queue := make(chan fetchCall)
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for call := range queue {
+				stats, err := call.fetch()
+				if err != nil {
+					call.log.WithError(err).Warn("Failed to load raw stats")
+					carryOn(FetchFailure{Tags: call.tags, Stats: call.stats, Err: err})
+					continue
+				}
+				for _, queryType := range call.stats {
+					for _, stat := range stats[queryType] {
+						out <- FetchedStat{Stat: queryType, Value: stat}
+					}
+				}
+			}
+		}()
+	}
+
+	made := 0
+	for _, call := range calls {
+		if isStopped() {
+			break
+		}
+		made++
+		queue <- call
+	}
+	close(queue)
+	wg.Wait()
+	return made, failures
+}
+
+// planCalls lists the API calls which fetch the stats in the plan.
+func planCalls(ctx context.Context, tagClient wirelesstag.Client, plan QueryPlan, groups []TagGroup, starts map[string]time.Time, end time.Time) []fetchCall {
+	log := logging.FromContext(ctx)
+	var calls []fetchCall
+
+	for _, group := range groups {
+		group := group
+		if len(plan.PerTag) > 0 {
+			// One call covers all of the stats, so start from the earliest
+			start := end
+			for _, queryType := range plan.PerTag {
+				if starts[queryType].Before(start) {
+					start = starts[queryType]
+				}
+			}
+
+			for _, tag := range group.Tags {
+				tag := tag
+				calls = append(calls, fetchCall{
+					tags:  []wirelesstag.Tag{tag},
+					stats: plan.PerTag,
+					log:   log.WithFields(logrus.Fields{"tag": tag.UUID, "manager": tag.ManagerMac}),
+					fetch: func() (map[string][]wirelesstag.Stat, error) {
+						stats, err := GetTagStats(ctx, tagClient, tag.SlaveId, start, end, group.Location)
+						if err != nil {
+							return nil, err
+						}
+						fetched := make(map[string][]wirelesstag.Stat)
+						for _, queryType := range plan.PerTag {
+							stat := stats[queryType]
+							stat.SlaveId = tag.SlaveId
+							fetched[queryType] = []wirelesstag.Stat{stat}
+						}
+						return fetched, nil
+					},
+				})
+			}
+		}
+
+		// Extract ids for the multi tag calls
+		var tagIds []int
+		for _, t := range group.Tags {
+			tagIds = append(tagIds, t.SlaveId)
+		}
+
+		for _, queryType := range plan.Multi {
+			queryType := queryType
+			calls = append(calls, fetchCall{
+				tags:  group.Tags,
+				stats: []string{queryType},
+				log:   log.WithFields(logrus.Fields{"stat": queryType, "location": group.Location.String()}),
+				fetch: func() (map[string][]wirelesstag.Stat, error) {
+					stats, err := GetStats(ctx, tagClient, queryType, tagIds, starts[queryType], end, group.Location)
+					if err != nil {
+						return nil, err
+					}
+					return map[string][]wirelesstag.Stat{queryType: withEmptyStats(stats, group.Tags)}, nil
+				},
+			})
+		}
+	}
+	return calls
+}
+
+// withEmptyStats adds an empty stat for any of the tags without one.
+func withEmptyStats(stats []wirelesstag.Stat, tags []wirelesstag.Tag) []wirelesstag.Stat {
+	found := make(map[int]bool)
+	for _, stat := range stats {
+		found[stat.SlaveId] = true
+	}
+	for _, tag := range tags {
+		if !found[tag.SlaveId] {
+			stats = append(stats, wirelesstag.Stat{SlaveId: tag.SlaveId})
+		}
+	}
+	return stats
+}
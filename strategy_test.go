@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arcticfoxnv/oolong/state"
+	"github.com/arcticfoxnv/oolong/wirelesstag"
+)
+
+var strategyTestStats = []string{"temperature", "cap", "batteryVolt"}
+
+func TestPlanQueriesMulti(t *testing.T) {
+	for _, strategy := range []string{"", StrategyMulti} {
+		plan, err := PlanQueries(strategy, strategyTestStats, 1)
+		if err != nil {
+			t.Fail()
+		}
+		if plan.Strategy != StrategyMulti || len(plan.Multi) != 3 || len(plan.PerTag) != 0 {
+			t.Fail()
+		}
+		if plan.Calls(1) != 3 {
+			t.Fail()
+		}
+	}
+}
+
+func TestPlanQueriesPerTag(t *testing.T) {
+	plan, err := PlanQueries(StrategyPerTag, strategyTestStats, 5)
+	if err != nil {
+		t.Fail()
+	}
+	if plan.Strategy != StrategyPerTag || len(plan.PerTag) != 2 || len(plan.Multi) != 1 {
+		t.Fail()
+	}
+	if plan.Calls(5) != 6 {
+		t.Fail()
+	}
+}
+
+func TestPlanQueriesAuto(t *testing.T) {
+	// A single tag saves a call by fetching temperature and humidity together
+	plan, _ := PlanQueries(StrategyAuto, strategyTestStats, 1)
+	if plan.Strategy != StrategyPerTag {
+		t.Fail()
+	}
+
+	// Two tags is a tie, so stick with multi
+	plan, _ = PlanQueries(StrategyAuto, strategyTestStats, 2)
+	if plan.Strategy != StrategyMulti {
+		t.Fail()
+	}
+
+	// Nothing to gain without both temperature and humidity
+	plan, _ = PlanQueries(StrategyAuto, []string{"temperature", "batteryVolt"}, 1)
+	if plan.Strategy != StrategyMulti {
+		t.Fail()
+	}
+}
+
+func TestPlanQueriesUnknown(t *testing.T) {
+	_, err := PlanQueries("sometimes", strategyTestStats, 1)
+	if err == nil {
+		t.Fail()
+	}
+}
+
+// fetchAllStats runs FetchStats, collecting the stats by stat.
+func fetchAllStats(config *Config, client wirelesstag.Client, plan QueryPlan, groups []TagGroup, starts map[string]time.Time, end time.Time) (map[string][]wirelesstag.Stat, int, []FetchFailure) {
+	out := make(chan FetchedStat)
+	fetched := make(map[string][]wirelesstag.Stat)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for stat := range out {
+			fetched[stat.Stat] = append(fetched[stat.Stat], stat.Value)
+		}
+	}()
+	calls, failed := FetchStats(context.Background(), config, state.NewFileState("state.json"), client, plan, groups, starts, end, out)
+	close(out)
+	<-done
+	return fetched, calls, failed
+}
+
+func TestFetchStatsPerTag(t *testing.T) {
+	client := &DummyTagClient{
+		RawStats: []wirelesstag.RawStat{
+			{
+				Date:             "1/2/2006",
+				Temperatures:     []float32{20, 21},
+				Caps:             []float32{40, 41},
+				TimeOfDaySeconds: []int{0, 60},
+			},
+		},
+	}
+	tags := []wirelesstag.Tag{{SlaveId: 0, UUID: "xxx"}, {SlaveId: 1, UUID: "yyy"}}
+	groups := []TagGroup{{Location: time.Local, Tags: tags}}
+	plan, _ := PlanQueries(StrategyPerTag, strategyTestStats, len(tags))
+	now := time.Now()
+	starts := map[string]time.Time{"temperature": now, "cap": now, "batteryVolt": now}
+
+	fetched, calls, failed := fetchAllStats(&Config{}, client, plan, groups, starts, now)
+	if calls != 3 || len(failed) != 0 || client.Calls != 3 {
+		t.Fail()
+	}
+	if len(fetched["temperature"]) != 2 || len(fetched["cap"]) != 2 {
+		t.FailNow()
+	}
+	if fetched["cap"][1].SlaveId != 1 || fetched["cap"][1].Readings[1].Value != 41 {
+		t.Fail()
+	}
+	if _, ok := fetched["batteryVolt"]; !ok {
+		t.Fail()
+	}
+}
+
+// Counts how many calls are being made at once
+type concurrentTagClient struct {
+	DummyTagClient
+	lock     sync.Mutex
+	inFlight int
+	most     int
+}
+
+func (c *concurrentTagClient) GetMultiTagStatsRawContext(ctx context.Context, ids []int, queryType string, start, end time.Time) ([]wirelesstag.RawMultiStat, error) {
+	c.lock.Lock()
+	c.inFlight++
+	if c.inFlight > c.most {
+		c.most = c.inFlight
+	}
+	c.lock.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	c.lock.Lock()
+	c.inFlight--
+	c.lock.Unlock()
+	return c.DummyTagClient.GetMultiTagStatsRawContext(ctx, ids, queryType, start, end)
+}
+
+func TestFetchStatsConcurrency(t *testing.T) {
+	client := &concurrentTagClient{DummyTagClient: DummyTagClient{Stats: pollerTestStats}}
+	tags := []wirelesstag.Tag{{SlaveId: 0, UUID: "xxx"}, {SlaveId: 1, UUID: "yyy"}}
+	groups := []TagGroup{{Location: time.UTC, Tags: tags}, {Location: time.Local, Tags: tags}}
+	stats := []string{"temperature", "cap", "batteryVolt", "light"}
+	plan, _ := PlanQueries(StrategyMulti, stats, len(tags))
+	now := time.Now()
+	starts := map[string]time.Time{"temperature": now, "cap": now, "batteryVolt": now, "light": now}
+
+	// Two groups of four stats, two calls at a time
+	fetched, calls, failed := fetchAllStats(&Config{Concurrency: 2}, client, plan, groups, starts, now)
+	if calls != 8 || len(failed) != 0 || client.Calls != 8 {
+		t.Fail()
+	}
+	if client.most != 2 {
+		t.Error(client.most)
+	}
+	for _, stat := range stats {
+		if len(fetched[stat]) != 4 {
+			t.Error(stat)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package tsdb
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/arcticfoxnv/oolong/wirelesstag"
+)
+
+// Aggregates which can be stored for each window
+const (
+	AggregateMin  = "min"
+	AggregateMax  = "max"
+	AggregateMean = "mean"
+	AggregateLast = "last"
+)
+
+// DefaultAggregates are stored when none are chosen
+var DefaultAggregates = []string{AggregateMin, AggregateMax, AggregateMean, AggregateLast}
+
+// WindowedTSDB is implemented by databases which store readings a window at a
+// time, rather than as they arrive.
+type WindowedTSDB interface {
+	TSDB
+	// Complete returns the leading readings which make up whole windows.
+	// The rest should be held back until a later reading shows their window
+	// has ended.
+	Complete([]wirelesstag.Reading) []wirelesstag.Reading
+}
+
+// Aggregator stores aggregates of each window of readings in db, instead of
+// every reading.  Each aggregate is stored as its own stat, named
+// <stat>.<aggregate>, timestamped with the start of the window.  Windows are
+// aligned to UTC.
+type Aggregator struct {
+	db         TSDB
+	window     time.Duration
+	aggregates []string
+}
+
+// NewAggregator wraps db, storing the given aggregates for each window.
+// DefaultAggregates are used if none are given.
+func NewAggregator(db TSDB, window time.Duration, aggregates []string) (*Aggregator, error) {
+	if window <= 0 {
+		return nil, fmt.Errorf("Invalid aggregation window %s", window)
+	}
+	if len(aggregates) == 0 {
+		aggregates = DefaultAggregates
+	}
+	err := CheckAggregates(aggregates)
+	if err != nil {
+		return nil, err
+	}
+	return &Aggregator{db: db, window: window, aggregates: aggregates}, nil
+}
+
+// CheckAggregates returns an error for the first unknown aggregate.
+func CheckAggregates(aggregates []string) error {
+	for _, aggregate := range aggregates {
+		switch aggregate {
+		case AggregateMin, AggregateMax, AggregateMean, AggregateLast:
+		default:
+			return fmt.Errorf("Unknown aggregate %s", aggregate)
+		}
+	}
+	return nil
+}
+
+// Complete returns the readings before the window the last reading falls in.
+// Readings must be in time order.
+func (a *Aggregator) Complete(readings []wirelesstag.Reading) []wirelesstag.Reading {
+	if len(readings) == 0 {
+		return nil
+	}
+	lastWindow := readings[len(readings)-1].Timestamp.Truncate(a.window)
+	for i, reading := range readings {
+		if !reading.Timestamp.Before(lastWindow) {
+			return readings[:i]
+		}
+	}
+	return readings
+}
+
+func (a *Aggregator) PutValue(tag *wirelesstag.Tag, valueType string, reading wirelesstag.Reading) error {
+	return a.PutValues(tag, valueType, []wirelesstag.Reading{reading})
+}
+
+// PutValues stores the aggregates of every window the readings fall in.  Use
+// Complete first to avoid storing aggregates of partial windows.
+func (a *Aggregator) PutValues(tag *wirelesstag.Tag, valueType string, readings []wirelesstag.Reading) error {
+	results := make(map[string][]wirelesstag.Reading)
+
+	for start := 0; start < len(readings); {
+		window := readings[start].Timestamp.Truncate(a.window)
+		end := start
+		for end < len(readings) && readings[end].Timestamp.Truncate(a.window).Equal(window) {
+			end++
+		}
+
+		for _, aggregate := range a.aggregates {
+			results[aggregate] = append(results[aggregate], wirelesstag.Reading{
+				Timestamp: window,
+				Value:     aggregateValues(aggregate, readings[start:end]),
+			})
+		}
+		start = end
+	}
+
+	for _, aggregate := range a.aggregates {
+		err := PutValues(a.db, tag, valueType+"."+aggregate, results[aggregate])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PutTagManagers passes the metadata through, if db stores it.
+func (a *Aggregator) PutTagManagers(managers []wirelesstag.TagManager, tags map[string][]wirelesstag.Tag) error {
+	if metadataDB, ok := a.db.(MetadataTSDB); ok {
+		return metadataDB.PutTagManagers(managers, tags)
+	}
+	return nil
+}
+
+// Close closes db, if it needs closing.
+func (a *Aggregator) Close() error {
+	if closer, ok := a.db.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func aggregateValues(aggregate string, readings []wirelesstag.Reading) float32 {
+	result := readings[0].Value
+	var sum float64
+	for _, reading := range readings {
+		switch aggregate {
+		case AggregateMin:
+			if reading.Value < result {
+				result = reading.Value
+			}
+		case AggregateMax:
+			if reading.Value > result {
+				result = reading.Value
+			}
+		case AggregateLast:
+			result = reading.Value
+		}
+		sum += float64(reading.Value)
+	}
+	if aggregate == AggregateMean {
+		return float32(sum / float64(len(readings)))
+	}
+	return result
+}
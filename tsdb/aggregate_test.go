@@ -0,0 +1,121 @@
+package tsdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/arcticfoxnv/oolong/wirelesstag"
+)
+
+// Stores readings by stat
+type statTSDB struct {
+	Values map[string][]wirelesstag.Reading
+}
+
+func (d *statTSDB) PutValue(tag *wirelesstag.Tag, valueType string, reading wirelesstag.Reading) error {
+	if d.Values == nil {
+		d.Values = make(map[string][]wirelesstag.Reading)
+	}
+	d.Values[valueType] = append(d.Values[valueType], reading)
+	return nil
+}
+
+var aggregateTestStart = time.Date(2006, 1, 2, 15, 0, 0, 0, time.UTC)
+
+func TestNewAggregator(t *testing.T) {
+	a, err := NewAggregator(&statTSDB{}, 5*time.Minute, nil)
+	if err != nil || len(a.aggregates) != 4 {
+		t.Fail()
+	}
+	_, err = NewAggregator(&statTSDB{}, 5*time.Minute, []string{"median"})
+	if err == nil {
+		t.Fail()
+	}
+	_, err = NewAggregator(&statTSDB{}, 0, nil)
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func TestAggregatorPutValues(t *testing.T) {
+	db := &statTSDB{}
+	a, _ := NewAggregator(db, 5*time.Minute, nil)
+
+	// Two windows, 15:00-15:05 and 15:05-15:10
+	readings := testReadingsAt(aggregateTestStart, 3, 1, 2, 6, 5, 10, 20)
+	err := a.PutValues(&wirelesstag.Tag{}, "temperature", readings)
+	if err != nil {
+		t.Fail()
+	}
+
+	expected := map[string][]float32{
+		"temperature.min":  {1, 10},
+		"temperature.max":  {6, 20},
+		"temperature.mean": {3.4, 15},
+		"temperature.last": {5, 20},
+	}
+	for stat, values := range expected {
+		if len(db.Values[stat]) != len(values) {
+			t.Errorf("%s: got %d readings", stat, len(db.Values[stat]))
+			continue
+		}
+		for i, value := range values {
+			if db.Values[stat][i].Value != value {
+				t.Errorf("%s: got %v, expected %v", stat, db.Values[stat][i].Value, value)
+			}
+		}
+		if !db.Values[stat][1].Timestamp.Equal(aggregateTestStart.Add(5 * time.Minute)) {
+			t.Fail()
+		}
+	}
+}
+
+func TestAggregatorComplete(t *testing.T) {
+	a, _ := NewAggregator(&statTSDB{}, 5*time.Minute, nil)
+
+	// The last window has no later reading, so it may not be finished
+	readings := testReadingsAt(aggregateTestStart, 1, 2, 3, 4, 5, 6, 7)
+	complete := a.Complete(readings)
+	if len(complete) != 5 {
+		t.Fail()
+	}
+
+	complete = a.Complete(readings[:3])
+	if len(complete) != 0 {
+		t.Fail()
+	}
+}
+
+func TestMultiplexerAggregator(t *testing.T) {
+	db := &statTSDB{}
+	a, _ := NewAggregator(db, 5*time.Minute, []string{AggregateLast})
+	checkpoints := &dummyCheckpointer{}
+	m := NewMultiplexer()
+	m.AddSink("db", a, SinkPolicy{})
+	m.SetCheckpointer(checkpoints)
+
+	tag := &wirelesstag.Tag{UUID: "xxx"}
+	readings := testReadingsAt(aggregateTestStart, 1, 2, 3, 4, 5, 6, 7)
+	m.PutValues(tag, "temperature", readings[:6])
+	if len(db.Values["temperature.last"]) != 1 {
+		t.FailNow()
+	}
+
+	// The second window was held back, so it's needed again
+	if !m.Checkpoint("xxx", "temperature").Equal(readings[4].Timestamp) {
+		t.Fail()
+	}
+
+	// Still not finished
+	m.PutValues(tag, "temperature", readings[5:])
+	if len(db.Values["temperature.last"]) != 1 {
+		t.Fail()
+	}
+
+	// A reading in the next window finishes it
+	next := testReadingsAt(aggregateTestStart.Add(10*time.Minute), 8)
+	m.PutValues(tag, "temperature", append(readings[5:], next...))
+	if len(db.Values["temperature.last"]) != 2 || db.Values["temperature.last"][1].Value != 7 {
+		t.Fail()
+	}
+}
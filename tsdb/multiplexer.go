@@ -0,0 +1,443 @@
+package tsdb
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arcticfoxnv/oolong/wirelesstag"
+	"github.com/sirupsen/logrus"
+)
+
+// SinkPolicy controls how failed writes to a single sink are handled.
+type SinkPolicy struct {
+	// Number of times to retry a failed write before giving up
+	Retries int
+	// Delay before the first retry.  Doubles with each further retry.
+	RetryDelay time.Duration
+	// Maximum number of readings to hold in memory while the sink is failing.
+	// Once full, the readings buffered for the tag and stat with the oldest
+	// are dropped.  The sink's checkpoint stays before them, so they're
+	// fetched from the API again to catch the sink up.
+	BufferSize int
+}
+
+// SinkStats counts readings by what happened to them, for a single sink.
+type SinkStats struct {
+	Name     string
+	Written  int
+	Failed   int
+	Buffered int
+	Dropped  int
+}
+
+// WriteObserver is told about every write to a sink, including retries and
+// writes of buffered readings.  Sinks write concurrently, so it must be safe
+// to call from multiple goroutines.
+type WriteObserver func(sink, valueType string, readings int, duration time.Duration, err error)
+
+// Checkpointer records the newest reading stored in each sink, so a sink which
+// falls behind can be caught up without holding back the others.
+type Checkpointer interface {
+	UpdateSink(string, string, string, time.Time)
+	GetSinkLastUpdateTime(string, string, string) time.Time
+}
+
+// Sinks write concurrently, so access to the checkpointer is serialized.
+type lockedCheckpointer struct {
+	checkpointer Checkpointer
+	lock         sync.Mutex
+}
+
+func (c *lockedCheckpointer) get(sink, uuid, valueType string) time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.checkpointer == nil {
+		return time.Time{}
+	}
+	return c.checkpointer.GetSinkLastUpdateTime(sink, uuid, valueType)
+}
+
+func (c *lockedCheckpointer) update(sink, uuid, valueType string, timestamp time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.checkpointer != nil {
+		c.checkpointer.UpdateSink(sink, uuid, valueType, timestamp)
+	}
+}
+
+type pendingWrite struct {
+	tag       *wirelesstag.Tag
+	valueType string
+	readings  []wirelesstag.Reading
+}
+
+type sink struct {
+	name   string
+	db     TSDB
+	policy SinkPolicy
+
+	// Held while writing, so each sink takes one write at a time.  The
+	// fields below are changed while holding both locks, so writes can read
+	// them without taking lock, which lets Stats and Checkpoint read them
+	// without waiting for a slow write.
+	writeLock sync.Mutex
+	lock      sync.Mutex
+
+	// Writes which failed and are waiting to be retried, oldest first
+	pending      []pendingWrite
+	pendingCount int
+	lastAttempt  time.Time
+	// uuid -> reading_type -> newest buffered timestamp
+	pendingUpTo map[string]map[string]time.Time
+
+	checkpoints *lockedCheckpointer
+	observer    WriteObserver
+	log         logrus.FieldLogger
+
+	stats SinkStats
+}
+
+// Multiplexer writes every reading to a list of sinks.  Each sink has its own
+// retry and buffer policy, so one sink failing doesn't stop readings from
+// reaching the others.  It's safe to write from several goroutines at once.
+// Each sink takes one write at a time, but sinks don't wait for each other,
+// so a slow sink only holds up writes to itself.
+type Multiplexer struct {
+	sinks       []*sink
+	checkpoints *lockedCheckpointer
+	observer    WriteObserver
+	log         logrus.FieldLogger
+	lock        sync.Mutex
+}
+
+func NewMultiplexer() *Multiplexer {
+	return &Multiplexer{
+		checkpoints: &lockedCheckpointer{},
+		log:         logrus.StandardLogger(),
+	}
+}
+
+// AddSink adds a sink.  Name is used for logging, stats and checkpoints, so
+// it should stay the same between runs.
+func (m *Multiplexer) AddSink(name string, db TSDB, policy SinkPolicy) {
+	m.sinks = append(m.sinks, &sink{
+		name:        name,
+		db:          db,
+		policy:      policy,
+		pendingUpTo: make(map[string]map[string]time.Time),
+		checkpoints: m.checkpoints,
+		observer:    m.observer,
+		log:         m.log.WithField("sink", name),
+		stats:       SinkStats{Name: name},
+	})
+}
+
+// SetLogger sets where sink failures are logged.  Entries from each sink
+// carry its name.
+func (m *Multiplexer) SetLogger(log logrus.FieldLogger) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.log = log
+	for _, s := range m.sinks {
+		s.writeLock.Lock()
+		s.log = log.WithField("sink", s.name)
+		s.writeLock.Unlock()
+	}
+}
+
+// SetObserver sets a function to be called after every write to a sink.
+func (m *Multiplexer) SetObserver(observer WriteObserver) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.observer = observer
+	for _, s := range m.sinks {
+		s.writeLock.Lock()
+		s.observer = observer
+		s.writeLock.Unlock()
+	}
+}
+
+// SetCheckpointer enables per-sink checkpoints.  Each sink skips readings at
+// or before its checkpoint, and moves it forward as readings are written.
+func (m *Multiplexer) SetCheckpointer(checkpointer Checkpointer) {
+	m.checkpoints.lock.Lock()
+	defer m.checkpoints.lock.Unlock()
+	m.checkpoints.checkpointer = checkpointer
+}
+
+// Checkpoint returns the time of the newest reading that every sink has
+// either stored or buffered, i.e. the point readings are needed from.
+func (m *Multiplexer) Checkpoint(uuid, valueType string) time.Time {
+	var oldest time.Time
+	for i, s := range m.sinks {
+		s.lock.Lock()
+		upTo := s.upTo(uuid, valueType)
+		s.lock.Unlock()
+		if i == 0 || upTo.Before(oldest) {
+			oldest = upTo
+		}
+	}
+	return oldest
+}
+
+// Newest returns the time of the newest reading that any sink has stored or
+// buffered, or the zero time if none has.
+func (m *Multiplexer) Newest(uuid, valueType string) time.Time {
+	var newest time.Time
+	for _, s := range m.sinks {
+		s.lock.Lock()
+		upTo := s.upTo(uuid, valueType)
+		s.lock.Unlock()
+		if upTo.After(newest) {
+			newest = upTo
+		}
+	}
+	return newest
+}
+
+func (m *Multiplexer) PutValue(tag *wirelesstag.Tag, valueType string, reading wirelesstag.Reading) error {
+	return m.PutValues(tag, valueType, []wirelesstag.Reading{reading})
+}
+
+// PutValues writes the readings to all sinks at once.  An error is only
+// returned if no sink was able to either store or buffer the readings.
+func (m *Multiplexer) PutValues(tag *wirelesstag.Tag, valueType string, readings []wirelesstag.Reading) error {
+	if len(readings) == 0 {
+		return nil
+	}
+
+	errs := make([]error, len(m.sinks))
+	wg := sync.WaitGroup{}
+	for i, s := range m.sinks {
+		wg.Add(1)
+		go func(i int, s *sink) {
+			defer wg.Done()
+			s.writeLock.Lock()
+			defer s.writeLock.Unlock()
+			errs[i] = s.write(pendingWrite{tag: tag, valueType: valueType, readings: readings})
+		}(i, s)
+	}
+	wg.Wait()
+
+	var failed []string
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", m.sinks[i].name, err.Error()))
+		}
+	}
+	if len(failed) > 0 && len(failed) == len(m.sinks) {
+		return fmt.Errorf("All sinks failed (%s)", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// PutTagManagers passes the tag managers on to any sinks which store them.
+// Failures are logged but otherwise ignored, as the metadata is refreshed
+// every time the poller starts.
+func (m *Multiplexer) PutTagManagers(managers []wirelesstag.TagManager, tags map[string][]wirelesstag.Tag) error {
+	for _, s := range m.sinks {
+		metadataDB, ok := s.db.(MetadataTSDB)
+		if !ok {
+			continue
+		}
+		s.writeLock.Lock()
+		err := metadataDB.PutTagManagers(managers, tags)
+		if err != nil {
+			s.log.WithError(err).Warn("Failed to store tag metadata")
+		}
+		s.writeLock.Unlock()
+	}
+	return nil
+}
+
+// Stats returns a copy of the counters for each sink.
+func (m *Multiplexer) Stats() []SinkStats {
+	stats := make([]SinkStats, len(m.sinks))
+	for i, s := range m.sinks {
+		s.lock.Lock()
+		stats[i] = s.stats
+		stats[i].Buffered = s.pendingCount
+		s.lock.Unlock()
+	}
+	return stats
+}
+
+// Close closes the sinks which need closing.  Readings still buffered for a
+// failing sink are lost, but its checkpoint hasn't moved past them.
+func (m *Multiplexer) Close() error {
+	var failed []string
+	for _, s := range m.sinks {
+		closer, ok := s.db.(io.Closer)
+		if !ok {
+			continue
+		}
+		// Wait for any write in progress
+		s.writeLock.Lock()
+		err := closer.Close()
+		s.writeLock.Unlock()
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", s.name, err.Error()))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Failed to close sinks: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// upTo returns the time of the newest reading this sink has stored or buffered.
+func (s *sink) upTo(uuid, valueType string) time.Time {
+	upTo := s.checkpoints.get(s.name, uuid, valueType)
+	if s.pendingUpTo[uuid] != nil && s.pendingUpTo[uuid][valueType].After(upTo) {
+		upTo = s.pendingUpTo[uuid][valueType]
+	}
+	return upTo
+}
+
+// written moves the checkpoint forward once readings are stored.
+func (s *sink) written(w pendingWrite) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.stats.Written += len(w.readings)
+	s.checkpoints.update(s.name, w.tag.UUID, w.valueType, w.readings[len(w.readings)-1].Timestamp)
+}
+
+// write tries to store w, buffering it if the sink is failing.  Returns nil
+// if w was either stored or buffered.
+func (s *sink) write(w pendingWrite) error {
+	// Skip anything this sink already has
+	upTo := s.upTo(w.tag.UUID, w.valueType)
+	var readings []wirelesstag.Reading
+	for _, reading := range w.readings {
+		if reading.Timestamp.After(upTo) {
+			readings = append(readings, reading)
+		}
+	}
+	// Sinks which store whole windows wait for the rest of an incomplete
+	// window.  Since the checkpoint stays before it, those readings are
+	// passed in again next time.
+	if windowed, ok := s.db.(WindowedTSDB); ok {
+		readings = windowed.Complete(readings)
+	}
+	if len(readings) == 0 {
+		return nil
+	}
+	w.readings = readings
+
+	// Anything already waiting has to go first to keep readings in order.
+	// While a sink is failing, only try to write once every RetryDelay so a
+	// dead sink doesn't slow down every write.
+	if len(s.pending) > 0 && time.Since(s.lastAttempt) >= s.policy.RetryDelay {
+		s.flush()
+	}
+	if len(s.pending) > 0 {
+		s.buffer(w)
+		return nil
+	}
+
+	err := s.putWithRetries(w)
+	if err == nil {
+		s.written(w)
+		return nil
+	}
+
+	s.log.WithFields(logrus.Fields{"tag": w.tag.UUID, "stat": w.valueType, "readings": len(w.readings)}).WithError(err).Warn("Failed to write readings")
+	if s.policy.BufferSize == 0 {
+		s.lock.Lock()
+		s.stats.Failed += len(w.readings)
+		s.lock.Unlock()
+		return err
+	}
+	s.buffer(w)
+	return nil
+}
+
+func (s *sink) putWithRetries(w pendingWrite) error {
+	delay := s.policy.RetryDelay
+	var err error
+	for attempt := 0; attempt <= s.policy.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		err = s.put(w)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// put makes a single attempt at storing w.
+func (s *sink) put(w pendingWrite) error {
+	s.lastAttempt = time.Now()
+	err := PutValues(s.db, w.tag, w.valueType, w.readings)
+	if s.observer != nil {
+		s.observer(s.name, w.valueType, len(w.readings), time.Since(s.lastAttempt), err)
+	}
+	return err
+}
+
+// buffer queues w.  If the buffer is full, everything buffered for the tag and
+// stat of the oldest write is dropped, leaving a gap which only catching up
+// from the checkpoint can fill, so later readings of it mustn't be written
+// before then either.
+func (s *sink) buffer(w pendingWrite) {
+	// Keep a copy, the caller is free to reuse the readings once we return
+	w.readings = append([]wirelesstag.Reading(nil), w.readings...)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.pending = append(s.pending, w)
+	s.pendingCount += len(w.readings)
+
+	if s.pendingUpTo[w.tag.UUID] == nil {
+		s.pendingUpTo[w.tag.UUID] = make(map[string]time.Time)
+	}
+	s.pendingUpTo[w.tag.UUID][w.valueType] = w.readings[len(w.readings)-1].Timestamp
+
+	for s.pendingCount > s.policy.BufferSize && len(s.pending) > 0 {
+		s.drop(s.pending[0].tag.UUID, s.pending[0].valueType)
+	}
+}
+
+// drop discards the buffered readings of a tag's stat.  Its checkpoint is left
+// at the last reading written, so the next write catches it up from there.
+// Called with lock held.
+func (s *sink) drop(uuid, valueType string) {
+	var kept []pendingWrite
+	for _, w := range s.pending {
+		if w.tag.UUID == uuid && w.valueType == valueType {
+			s.pendingCount -= len(w.readings)
+			s.stats.Dropped += len(w.readings)
+			continue
+		}
+		kept = append(kept, w)
+	}
+	s.pending = kept
+	delete(s.pendingUpTo[uuid], valueType)
+	s.log.WithFields(logrus.Fields{"tag": uuid, "stat": valueType}).Warn("Buffer full, dropped buffered readings to catch up later")
+}
+
+// flush writes buffered readings until the buffer is empty or a write fails.
+func (s *sink) flush() {
+	for len(s.pending) > 0 {
+		w := s.pending[0]
+		err := s.put(w)
+		if err != nil {
+			s.log.WithField("buffered", s.pendingCount).WithError(err).Warn("Sink still failing")
+			return
+		}
+		s.lock.Lock()
+		s.pending = s.pending[1:]
+		s.pendingCount -= len(w.readings)
+		s.lock.Unlock()
+		s.written(w)
+	}
+	s.lock.Lock()
+	s.pendingUpTo = make(map[string]map[string]time.Time)
+	s.lock.Unlock()
+	s.log.Info("Sink recovered, buffered readings written")
+}
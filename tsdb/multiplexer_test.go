@@ -0,0 +1,278 @@
+package tsdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/arcticfoxnv/oolong/wirelesstag"
+)
+
+func TestMultiplexerPutValues(t *testing.T) {
+	db1 := &dummyTSDB{}
+	db2 := &dummyBatchTSDB{}
+	m := NewMultiplexer()
+	m.AddSink("db1", db1, SinkPolicy{})
+	m.AddSink("db2", db2, SinkPolicy{})
+
+	err := m.PutValues(&wirelesstag.Tag{}, "test", testReadings)
+	if err != nil {
+		t.Fail()
+	}
+	if len(db1.Values) != 2 || len(db2.Values) != 2 {
+		t.Fail()
+	}
+
+	stats := m.Stats()
+	if stats[0].Written != 2 || stats[1].Written != 2 {
+		t.Fail()
+	}
+}
+
+func TestMultiplexerOneSinkFailed(t *testing.T) {
+	db1 := &dummyTSDB{Fail: true}
+	db2 := &dummyTSDB{}
+	m := NewMultiplexer()
+	m.AddSink("db1", db1, SinkPolicy{})
+	m.AddSink("db2", db2, SinkPolicy{})
+
+	err := m.PutValues(&wirelesstag.Tag{}, "test", testReadings)
+	if err != nil {
+		t.Fail()
+	}
+	if len(db2.Values) != 2 {
+		t.Fail()
+	}
+
+	stats := m.Stats()
+	if stats[0].Failed != 2 || stats[1].Written != 2 {
+		t.Fail()
+	}
+}
+
+func TestMultiplexerAllSinksFailed(t *testing.T) {
+	m := NewMultiplexer()
+	m.AddSink("db1", &dummyTSDB{Fail: true}, SinkPolicy{})
+	m.AddSink("db2", &dummyTSDB{Fail: true}, SinkPolicy{})
+
+	err := m.PutValues(&wirelesstag.Tag{}, "test", testReadings)
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func TestMultiplexerRetries(t *testing.T) {
+	db := &flakyTSDB{FailuresLeft: 2}
+	m := NewMultiplexer()
+	m.AddSink("db", db, SinkPolicy{Retries: 2, RetryDelay: time.Millisecond})
+
+	err := m.PutValues(&wirelesstag.Tag{}, "test", testReadings)
+	if err != nil {
+		t.Fail()
+	}
+	if len(db.Values) != 2 {
+		t.Fail()
+	}
+}
+
+func TestMultiplexerObserver(t *testing.T) {
+	db := &flakyTSDB{FailuresLeft: 1}
+	m := NewMultiplexer()
+	m.AddSink("db", db, SinkPolicy{Retries: 1, RetryDelay: time.Millisecond})
+
+	var errs []error
+	m.SetObserver(func(sink, valueType string, readings int, duration time.Duration, err error) {
+		if sink != "db" || valueType != "test" || readings != 2 {
+			t.Fail()
+		}
+		errs = append(errs, err)
+	})
+
+	m.PutValues(&wirelesstag.Tag{}, "test", testReadings)
+	if len(errs) != 2 || errs[0] == nil || errs[1] != nil {
+		t.Fail()
+	}
+}
+
+func TestMultiplexerBuffer(t *testing.T) {
+	db := &dummyTSDB{Fail: true}
+	m := NewMultiplexer()
+	m.AddSink("db", db, SinkPolicy{BufferSize: 3})
+	m.SetCheckpointer(&dummyCheckpointer{})
+	tag1 := &wirelesstag.Tag{UUID: "1"}
+	tag2 := &wirelesstag.Tag{UUID: "2"}
+
+	// Buffered writes aren't failures
+	now := time.Now()
+	err := m.PutValues(tag1, "test", testReadingsAt(now, 1, 2))
+	if err != nil {
+		t.Fail()
+	}
+	err = m.PutValues(tag2, "test", testReadingsAt(now.Add(time.Hour), 3))
+	if err != nil {
+		t.Fail()
+	}
+	if m.Checkpoint("1", "test") != now.Add(time.Minute) {
+		t.Fail()
+	}
+
+	// Overflowing drops everything buffered for the oldest tag, and its
+	// checkpoint goes back to the last reading written
+	err = m.PutValues(tag1, "test", testReadingsAt(now.Add(time.Hour), 4))
+	if err != nil {
+		t.Fail()
+	}
+	stats := m.Stats()
+	if stats[0].Buffered != 1 || stats[0].Dropped != 3 {
+		t.Error(stats)
+	}
+	if !m.Checkpoint("1", "test").IsZero() || m.Checkpoint("2", "test") != now.Add(time.Hour) {
+		t.Fail()
+	}
+
+	// Once the sink recovers, buffered readings go first, and the dropped
+	// readings are caught up from the checkpoint
+	db.Fail = false
+	m.PutValues(tag1, "test", testReadingsAt(now, 1, 2))
+	if len(db.Values) != 3 {
+		t.FailNow()
+	}
+	if db.Values[0].Value != 3 || db.Values[1].Value != 1 || db.Values[2].Value != 2 {
+		t.Fail()
+	}
+
+	stats = m.Stats()
+	if stats[0].Buffered != 0 || stats[0].Written != 3 {
+		t.Fail()
+	}
+}
+
+func TestMultiplexerCheckpoints(t *testing.T) {
+	db1 := &dummyTSDB{}
+	db2 := &dummyTSDB{}
+	checkpoints := &dummyCheckpointer{}
+	m := NewMultiplexer()
+	m.AddSink("db1", db1, SinkPolicy{})
+	m.AddSink("db2", db2, SinkPolicy{})
+	m.SetCheckpointer(checkpoints)
+
+	// db2 is an hour behind db1
+	now := time.Now()
+	checkpoints.UpdateSink("db1", "xxx", "test", now)
+	checkpoints.UpdateSink("db2", "xxx", "test", now.Add(-time.Hour))
+
+	if !m.Checkpoint("xxx", "test").Equal(now.Add(-time.Hour)) {
+		t.Fail()
+	}
+	if !m.Newest("xxx", "test").Equal(now) || !m.Newest("yyy", "test").IsZero() {
+		t.Fail()
+	}
+
+	// Only db2 needs the older readings
+	tag := &wirelesstag.Tag{UUID: "xxx"}
+	err := m.PutValues(tag, "test", testReadingsAt(now.Add(-time.Minute), 1, 2, 3))
+	if err != nil {
+		t.Fail()
+	}
+	if len(db1.Values) != 1 || len(db2.Values) != 3 {
+		t.Fail()
+	}
+
+	// Both are now caught up
+	if !m.Checkpoint("xxx", "test").Equal(now.Add(time.Minute)) {
+		t.Fail()
+	}
+}
+
+func TestMultiplexerClose(t *testing.T) {
+	db1 := &closingTSDB{}
+	db2 := &closingTSDB{}
+	aggregator, _ := NewAggregator(db2, time.Minute, nil)
+	m := NewMultiplexer()
+	m.AddSink("db1", db1, SinkPolicy{})
+	m.AddSink("db2", aggregator, SinkPolicy{})
+	m.AddSink("db3", &dummyTSDB{}, SinkPolicy{})
+
+	err := m.Close()
+	if err != nil || !db1.Closed || !db2.Closed {
+		t.Fail()
+	}
+}
+
+type dummyCheckpointer struct {
+	Checkpoints map[string]time.Time
+}
+
+func (d *dummyCheckpointer) UpdateSink(sink, uuid, valueType string, timestamp time.Time) {
+	if d.Checkpoints == nil {
+		d.Checkpoints = make(map[string]time.Time)
+	}
+	d.Checkpoints[sink+uuid+valueType] = timestamp
+}
+
+func (d *dummyCheckpointer) GetSinkLastUpdateTime(sink, uuid, valueType string) time.Time {
+	return d.Checkpoints[sink+uuid+valueType]
+}
+
+type flakyTSDB struct {
+	dummyTSDB
+	FailuresLeft int
+}
+
+func (d *flakyTSDB) PutValue(tag *wirelesstag.Tag, valueType string, reading wirelesstag.Reading) error {
+	d.Fail = d.FailuresLeft > 0
+	d.FailuresLeft--
+	return d.dummyTSDB.PutValue(tag, valueType, reading)
+}
+
+type closingTSDB struct {
+	dummyTSDB
+	Closed bool
+}
+
+func (d *closingTSDB) Close() error {
+	d.Closed = true
+	return nil
+}
+
+// Holds every write until released
+type blockingTSDB struct {
+	dummyTSDB
+	Release chan struct{}
+}
+
+func (d *blockingTSDB) PutValue(tag *wirelesstag.Tag, valueType string, reading wirelesstag.Reading) error {
+	<-d.Release
+	return d.dummyTSDB.PutValue(tag, valueType, reading)
+}
+
+func TestMultiplexerConcurrentWrites(t *testing.T) {
+	slow := &blockingTSDB{Release: make(chan struct{})}
+	fast := &dummyTSDB{}
+	m := NewMultiplexer()
+	m.AddSink("slow", slow, SinkPolicy{})
+	m.AddSink("fast", fast, SinkPolicy{})
+
+	done := make(chan error, 2)
+	for _, tag := range []string{"xxx", "yyy"} {
+		go func(uuid string) {
+			done <- m.PutValues(&wirelesstag.Tag{UUID: uuid}, "test", testReadings)
+		}(tag)
+	}
+
+	// The fast sink isn't held up by the slow one
+	deadline := time.Now().Add(time.Second)
+	for m.Stats()[1].Written != 4 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if m.Stats()[1].Written != 4 {
+		t.Fail()
+	}
+
+	close(slow.Release)
+	if <-done != nil || <-done != nil {
+		t.Fail()
+	}
+	if m.Stats()[0].Written != 4 {
+		t.Fail()
+	}
+}
@@ -1,6 +1,9 @@
 package tsdb
 
 import (
+	"context"
+	"time"
+
 	"github.com/arcticfoxnv/oolong/wirelesstag"
 )
 
@@ -8,3 +11,49 @@ import (
 type TSDB interface {
 	PutValue(*wirelesstag.Tag, string, wirelesstag.Reading) error
 }
+
+// BatchTSDB is implemented by databases that can store many readings for a
+// single tag and stat more efficiently than one at a time.
+type BatchTSDB interface {
+	TSDB
+	PutValues(*wirelesstag.Tag, string, []wirelesstag.Reading) error
+}
+
+// MetadataTSDB is implemented by databases that also keep details about the
+// tag managers and the tags connected to them.
+type MetadataTSDB interface {
+	PutTagManagers([]wirelesstag.TagManager, map[string][]wirelesstag.Tag) error
+}
+
+// Series is the set of readings of a single stat for a tag.
+type Series struct {
+	Tag      wirelesstag.Tag
+	Readings []wirelesstag.Reading
+}
+
+// Source is implemented by databases which readings can be read back from.
+type Source interface {
+	// GetValues returns the readings of a stat stored between from and to
+	// (inclusive), grouped by tag and sorted by time.
+	GetValues(context.Context, string, time.Time, time.Time) ([]Series, error)
+}
+
+// PutValues stores all of the readings for a tag and stat, using the batch
+// method if the database supports it.
+func PutValues(db TSDB, tag *wirelesstag.Tag, valueType string, readings []wirelesstag.Reading) error {
+	if len(readings) == 0 {
+		return nil
+	}
+
+	if batchDB, ok := db.(BatchTSDB); ok {
+		return batchDB.PutValues(tag, valueType, readings)
+	}
+
+	for _, reading := range readings {
+		err := db.PutValue(tag, valueType, reading)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
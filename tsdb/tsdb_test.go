@@ -0,0 +1,91 @@
+package tsdb
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/arcticfoxnv/oolong/wirelesstag"
+)
+
+type dummyTSDB struct {
+	Values []wirelesstag.Reading
+	Fail   bool
+}
+
+func (d *dummyTSDB) PutValue(tag *wirelesstag.Tag, valueType string, reading wirelesstag.Reading) error {
+	if d.Fail {
+		return errors.New("Failed to store value")
+	}
+	d.Values = append(d.Values, reading)
+	return nil
+}
+
+type dummyBatchTSDB struct {
+	dummyTSDB
+	Batches int
+}
+
+func (d *dummyBatchTSDB) PutValues(tag *wirelesstag.Tag, valueType string, readings []wirelesstag.Reading) error {
+	d.Batches++
+	d.Values = append(d.Values, readings...)
+	return nil
+}
+
+var testReadings = testReadingsAt(time.Now(), 1, 2)
+
+// Returns a reading for each value, a minute apart starting at start
+func testReadingsAt(start time.Time, values ...float32) []wirelesstag.Reading {
+	var readings []wirelesstag.Reading
+	for i, value := range values {
+		readings = append(readings, wirelesstag.Reading{
+			Timestamp: start.Add(time.Duration(i) * time.Minute),
+			Value:     value,
+		})
+	}
+	return readings
+}
+
+func TestPutValues(t *testing.T) {
+	db := &dummyTSDB{}
+	err := PutValues(db, &wirelesstag.Tag{}, "test", testReadings)
+	if err != nil {
+		t.Fail()
+	}
+	if len(db.Values) != 2 {
+		t.Fail()
+	}
+}
+
+func TestPutValuesBatch(t *testing.T) {
+	db := &dummyBatchTSDB{}
+	err := PutValues(db, &wirelesstag.Tag{}, "test", testReadings)
+	if err != nil {
+		t.Fail()
+	}
+	if db.Batches != 1 {
+		t.Fail()
+	}
+	if len(db.Values) != 2 {
+		t.Fail()
+	}
+}
+
+func TestPutValuesEmpty(t *testing.T) {
+	db := &dummyBatchTSDB{}
+	err := PutValues(db, &wirelesstag.Tag{}, "test", nil)
+	if err != nil {
+		t.Fail()
+	}
+	if db.Batches != 0 {
+		t.Fail()
+	}
+}
+
+func TestPutValuesFailed(t *testing.T) {
+	db := &dummyTSDB{Fail: true}
+	err := PutValues(db, &wirelesstag.Tag{}, "test", testReadings)
+	if err == nil {
+		t.Fail()
+	}
+}
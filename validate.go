@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/arcticfoxnv/oolong/logging"
+	"github.com/arcticfoxnv/oolong/state"
+	"github.com/arcticfoxnv/oolong/tsdb"
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+)
+
+// Limits on poll_interval, in seconds.  Tags only report every few minutes,
+// so polling more often than this just uses up API calls.
+const (
+	MinPollInterval = 30
+	MaxPollInterval = 24 * 60 * 60
+)
+
+// Most API calls to make at once.  The API is shared by every account, so
+// it's kept to a polite number.
+const MaxConcurrency = 16
+
+// Shortest leader.ttl, so the lock isn't renewed more than once a second.
+const MinLeaderTTL = 3
+
+// KnownStats are the stats the API is known to return.
+var KnownStats = []string{"temperature", "cap", "batteryVolt", "light"}
+
+var knownSinks = []string{"opentsdb", "postgres", "archive"}
+
+// ConfigErrors lists everything wrong with a config.
+type ConfigErrors []string
+
+func (e ConfigErrors) Error() string {
+	return "Invalid config: " + strings.Join(e, "; ")
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the config for settings which can't work, returning
+// ConfigErrors listing all of them, or nil if there aren't any.
+func (c *Config) Validate() error {
+	var errs ConfigErrors
+	add := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+	checkPort := func(key string, port int) {
+		if port < 1 || port > 65535 {
+			add("%s must be between 1 and 65535, got %d", key, port)
+		}
+	}
+
+	if c.OAuth.ID == "" {
+		add("oauth.id is missing")
+	}
+
+	if c.PollInterval < MinPollInterval || c.PollInterval > MaxPollInterval {
+		add("poll_interval must be between %d and %d seconds, got %d", MinPollInterval, MaxPollInterval, c.PollInterval)
+	}
+	if len(c.QueryStats) == 0 {
+		add("query_stats is empty, so there's nothing to poll")
+	}
+	for _, stat := range c.QueryStats {
+		if !contains(KnownStats, stat) {
+			add("query_stats has unknown stat %s, known stats are %s", stat, strings.Join(KnownStats, ", "))
+		}
+	}
+	switch c.PollingStrategy {
+	case "", StrategyMulti, StrategyPerTag, StrategyAuto:
+	default:
+		add("polling_strategy must be %s, %s or %s, got %s", StrategyMulti, StrategyPerTag, StrategyAuto, c.PollingStrategy)
+	}
+	if c.Concurrency < 1 || c.Concurrency > MaxConcurrency {
+		add("concurrency must be between 1 and %d, got %d", MaxConcurrency, c.Concurrency)
+	}
+	for _, spec := range c.Schedule.Cron {
+		if s, err := cron.ParseStandard(spec); err != nil {
+			add("schedule.cron %s is invalid: %s", spec, err)
+		} else if s.Next(time.Now()).IsZero() {
+			add("schedule.cron %s never matches", spec)
+		}
+	}
+	if c.Schedule.Align && len(c.Schedule.Cron) > 0 {
+		add("schedule.align can't be used with schedule.cron")
+	}
+	if c.Schedule.Jitter < 0 {
+		add("schedule.jitter can't be negative")
+	} else if len(c.Schedule.Cron) == 0 && c.Schedule.Jitter >= c.PollInterval && c.PollInterval > 0 {
+		add("schedule.jitter must be less than poll_interval, got %d", c.Schedule.Jitter)
+	}
+	for stat, interval := range c.Schedule.Intervals {
+		if !contains(c.QueryStats, stat) {
+			add("schedule.intervals has %s, which isn't in query_stats", stat)
+		}
+		if interval <= 0 {
+			add("schedule.intervals.%s must be more than 0", stat)
+		}
+	}
+	if c.CatchUpDays < 0 {
+		add("catchup_days can't be negative")
+	}
+
+	if c.API.Timeout < 0 || c.API.Retries < 0 || c.API.RetryDelay < 0 || c.API.MaxRetryDelay < 0 || c.API.CallsPerMinute < 0 {
+		add("api settings can't be negative")
+	}
+	if c.HTTP.Port < 0 || c.HTTP.Port > 65535 {
+		add("http.port must be between 0 and 65535, got %d", c.HTTP.Port)
+	}
+	if _, _, err := net.SplitHostPort(c.HTTP.Listen); c.HTTP.Listen != "" && err != nil {
+		add("http.listen %s isn't a valid address: %s", c.HTTP.Listen, err)
+	}
+	if u, err := url.Parse(c.HTTP.PublicURL); c.HTTP.PublicURL != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+		add("http.public_url must be an http or https URL, got %s", c.HTTP.PublicURL)
+	}
+	if (c.HTTP.TLSCert == "") != (c.HTTP.TLSKey == "") {
+		add("http.tls_cert and http.tls_key must be set together")
+	}
+
+	if _, err := c.Location(""); err != nil {
+		add("timezone %s is unknown", c.TimeZone)
+	}
+	for mac, name := range c.TimeZones {
+		if _, err := c.Location(mac); err != nil {
+			add("timezones has unknown time zone %s for %s", name, mac)
+		}
+	}
+
+	for stat, r := range c.Filter.Ranges {
+		if r.Min >= r.Max {
+			add("filter.ranges.%s min must be less than max", stat)
+		}
+	}
+	for stat, spike := range c.Filter.Spikes {
+		if spike <= 0 {
+			add("filter.spikes.%s must be more than 0", stat)
+		}
+	}
+
+	if _, err := logrus.ParseLevel(c.Log.Level); c.Log.Level != "" && err != nil {
+		add("log.level %s is unknown", c.Log.Level)
+	}
+	switch c.Log.Format {
+	case "", logging.FormatText, logging.FormatLogfmt, logging.FormatJSON:
+	default:
+		add("log.format must be %s, %s or %s, got %s", logging.FormatText, logging.FormatLogfmt, logging.FormatJSON, c.Log.Format)
+	}
+	if c.Metrics.StaleAfter < 0 {
+		add("metrics.stale_after can't be negative")
+	}
+
+	sinks := c.Sinks
+	if len(sinks) == 0 {
+		sinks = []string{"opentsdb"}
+	}
+	for _, sink := range sinks {
+		if !contains(knownSinks, sink) {
+			add("sinks has unknown sink %s, known sinks are %s", sink, strings.Join(knownSinks, ", "))
+			continue
+		}
+		policy := sinkPolicyConfig(c, sink)
+		if policy.Retries < 0 || policy.RetryDelay < 0 || policy.BufferSize < 0 {
+			add("%s retry and buffer settings can't be negative", sink)
+		}
+		aggregate := sinkAggregateConfig(c, sink)
+		if aggregate.Resolution < 0 {
+			add("%s.resolution can't be negative", sink)
+		}
+		if err := tsdb.CheckAggregates(aggregate.Aggregates); err != nil {
+			add("%s.aggregates: %s", sink, err)
+		}
+	}
+	if contains(sinks, "opentsdb") {
+		if c.OpenTSDB.Host == "" {
+			add("opentsdb.host is missing")
+		}
+		checkPort("opentsdb.port", c.OpenTSDB.Port)
+	}
+	if contains(sinks, "postgres") && c.Postgres.DSN == "" {
+		add("postgres.dsn is missing")
+	}
+	if contains(sinks, "archive") {
+		if c.Archive.Directory == "" {
+			add("archive.directory is missing")
+		}
+		if c.Archive.Format != "csv" && c.Archive.Format != "jsonl" {
+			add("archive.format must be csv or jsonl, got %s", c.Archive.Format)
+		}
+	}
+
+	switch c.Backend {
+	case "file":
+		if c.File.Filename == "" {
+			add("file.filename is missing")
+		}
+	case "redis":
+		if c.Redis.MasterName == "" {
+			if c.Redis.Host == "" {
+				add("redis.host is missing")
+			}
+			checkPort("redis.port", c.Redis.Port)
+		} else if len(c.Redis.Sentinels) == 0 {
+			add("redis.sentinels is missing, it's needed with redis.master_name")
+		} else if c.Redis.TLS || c.Redis.Username != "" {
+			// Not supported by redis.v5's Sentinel client
+			add("redis.tls and redis.username can't be used with Sentinel")
+		}
+		if len(c.Redis.Sentinels) > 0 && c.Redis.MasterName == "" {
+			add("redis.master_name is missing, it's needed with redis.sentinels")
+		}
+		if c.Redis.DB < 0 {
+			add("redis.db can't be negative")
+		}
+		if c.Redis.TLSCA != "" && !c.Redis.TLS {
+			add("redis.tls_ca is set, but redis.tls isn't")
+		}
+		if c.Redis.Key == "" {
+			add("redis.key is missing")
+		}
+	default:
+		add("backend must be file or redis, got %s", c.Backend)
+	}
+	if _, err := state.ParseKey(c.StateKey); c.StateKey != "" && err != nil {
+		add("state_key: %s", err)
+	}
+	if _, err := state.ParseKey(c.StateKeyPrevious); c.StateKeyPrevious != "" && err != nil {
+		add("state_key_previous: %s", err)
+	}
+	if c.Leader.TTL < MinLeaderTTL {
+		add("leader.ttl must be at least %d seconds, got %d", MinLeaderTTL, c.Leader.TTL)
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// Redacted returns a copy of the config with the secrets redacted, for
+// showing to the user.
+func (c *Config) Redacted() *Config {
+	redacted := *c
+	for _, secret := range redacted.secrets() {
+		if *secret.value != "" {
+			*secret.value = logging.Redact(*secret.value)
+		}
+	}
+	return &redacted
+}
+
+// Map returns the config as nested maps with the same keys as the config
+// file, for encoding as TOML.
+func (c *Config) Map() map[string]interface{} {
+	return configMap(reflect.ValueOf(*c))
+}
+
+func configMap(v reflect.Value) map[string]interface{} {
+	m := make(map[string]interface{})
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous {
+			for key, value := range configMap(v.Field(i)) {
+				m[key] = value
+			}
+			continue
+		}
+		m[strings.ToLower(tomlKey(field))] = configValue(v.Field(i))
+	}
+	return m
+}
+
+func configValue(v reflect.Value) interface{} {
+	switch {
+	case v.Kind() == reflect.Struct:
+		return configMap(v)
+	case v.Kind() == reflect.Map && v.Type().Elem().Kind() == reflect.Struct:
+		m := make(map[string]interface{})
+		for _, key := range v.MapKeys() {
+			m[key.String()] = configMap(v.MapIndex(key))
+		}
+		return m
+	}
+	return v.Interface()
+}
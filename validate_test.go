@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestConfigValidateExample(t *testing.T) {
+	config := ReadConfigFile("oolong.toml.example")
+	if err := config.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConfigValidateDefaults(t *testing.T) {
+	config, err := LoadConfig("", []string{"OOLONG_OAUTH_ID=x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConfigValidateErrors(t *testing.T) {
+	config := defaultConfig()
+	config.PollInterval = 0
+	config.QueryStats = []string{"temperature", "pressure"}
+	config.Backend = "mysql"
+	config.Sinks = []string{"opentsdb", "archive"}
+	config.OpenTSDB.Port = 70000
+	config.Archive.Aggregates = []string{"median"}
+	config.StateKey = "c2hvcnQ="
+
+	errs, ok := config.Validate().(ConfigErrors)
+	if !ok {
+		t.Fatal("expected ConfigErrors")
+	}
+	// oauth.id, poll_interval, pressure, backend, opentsdb.port, the
+	// aggregate and state_key
+	if len(errs) != 7 {
+		t.Error(errs)
+	}
+	if !strings.Contains(errs.Error(), "pressure") {
+		t.Fail()
+	}
+}
+
+func TestLoadConfigUnknownKey(t *testing.T) {
+	ioutil.WriteFile("test.toml", []byte("poll_intervl = 300\n[redis]\nhots = \"localhost\"\n"), 0600)
+	defer os.Remove("test.toml")
+
+	_, err := LoadConfig("test.toml", nil)
+	if err == nil || !strings.Contains(err.Error(), "redis.hots") {
+		t.Fail()
+	}
+}
+
+func TestLoadConfigUnknownEnv(t *testing.T) {
+	_, err := LoadConfig("", []string{"OOLONG_CONFIG=", "OOLONG_POLL_INTERVL=60"})
+	if err == nil || !strings.Contains(err.Error(), "OOLONG_POLL_INTERVL") {
+		t.Fail()
+	}
+}
+
+func TestConfigRedacted(t *testing.T) {
+	config := defaultConfig()
+	config.OAuth.Secret = "0123456789abcdef"
+	redacted := config.Redacted()
+	if config.OAuth.Secret != "0123456789abcdef" || strings.Contains(redacted.OAuth.Secret, "abcdef") {
+		t.Fail()
+	}
+
+	m := redacted.Map()
+	oauth := m["oauth"].(map[string]interface{})
+	if oauth["secret"] != redacted.OAuth.Secret {
+		t.Fail()
+	}
+	// Embedded sections are flattened, as in the config file
+	if m["opentsdb"].(map[string]interface{})["retries"] != 0 {
+		t.Fail()
+	}
+}
+
+func TestConfigValidateRedis(t *testing.T) {
+	config := defaultConfig()
+	config.OAuth.ID = "x"
+	config.Backend = "redis"
+	config.Redis.MasterName = "mymaster"
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "redis.sentinels") {
+		t.Error(err)
+	}
+
+	config.Redis.Sentinels = []string{"localhost:26379"}
+	if err := config.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	config.Redis.Username = "oolong"
+	if err := config.Validate(); err == nil {
+		t.Fail()
+	}
+}
+
+func TestConfigValidateSchedule(t *testing.T) {
+	config := defaultConfig()
+	config.OAuth.ID = "x"
+	config.Schedule.Cron = []string{"*/5 * * * *", "0 0 30 2 *"}
+	config.Schedule.Align = true
+	config.Schedule.Jitter = -1
+	config.Schedule.Intervals = map[string]int{"batteryVolt": 3600, "light": 0}
+
+	errs, ok := config.Validate().(ConfigErrors)
+	if !ok {
+		t.Fatal("expected ConfigErrors")
+	}
+	// Never matches, align, jitter, light isn't polled and has no interval
+	if len(errs) != 5 {
+		t.Error(errs)
+	}
+
+	config.Schedule = ScheduleConfig{Jitter: config.PollInterval}
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "schedule.jitter") {
+		t.Error(err)
+	}
+}
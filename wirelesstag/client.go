@@ -2,14 +2,21 @@ package wirelesstag
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/arcticfoxnv/oolong/logging"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
 )
 
 var apiHost = "https://www.mytaglist.com"
@@ -23,29 +30,74 @@ var (
 )
 
 // Client represents an API client.  It's not limited to the ethClient module
+//
+// Each method has a Context variant.  Cancelling the context, or reaching its
+// deadline, aborts the request along with any waiting for retries or the
+// rate limit.  The plain methods use context.Background().
 type Client interface {
 	// GetMultiTagStatsRaw calls a method of the same name in the ethLogs module
 	GetMultiTagStatsRaw([]int, string, time.Time, time.Time) ([]RawMultiStat, error)
+	GetMultiTagStatsRawContext(context.Context, []int, string, time.Time, time.Time) ([]RawMultiStat, error)
 
 	// GetStatsRaw calls a method of the same name in the ethLogs module
 	GetStatsRaw(int, time.Time, time.Time) ([]RawStat, error)
+	GetStatsRawContext(context.Context, int, time.Time, time.Time) ([]RawStat, error)
 
 	// GetTagManagers calls a method of the same name in the ethAccount module
 	GetTagManagers() ([]TagManager, error)
+	GetTagManagersContext(context.Context) ([]TagManager, error)
 
 	// GetTagManagerTagList calls a method of the same name in the ethClient module
 	GetTagManagerTagList() (map[string][]Tag, error)
+	GetTagManagerTagListContext(context.Context) (map[string][]Tag, error)
+
+	// SetAccessToken replaces the token used for further calls
+	SetAccessToken(string)
+}
+
+// ClientOptions controls timeouts, retries and rate limiting of API calls.
+type ClientOptions struct {
+	// Maximum time for a single request, including reading the response
+	Timeout time.Duration
+	// Number of times to retry a request that failed with a network error,
+	// 429 or 5xx response
+	Retries int
+	// Delay before the first retry.  Doubles with each further retry (with
+	// jitter), up to MaxRetryDelay.  A Retry-After header from the server
+	// takes precedence.
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+	// Maximum API calls per minute, spaced out evenly.  0 is unlimited.
+	CallsPerMinute int
+	// Called after every request, if set
+	Observer RequestObserver
 }
 
-type clientError struct {
-	Error        error
-	StatusCode   int
-	RequestURI   string
-	ResponseBody []byte
+// RequestObserver is told about every request made to the API, including
+// retries.  Method is the API method called, e.g. GetStatsRaw, and statusCode
+// is 0 if no response was received.
+type RequestObserver func(method string, statusCode int, duration time.Duration, err error)
+
+// DefaultClientOptions are used by NewClient
+var DefaultClientOptions = ClientOptions{
+	Timeout:       30 * time.Second,
+	Retries:       3,
+	RetryDelay:    time.Second,
+	MaxRetryDelay: time.Minute,
 }
 
+// Shared by clients that weren't given their own, so connections are kept
+// alive between calls.
+var defaultHTTPClient = &http.Client{Timeout: DefaultClientOptions.Timeout}
+
+// Safe for concurrent use, including replacing the access token while calls
+// are being made.
 type wirelessTagClient struct {
 	AccessToken string
+	tokenLock   sync.RWMutex
+	options     ClientOptions
+	httpClient  *http.Client
+	limiter     *rate.Limiter
 }
 
 type tagList []Tag
@@ -59,27 +111,104 @@ type multiTagRawResponse struct {
 }
 
 func NewClient(accessToken string) Client {
-	return &wirelessTagClient{
+	return NewClientWithOptions(accessToken, DefaultClientOptions)
+}
+
+func NewClientWithOptions(accessToken string, options ClientOptions) Client {
+	c := &wirelessTagClient{
 		AccessToken: accessToken,
+		options:     options,
+		httpClient:  &http.Client{Timeout: options.Timeout},
 	}
+	if options.CallsPerMinute > 0 {
+		// Calls are spaced out evenly, without a burst, so no minute has more
+		// than CallsPerMinute, including the first.
+		c.limiter = rate.NewLimiter(rate.Every(time.Minute/time.Duration(options.CallsPerMinute)), 1)
+	}
+	return c
+}
+
+func (c *wirelessTagClient) SetAccessToken(accessToken string) {
+	c.tokenLock.Lock()
+	defer c.tokenLock.Unlock()
+	c.AccessToken = accessToken
+}
+
+func (c *wirelessTagClient) accessToken() string {
+	c.tokenLock.RLock()
+	defer c.tokenLock.RUnlock()
+	return c.AccessToken
 }
 
 // doPostEmptyRequest is a helper function for calling endpoints that take no input
-func (c *wirelessTagClient) doPostEmptyRequest(module, endpoint string) ([]byte, *clientError) {
+func (c *wirelessTagClient) doPostEmptyRequest(ctx context.Context, module, endpoint string) ([]byte, error) {
 	content := strings.NewReader("{}")
-	return c.doPostRequest(module, endpoint, content)
+	return c.doPostRequest(ctx, module, endpoint, content)
+}
+
+// doPostRequest makes a POST to the API server, and handles adding the authorization and content-type headers.
+// Requests which fail with a network error, 429 or 5xx response are retried.
+// Failures are returned as one of the error types in errors.go.
+func (c *wirelessTagClient) doPostRequest(ctx context.Context, module, endpoint string, content io.Reader) ([]byte, error) {
+	url := apiURL(module, endpoint)
+
+	// The content is needed for each attempt
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		return nil, &RequestError{Err: err, RequestURI: url}
+	}
+
+	for attempt := 0; ; attempt++ {
+		// Time spent waiting on the rate limit isn't part of the request
+		if c.limiter != nil {
+			err := c.limiter.Wait(ctx)
+			if err != nil {
+				return nil, &RequestError{Err: err, RequestURI: url}
+			}
+		}
+
+		start := time.Now()
+		body, retryAfter, err := c.doPostAttempt(ctx, url, data)
+		if c.options.Observer != nil {
+			c.options.Observer(endpoint, StatusCode(err), time.Since(start), err)
+		}
+		if err == nil || !isRetryable(err) || attempt >= c.options.Retries || ctx.Err() != nil {
+			return body, err
+		}
+
+		// Wait before the next attempt, as long as the server asked if it did
+		delay := c.backoff(attempt)
+		if retryAfter > 0 {
+			delay = retryAfter
+		}
+		logging.FromContext(ctx).WithFields(logrus.Fields{
+			"method":  endpoint,
+			"attempt": attempt + 1,
+			"delay":   delay.String(),
+		}).WithError(err).Warn("API request failed, retrying")
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, &RequestError{Err: ctx.Err(), RequestURI: url}
+		case <-timer.C:
+		}
+	}
 }
 
-// doPostRequest makes a POST to the API server, and handles adding the authorization and content-type headers
-func (c *wirelessTagClient) doPostRequest(module, endpoint string, content io.Reader) ([]byte, *clientError) {
-	httpClient := &http.Client{}
-	authStr := fmt.Sprintf("Bearer %s", c.AccessToken)
-	url := fmt.Sprintf("%s/%s/%s", apiHost, module, endpoint)
+// doPostAttempt makes a single request.  Also returns the delay requested by
+// the Retry-After header, if any.
+func (c *wirelessTagClient) doPostAttempt(ctx context.Context, url string, data []byte) ([]byte, time.Duration, error) {
+	httpClient := c.httpClient
+	if httpClient == nil {
+		httpClient = defaultHTTPClient
+	}
+	authStr := fmt.Sprintf("Bearer %s", c.accessToken())
 
 	// Build the request
-	req, err := http.NewRequest(http.MethodPost, url, content)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
 	if err != nil {
-		return nil, &clientError{Error: err}
+		return nil, 0, &RequestError{Err: err}
 	}
 	req.Header.Add("Authorization", authStr)
 	req.Header.Add("Content-Type", "application/json")
@@ -87,30 +216,78 @@ func (c *wirelessTagClient) doPostRequest(module, endpoint string, content io.Re
 	// Execute
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		return nil, &clientError{Error: err, RequestURI: url}
+		return nil, 0, &RequestError{Err: err, RequestURI: url}
 	}
 	defer resp.Body.Close()
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, &clientError{Error: err, RequestURI: url, StatusCode: resp.StatusCode}
+		return nil, 0, &RequestError{Err: err, RequestURI: url, StatusCode: resp.StatusCode}
 	}
 	if resp.StatusCode != http.StatusOK {
-		err = errors.New("Something failed in the request")
-		return nil, &clientError{Error: err, RequestURI: url, StatusCode: resp.StatusCode, ResponseBody: body}
+		retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"))
+		return nil, retryAfter, newResponseError(url, resp, body)
 	}
 
-	return body, nil
+	return body, 0, nil
+}
+
+func apiURL(module, endpoint string) string {
+	return fmt.Sprintf("%s/%s/%s", apiHost, module, endpoint)
+}
+
+// decodeResponse unmarshals a response body, wrapping any failure in a DecodeError.
+func decodeResponse(module, endpoint string, body []byte, v interface{}) error {
+	err := json.Unmarshal(body, v)
+	if err != nil {
+		return &DecodeError{RequestURI: apiURL(module, endpoint), ResponseBody: body, Err: err}
+	}
+	return nil
+}
+
+// backoff returns the delay before retrying after the given attempt.  The
+// delay doubles each attempt, with up to half of it randomized so clients
+// don't retry in lockstep.
+func (c *wirelessTagClient) backoff(attempt int) time.Duration {
+	delay := c.options.RetryDelay << uint(attempt)
+	if delay > c.options.MaxRetryDelay || delay <= 0 {
+		delay = c.options.MaxRetryDelay
+	}
+	if delay < 2 {
+		return delay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+}
+
+// parseRetryAfter handles both forms of the Retry-After header, a number of
+// seconds or an HTTP date.
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+	return 0
 }
 
 func (c *wirelessTagClient) GetTagManagers() ([]TagManager, error) {
-	resp, cErr := c.doPostEmptyRequest(ethAccount, "GetTagManagers")
-	if cErr != nil {
-		return nil, cErr.Error
+	return c.GetTagManagersContext(context.Background())
+}
+
+func (c *wirelessTagClient) GetTagManagersContext(ctx context.Context) ([]TagManager, error) {
+	resp, err := c.doPostEmptyRequest(ctx, ethAccount, "GetTagManagers")
+	if err != nil {
+		return nil, err
 	}
 
 	decodedResponse := make(map[string][]TagManager, 0)
-	err := json.Unmarshal(resp, &decodedResponse)
+	err = decodeResponse(ethAccount, "GetTagManagers", resp, &decodedResponse)
 	if err != nil {
 		return nil, err
 	}
@@ -118,19 +295,26 @@ func (c *wirelessTagClient) GetTagManagers() ([]TagManager, error) {
 }
 
 func (c *wirelessTagClient) GetTagManagerTagList() (map[string][]Tag, error) {
-	resp, cErr := c.doPostEmptyRequest(ethClient, "GetTagManagerTagList")
-	if cErr != nil {
-		return nil, cErr.Error
+	return c.GetTagManagerTagListContext(context.Background())
+}
+
+func (c *wirelessTagClient) GetTagManagerTagListContext(ctx context.Context) (map[string][]Tag, error) {
+	resp, err := c.doPostEmptyRequest(ctx, ethClient, "GetTagManagerTagList")
+	if err != nil {
+		return nil, err
 	}
 
 	decodedResponse := make(map[string][]tagManagerTagList, 0)
-	err := json.Unmarshal(resp, &decodedResponse)
+	err = decodeResponse(ethClient, "GetTagManagerTagList", resp, &decodedResponse)
 	if err != nil {
 		return nil, err
 	}
 
 	list := make(map[string][]Tag, 0)
 	for _, entry := range decodedResponse["d"] {
+		for i := range entry.Tags {
+			entry.Tags[i].ManagerMac = entry.Mac
+		}
 		list[entry.Mac] = entry.Tags
 	}
 
@@ -138,6 +322,10 @@ func (c *wirelessTagClient) GetTagManagerTagList() (map[string][]Tag, error) {
 }
 
 func (c *wirelessTagClient) GetStatsRaw(slaveId int, from, to time.Time) ([]RawStat, error) {
+	return c.GetStatsRawContext(context.Background(), slaveId, from, to)
+}
+
+func (c *wirelessTagClient) GetStatsRawContext(ctx context.Context, slaveId int, from, to time.Time) ([]RawStat, error) {
 	data, err := json.Marshal(map[string]interface{}{
 		"id":       slaveId,
 		"fromDate": from.Format(DateFormat),
@@ -148,13 +336,13 @@ func (c *wirelessTagClient) GetStatsRaw(slaveId int, from, to time.Time) ([]RawS
 	}
 	content := bytes.NewReader(data)
 
-	resp, cErr := c.doPostRequest(ethLogs, "GetStatsRaw", content)
-	if cErr != nil {
-		return nil, cErr.Error
+	resp, err := c.doPostRequest(ctx, ethLogs, "GetStatsRaw", content)
+	if err != nil {
+		return nil, err
 	}
 
 	decodedResponse := make(map[string][]RawStat, 0)
-	err = json.Unmarshal(resp, &decodedResponse)
+	err = decodeResponse(ethLogs, "GetStatsRaw", resp, &decodedResponse)
 	if err != nil {
 		return nil, err
 	}
@@ -163,6 +351,10 @@ func (c *wirelessTagClient) GetStatsRaw(slaveId int, from, to time.Time) ([]RawS
 }
 
 func (c *wirelessTagClient) GetMultiTagStatsRaw(slaveIds []int, statType string, from, to time.Time) ([]RawMultiStat, error) {
+	return c.GetMultiTagStatsRawContext(context.Background(), slaveIds, statType, from, to)
+}
+
+func (c *wirelessTagClient) GetMultiTagStatsRawContext(ctx context.Context, slaveIds []int, statType string, from, to time.Time) ([]RawMultiStat, error) {
 	data, err := json.Marshal(map[string]interface{}{
 		"ids":      slaveIds,
 		"type":     statType,
@@ -174,13 +366,13 @@ func (c *wirelessTagClient) GetMultiTagStatsRaw(slaveIds []int, statType string,
 	}
 	content := bytes.NewReader(data)
 
-	resp, cErr := c.doPostRequest(ethLogs, "GetMultiTagStatsRaw", content)
-	if cErr != nil {
-		return nil, cErr.Error
+	resp, err := c.doPostRequest(ctx, ethLogs, "GetMultiTagStatsRaw", content)
+	if err != nil {
+		return nil, err
 	}
 
 	decodedResponse := make(map[string]multiTagRawResponse, 0)
-	err = json.Unmarshal(resp, &decodedResponse)
+	err = decodeResponse(ethLogs, "GetMultiTagStatsRaw", resp, &decodedResponse)
 	if err != nil {
 		return nil, err
 	}
@@ -1,7 +1,10 @@
 package wirelesstag
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -9,6 +12,12 @@ import (
 	"time"
 )
 
+func init() {
+	// Keep retries from slowing down the tests
+	DefaultClientOptions.RetryDelay = time.Millisecond
+	DefaultClientOptions.MaxRetryDelay = 10 * time.Millisecond
+}
+
 func TestDoPostRequest(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
@@ -19,7 +28,7 @@ func TestDoPostRequest(t *testing.T) {
 
 	client := &wirelessTagClient{AccessToken: "xyz"}
 	content := strings.NewReader("")
-	res, err := client.doPostRequest(ethAccount, "testing", content)
+	res, err := client.doPostRequest(context.Background(), ethAccount, "testing", content)
 	if err != nil {
 		t.Fail()
 	}
@@ -39,7 +48,7 @@ func TestDoPostRequestBadAuth(t *testing.T) {
 
 	client := &wirelessTagClient{AccessToken: "xyz"}
 	content := strings.NewReader("")
-	res, err := client.doPostRequest(ethAccount, "testing", content)
+	res, err := client.doPostRequest(context.Background(), ethAccount, "testing", content)
 	if err == nil {
 		t.Fail()
 	}
@@ -57,7 +66,7 @@ func TestDoPostEmptyRequest(t *testing.T) {
 	apiHost = ts.URL
 
 	client := &wirelessTagClient{AccessToken: "xyz"}
-	res, err := client.doPostEmptyRequest(ethAccount, "testing")
+	res, err := client.doPostEmptyRequest(context.Background(), ethAccount, "testing")
 	if err != nil {
 		t.Fail()
 	}
@@ -137,6 +146,9 @@ func TestGetTagManagerTagList(t *testing.T) {
 	if res["xx:xx:xx:xx:xx:xx"][0].Name != "Test Tag" {
 		t.Fail()
 	}
+	if res["xx:xx:xx:xx:xx:xx"][0].ManagerMac != "xx:xx:xx:xx:xx:xx" {
+		t.Fail()
+	}
 }
 
 func TestGetTagManagerTagListBadResponse(t *testing.T) {
@@ -291,3 +303,219 @@ func TestGetMultiTagStatsRawBadData(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestDoPostRequestRetry(t *testing.T) {
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			w.WriteHeader(503)
+			return
+		}
+		fmt.Fprintf(w, `you win!`)
+	}))
+	defer ts.Close()
+	apiHost = ts.URL
+
+	client := NewClient("xyz").(*wirelessTagClient)
+	res, err := client.doPostRequest(context.Background(), ethAccount, "testing", strings.NewReader("{}"))
+	if err != nil {
+		t.Fail()
+	}
+	if string(res) != "you win!" || calls != 3 {
+		t.Fail()
+	}
+}
+
+func TestDoPostRequestRetriesExhausted(t *testing.T) {
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(429)
+	}))
+	defer ts.Close()
+	apiHost = ts.URL
+
+	client := NewClient("xyz").(*wirelessTagClient)
+	_, err := client.doPostRequest(context.Background(), ethAccount, "testing", strings.NewReader("{}"))
+	if err == nil {
+		t.Fail()
+	}
+	if calls != DefaultClientOptions.Retries+1 {
+		t.Fail()
+	}
+}
+
+func TestDoPostRequestNoRetry(t *testing.T) {
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(403)
+	}))
+	defer ts.Close()
+	apiHost = ts.URL
+
+	client := NewClient("xyz").(*wirelessTagClient)
+	_, err := client.doPostRequest(context.Background(), ethAccount, "testing", strings.NewReader("{}"))
+	if err == nil {
+		t.Fail()
+	}
+	if calls != 1 {
+		t.Fail()
+	}
+}
+
+func TestDoPostRequestRetryBody(t *testing.T) {
+	var bodies []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if len(bodies) == 1 {
+			w.WriteHeader(500)
+		}
+	}))
+	defer ts.Close()
+	apiHost = ts.URL
+
+	client := NewClient("xyz").(*wirelessTagClient)
+	client.doPostRequest(context.Background(), ethAccount, "testing", strings.NewReader(`{"id": 1}`))
+	if len(bodies) != 2 || bodies[1] != `{"id": 1}` {
+		t.Fail()
+	}
+}
+
+func TestObserver(t *testing.T) {
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(503)
+			return
+		}
+		fmt.Fprintf(w, `you win!`)
+	}))
+	defer ts.Close()
+	apiHost = ts.URL
+
+	var methods []string
+	var statusCodes []int
+	options := DefaultClientOptions
+	options.Observer = func(method string, statusCode int, duration time.Duration, err error) {
+		methods = append(methods, method)
+		statusCodes = append(statusCodes, statusCode)
+	}
+	client := NewClientWithOptions("xyz", options).(*wirelessTagClient)
+	client.doPostEmptyRequest(context.Background(), ethAccount, "testing")
+
+	// Each attempt is observed
+	if len(methods) != 2 || methods[0] != "testing" || methods[1] != "testing" {
+		t.Fail()
+	}
+	if len(statusCodes) != 2 || statusCodes[0] != 503 || statusCodes[1] != 200 {
+		t.Fail()
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if parseRetryAfter("") != 0 {
+		t.Fail()
+	}
+	if parseRetryAfter("120") != 2*time.Minute {
+		t.Fail()
+	}
+	if parseRetryAfter("garbage") != 0 {
+		t.Fail()
+	}
+
+	date := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	delay := parseRetryAfter(date)
+	if delay < 59*time.Minute || delay > time.Hour {
+		t.Fail()
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	client := &wirelessTagClient{options: ClientOptions{RetryDelay: time.Second, MaxRetryDelay: 10 * time.Second}}
+	for attempt, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		delay := client.backoff(attempt)
+		if delay < max/2 || delay > max {
+			t.Fail()
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `you win!`)
+	}))
+	defer ts.Close()
+	apiHost = ts.URL
+
+	// Calls are 100ms apart from the first, so there's no burst of extra
+	// calls in the first minute
+	options := DefaultClientOptions
+	options.CallsPerMinute = 600
+	client := NewClientWithOptions("xyz", options).(*wirelessTagClient)
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		client.doPostEmptyRequest(context.Background(), ethAccount, "testing")
+	}
+	if time.Since(start) < 350*time.Millisecond {
+		t.Error(time.Since(start))
+	}
+}
+
+func TestContextDeadline(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Hang until the client gives up, which the server only notices
+		// once the body has been read.
+		ioutil.ReadAll(r.Body)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer ts.Close()
+	apiHost = ts.URL
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	client := NewClient("xyz")
+	_, err := client.GetTagManagersContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fail()
+	}
+	if time.Since(start) > time.Second {
+		t.Fail()
+	}
+}
+
+func TestContextCancelRetry(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(503)
+	}))
+	defer ts.Close()
+	apiHost = ts.URL
+
+	options := DefaultClientOptions
+	options.RetryDelay = time.Minute
+	options.MaxRetryDelay = time.Minute
+	client := NewClientWithOptions("xyz", options)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	// Cancelling stops the wait for the next retry
+	_, err := client.GetMultiTagStatsRawContext(ctx, []int{1}, "temperature", time.Now(), time.Now())
+	if !errors.Is(err, context.Canceled) {
+		t.Fail()
+	}
+	if requests != 1 {
+		t.Fail()
+	}
+}
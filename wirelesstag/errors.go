@@ -0,0 +1,173 @@
+package wirelesstag
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// RequestError is returned when a request could not be made, or the server
+// responded with an error that doesn't fit one of the more specific types
+// below.  StatusCode is 0 if no response was received.
+type RequestError struct {
+	StatusCode   int
+	RequestURI   string
+	ResponseBody []byte
+	// Underlying error (network failure, timeout, etc), if any
+	Err error
+}
+
+func (e *RequestError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("Request to %s failed: %s", e.RequestURI, e.Err.Error())
+	}
+	return fmt.Sprintf("Request to %s failed with status %d", e.RequestURI, e.StatusCode)
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// AuthError is returned when the access token was rejected, either with a
+// 401/403 response or an authentication fault.  A new token is needed.
+type AuthError struct {
+	RequestError
+	// Set if the server described the problem
+	Fault *Fault
+}
+
+func (e *AuthError) Error() string {
+	if e.Fault != nil {
+		return fmt.Sprintf("Access token rejected by %s: %s", e.RequestURI, e.Fault.Message)
+	}
+	return fmt.Sprintf("Access token rejected by %s (status %d)", e.RequestURI, e.StatusCode)
+}
+
+// RateLimitError is returned for a 429 response which persisted through all
+// of the retries.
+type RateLimitError struct {
+	RequestError
+	// Delay the server asked for before the next request, if it said
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("Rate limited by %s", e.RequestURI)
+}
+
+// ServerError is returned for a 5xx response which persisted through all of
+// the retries, and didn't describe what went wrong.
+type ServerError struct {
+	RequestError
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("Server error from %s (status %d)", e.RequestURI, e.StatusCode)
+}
+
+// Fault is the body ASP.NET web services respond with when a method throws
+// an exception.
+type Fault struct {
+	Message       string
+	ExceptionType string
+	StackTrace    string
+}
+
+// FaultError is returned when the API method failed and the server said why,
+// usually because of a bad argument.  Repeating the request won't help.
+type FaultError struct {
+	RequestError
+	Fault Fault
+}
+
+func (e *FaultError) Error() string {
+	return fmt.Sprintf("%s failed: %s (%s)", e.RequestURI, e.Fault.Message, e.Fault.ExceptionType)
+}
+
+// DecodeError is returned when a successful response couldn't be decoded.
+type DecodeError struct {
+	RequestURI   string
+	ResponseBody []byte
+	Err          error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("Unable to decode response from %s: %s", e.RequestURI, e.Err.Error())
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// parseFault returns the fault described by a response body, or nil if the
+// body isn't one.
+func parseFault(body []byte) *Fault {
+	fault := new(Fault)
+	if json.Unmarshal(body, fault) != nil || fault.ExceptionType == "" {
+		return nil
+	}
+	return fault
+}
+
+// Faults thrown when the token is invalid or expired.  The API returns these
+// as a 500 rather than a 401.
+func isAuthFault(fault *Fault) bool {
+	return strings.Contains(fault.ExceptionType, "Unauthorized") ||
+		strings.Contains(fault.ExceptionType, "Authentication") ||
+		strings.HasPrefix(fault.Message, "Authentication failed")
+}
+
+// newResponseError picks the error type which best describes a failed
+// response.
+func newResponseError(uri string, resp *http.Response, body []byte) error {
+	base := RequestError{StatusCode: resp.StatusCode, RequestURI: uri, ResponseBody: body}
+	fault := parseFault(body)
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return &AuthError{RequestError: base, Fault: fault}
+	case fault != nil && isAuthFault(fault):
+		return &AuthError{RequestError: base, Fault: fault}
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return &RateLimitError{RequestError: base, RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	case fault != nil:
+		return &FaultError{RequestError: base, Fault: *fault}
+	case resp.StatusCode >= 500:
+		return &ServerError{RequestError: base}
+	}
+	return &base
+}
+
+// StatusCode returns the HTTP status of the response a request failed with,
+// 200 if err is nil, or 0 if there was no response.
+func StatusCode(err error) int {
+	switch e := err.(type) {
+	case nil:
+		return http.StatusOK
+	case *RequestError:
+		return e.StatusCode
+	case *AuthError:
+		return e.StatusCode
+	case *RateLimitError:
+		return e.StatusCode
+	case *ServerError:
+		return e.StatusCode
+	case *FaultError:
+		return e.StatusCode
+	}
+	return 0
+}
+
+// Network errors (sent, but no response), rate limiting and server errors are
+// worth retrying.  Anything else will fail the same way again.
+func isRetryable(err error) bool {
+	switch e := err.(type) {
+	case *RateLimitError, *ServerError:
+		return true
+	case *RequestError:
+		return e.StatusCode == 0 && e.RequestURI != ""
+	}
+	return false
+}
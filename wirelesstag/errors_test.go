@@ -0,0 +1,163 @@
+package wirelesstag
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Returns a server which always responds with the given status and body,
+// and counts the requests made to it.
+func newErrorServer(status int, body string, requests *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+}
+
+func TestAuthError(t *testing.T) {
+	requests := 0
+	ts := newErrorServer(401, "", &requests)
+	defer ts.Close()
+	apiHost = ts.URL
+
+	client := NewClient("xyz")
+	_, err := client.GetTagManagers()
+	var authErr *AuthError
+	if !errors.As(err, &authErr) {
+		t.Fail()
+	}
+	if authErr != nil && authErr.StatusCode != 401 {
+		t.Fail()
+	}
+	if requests != 1 {
+		t.Fail()
+	}
+}
+
+func TestAuthFault(t *testing.T) {
+	requests := 0
+	ts := newErrorServer(500, `{"Message":"Authentication failed, please login.","StackTrace":"","ExceptionType":"System.UnauthorizedAccessException"}`, &requests)
+	defer ts.Close()
+	apiHost = ts.URL
+
+	client := NewClient("xyz")
+	_, err := client.GetTagManagerTagList()
+	var authErr *AuthError
+	if !errors.As(err, &authErr) {
+		t.Fail()
+	}
+	if authErr != nil && (authErr.Fault == nil || authErr.Fault.Message != "Authentication failed, please login.") {
+		t.Fail()
+	}
+	if requests != 1 {
+		t.Fail()
+	}
+}
+
+func TestFaultError(t *testing.T) {
+	requests := 0
+	ts := newErrorServer(500, `{"Message":"Invalid tag id","StackTrace":"   at MyTagList.ethLogs.GetStatsRaw()","ExceptionType":"System.ArgumentException"}`, &requests)
+	defer ts.Close()
+	apiHost = ts.URL
+
+	client := NewClient("xyz")
+	_, err := client.GetStatsRaw(1, time.Now(), time.Now())
+	var faultErr *FaultError
+	if !errors.As(err, &faultErr) {
+		t.Fail()
+	}
+	if faultErr != nil && (faultErr.Fault.Message != "Invalid tag id" || faultErr.Fault.ExceptionType != "System.ArgumentException") {
+		t.Fail()
+	}
+	// Faults aren't worth retrying
+	if requests != 1 {
+		t.Fail()
+	}
+}
+
+func TestServerError(t *testing.T) {
+	requests := 0
+	ts := newErrorServer(503, "<html>Service Unavailable</html>", &requests)
+	defer ts.Close()
+	apiHost = ts.URL
+
+	client := NewClient("xyz")
+	_, err := client.GetMultiTagStatsRaw([]int{1}, "temperature", time.Now(), time.Now())
+	var serverErr *ServerError
+	if !errors.As(err, &serverErr) {
+		t.Fail()
+	}
+	if requests != DefaultClientOptions.Retries+1 {
+		t.Fail()
+	}
+}
+
+func TestRateLimitError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(429)
+	}))
+	defer ts.Close()
+	apiHost = ts.URL
+
+	client := NewClientWithOptions("xyz", ClientOptions{})
+	_, err := client.GetTagManagers()
+	var rateErr *RateLimitError
+	if !errors.As(err, &rateErr) {
+		t.Fail()
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	requests := 0
+	ts := newErrorServer(200, "garbage", &requests)
+	defer ts.Close()
+	apiHost = ts.URL
+
+	client := NewClient("xyz")
+	_, err := client.GetTagManagers()
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) {
+		t.Fail()
+	}
+	if decodeErr != nil && string(decodeErr.ResponseBody) != "garbage" {
+		t.Fail()
+	}
+}
+
+func TestNetworkError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	apiHost = ts.URL
+	ts.Close()
+
+	client := NewClientWithOptions("xyz", ClientOptions{})
+	_, err := client.GetTagManagers()
+	var reqErr *RequestError
+	if !errors.As(err, &reqErr) {
+		t.Fail()
+	}
+	if reqErr != nil && (reqErr.StatusCode != 0 || reqErr.Unwrap() == nil) {
+		t.Fail()
+	}
+}
+
+func TestStatusCode(t *testing.T) {
+	if StatusCode(nil) != 200 {
+		t.Fail()
+	}
+	if StatusCode(&AuthError{RequestError: RequestError{StatusCode: 401}}) != 401 {
+		t.Fail()
+	}
+	if StatusCode(&RequestError{Err: errors.New("connection refused")}) != 0 {
+		t.Fail()
+	}
+	if StatusCode(&DecodeError{}) != 0 {
+		t.Fail()
+	}
+}
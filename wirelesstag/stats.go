@@ -1,6 +1,7 @@
 package wirelesstag
 
 import (
+	"fmt"
 	"time"
 )
 
@@ -30,14 +31,67 @@ type Reading struct {
 	Value     float32
 }
 
-func NormalizeRawMultiStat(rawStats []RawMultiStat) ([]Stat, error) {
+// MalformedStatError is returned when the arrays in a raw stat don't line up,
+// so values can't be matched with tags or times.
+type MalformedStatError struct {
+	Date string
+	// Index of the tag within the response, or -1 if the problem isn't with
+	// a single tag
+	Index  int
+	Reason string
+}
+
+func (e *MalformedStatError) Error() string {
+	if e.Index < 0 {
+		return fmt.Sprintf("Malformed stats for %s: %s", e.Date, e.Reason)
+	}
+	return fmt.Sprintf("Malformed stats for %s, tag %d: %s", e.Date, e.Index, e.Reason)
+}
+
+// checkRawMultiStat makes sure every value has a tag and time of day.
+func checkRawMultiStat(dayStat RawMultiStat) error {
+	if len(dayStat.Values) != len(dayStat.SlaveIds) {
+		return &MalformedStatError{Date: dayStat.Date, Index: -1, Reason: fmt.Sprintf("%d ids for %d sets of values", len(dayStat.SlaveIds), len(dayStat.Values))}
+	}
+	if len(dayStat.TimeOfDaySeconds) != len(dayStat.Values) {
+		return &MalformedStatError{Date: dayStat.Date, Index: -1, Reason: fmt.Sprintf("%d sets of times for %d sets of values", len(dayStat.TimeOfDaySeconds), len(dayStat.Values))}
+	}
+	for i := range dayStat.Values {
+		if len(dayStat.TimeOfDaySeconds[i]) != len(dayStat.Values[i]) {
+			return &MalformedStatError{Date: dayStat.Date, Index: i, Reason: fmt.Sprintf("%d times for %d values", len(dayStat.TimeOfDaySeconds[i]), len(dayStat.Values[i]))}
+		}
+	}
+	return nil
+}
+
+// checkRawStat makes sure every value has a time of day.  Tags without a
+// humidity sensor have no caps at all.
+func checkRawStat(dayStat RawStat) error {
+	if len(dayStat.Temperatures) != len(dayStat.TimeOfDaySeconds) {
+		return &MalformedStatError{Date: dayStat.Date, Index: -1, Reason: fmt.Sprintf("%d times for %d temperatures", len(dayStat.TimeOfDaySeconds), len(dayStat.Temperatures))}
+	}
+	if len(dayStat.Caps) != 0 && len(dayStat.Caps) != len(dayStat.TimeOfDaySeconds) {
+		return &MalformedStatError{Date: dayStat.Date, Index: -1, Reason: fmt.Sprintf("%d times for %d caps", len(dayStat.TimeOfDaySeconds), len(dayStat.Caps))}
+	}
+	return nil
+}
+
+// NormalizeRawMultiStat converts the nested arrays returned by
+// GetMultiTagStatsRaw into a Stat per tag.  Dates and times of day are in the
+// account's time zone, loc.  A MalformedStatError is returned if the arrays
+// don't line up.
+func NormalizeRawMultiStat(rawStats []RawMultiStat, loc *time.Location) ([]Stat, error) {
 	normalizedStats := []Stat{}
 
 	// Maps slave_id -> index+1 in normStats
 	deviceMap := make(map[int]int, 0)
 
 	for _, dayStat := range rawStats {
-		date, err := time.ParseInLocation(DateFormat, dayStat.Date, time.Local)
+		date, err := time.ParseInLocation(DateFormat, dayStat.Date, loc)
+		if err != nil {
+			return nil, err
+		}
+		err = checkRawMultiStat(dayStat)
 		if err != nil {
 			return nil, err
 		}
@@ -58,16 +112,113 @@ func NormalizeRawMultiStat(rawStats []RawMultiStat) ([]Stat, error) {
 
 		for deviceValueIndex, deviceValues := range dayStat.Values {
 			normalizedStatsIndex := deviceMap[dayStat.SlaveIds[deviceValueIndex]] - 1
+			var previous time.Time
 			for valueIndex, value := range deviceValues {
-				timestamp := date.Add(time.Duration(dayStat.TimeOfDaySeconds[deviceValueIndex][valueIndex]) * time.Second)
+				timestamp := WallClockTime(date, dayStat.TimeOfDaySeconds[deviceValueIndex][valueIndex], previous)
 				normalizedReading := Reading{
 					Timestamp: timestamp,
 					Value:     value,
 				}
 				normalizedStats[normalizedStatsIndex].Readings = append(normalizedStats[normalizedStatsIndex].Readings, normalizedReading)
+				previous = timestamp
 			}
 		}
 	}
 
 	return normalizedStats, nil
 }
+
+// WallClockTime returns the time when the clock read the given number of
+// seconds past midnight on date, in date's location.  Times of day from the
+// API are wall clock times, so they can't simply be added to midnight on days
+// the clocks change.
+//
+// When the clocks go back, a time of day happens twice.  The first occurrence
+// is used, unless it's before previous (the reading before this one), which
+// means the readings have already reached the repeated hour.  Times of day
+// skipped when the clocks go forward are moved forward by the size of the
+// gap.
+func WallClockTime(date time.Time, seconds int, previous time.Time) time.Time {
+	loc := date.Location()
+	year, month, day := date.Date()
+
+	// The wall clock time, as if there were no time zone at all
+	wall := time.Date(year, month, day, 0, 0, seconds, 0, time.UTC)
+
+	// The offsets either side of any change that day
+	_, offsetBefore := wall.Add(-24 * time.Hour).In(loc).Zone()
+	_, offsetAfter := wall.Add(24 * time.Hour).In(loc).Zone()
+
+	var candidates []time.Time
+	for _, offset := range []int{offsetBefore, offsetAfter} {
+		t := wall.Add(-time.Duration(offset) * time.Second).In(loc)
+		if sameWallClock(t, wall) && (len(candidates) == 0 || !t.Equal(candidates[0])) {
+			candidates = append(candidates, t)
+		}
+	}
+
+	switch len(candidates) {
+	case 0:
+		// Skipped by the clocks going forward.  Using the offset from before
+		// the change gives the time the clock would have shown had it not
+		// changed.
+		return wall.Add(-time.Duration(offsetBefore) * time.Second).In(loc)
+	case 1:
+		return candidates[0]
+	}
+
+	first, second := candidates[0], candidates[1]
+	if second.Before(first) {
+		first, second = second, first
+	}
+	if first.Before(previous) {
+		return second
+	}
+	return first
+}
+
+func sameWallClock(t, wall time.Time) bool {
+	year, month, day := t.Date()
+	wallYear, wallMonth, wallDay := wall.Date()
+	return year == wallYear && month == wallMonth && day == wallDay &&
+		t.Hour() == wall.Hour() && t.Minute() == wall.Minute() && t.Second() == wall.Second()
+}
+
+// RawStatTypes are the stats GetStatsRaw returns together, in the names used
+// by GetMultiTagStatsRaw.
+var RawStatTypes = []string{"temperature", "cap"}
+
+// NormalizeRawStat is the single tag counterpart of NormalizeRawMultiStat.
+// GetStatsRaw returns temperature and humidity in the same response, so a
+// Stat is returned for each of RawStatTypes.
+func NormalizeRawStat(slaveId int, rawStats []RawStat, loc *time.Location) (map[string]Stat, error) {
+	temperature := Stat{SlaveId: slaveId}
+	humidity := Stat{SlaveId: slaveId}
+
+	for _, dayStat := range rawStats {
+		date, err := time.ParseInLocation(DateFormat, dayStat.Date, loc)
+		if err != nil {
+			return nil, err
+		}
+		err = checkRawStat(dayStat)
+		if err != nil {
+			return nil, err
+		}
+
+		// Both stats share the same times of day
+		var previous time.Time
+		for index, seconds := range dayStat.TimeOfDaySeconds {
+			timestamp := WallClockTime(date, seconds, previous)
+			previous = timestamp
+			temperature.Readings = append(temperature.Readings, Reading{Timestamp: timestamp, Value: dayStat.Temperatures[index]})
+			if len(dayStat.Caps) > 0 {
+				humidity.Readings = append(humidity.Readings, Reading{Timestamp: timestamp, Value: dayStat.Caps[index]})
+			}
+		}
+	}
+
+	return map[string]Stat{
+		"temperature": temperature,
+		"cap":         humidity,
+	}, nil
+}
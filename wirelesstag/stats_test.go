@@ -1,6 +1,7 @@
 package wirelesstag
 
 import (
+	"errors"
 	"testing"
 	"time"
 )
@@ -36,7 +37,7 @@ func TestNormalizeRawMultiStat(t *testing.T) {
 		},
 	}
 
-	output, err := NormalizeRawMultiStat(raw)
+	output, err := NormalizeRawMultiStat(raw, time.Local)
 	if err != nil {
 		t.Fail()
 	}
@@ -96,8 +97,199 @@ func TestNormalizeRawMultiStatBadDate(t *testing.T) {
 		},
 	}
 
-	_, err := NormalizeRawMultiStat(raw)
+	_, err := NormalizeRawMultiStat(raw, time.Local)
 	if err == nil {
 		t.Fail()
 	}
 }
+
+func TestNormalizeRawStat(t *testing.T) {
+	raw := []RawStat{
+		{
+			Date:             "1/2/2006",
+			Temperatures:     []float32{20, 21},
+			Caps:             []float32{40, 41},
+			TimeOfDaySeconds: []int{0, 605},
+		},
+		{
+			Date:             "1/3/2006",
+			Temperatures:     []float32{22},
+			Caps:             []float32{42},
+			TimeOfDaySeconds: []int{60},
+		},
+	}
+
+	output, err := NormalizeRawStat(5, raw, time.Local)
+	if err != nil {
+		t.Fail()
+	}
+
+	temperature := output["temperature"]
+	if temperature.SlaveId != 5 || len(temperature.Readings) != 3 {
+		t.FailNow()
+	}
+	if temperature.Readings[1].Value != 21 {
+		t.Fail()
+	}
+	expectedTimestamp := time.Date(2006, 1, 2, 0, 10, 5, 0, time.Local)
+	if !temperature.Readings[1].Timestamp.Equal(expectedTimestamp) {
+		t.Fail()
+	}
+
+	humidity := output["cap"]
+	if len(humidity.Readings) != 3 {
+		t.FailNow()
+	}
+	expectedTimestamp = time.Date(2006, 1, 3, 0, 1, 0, 0, time.Local)
+	if humidity.Readings[2].Value != 42 || !humidity.Readings[2].Timestamp.Equal(expectedTimestamp) {
+		t.Fail()
+	}
+}
+
+func TestNormalizeRawStatBadDate(t *testing.T) {
+	_, err := NormalizeRawStat(5, []RawStat{{Date: "garbage"}}, time.Local)
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func loadTestLocation(t *testing.T, name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("Time zone %s not available: %s", name, err.Error())
+	}
+	return loc
+}
+
+func TestWallClockTime(t *testing.T) {
+	loc := loadTestLocation(t, "America/Denver")
+	date := time.Date(2021, 6, 1, 0, 0, 0, 0, loc)
+	timestamp := WallClockTime(date, 3600*14+30, time.Time{})
+	if !timestamp.Equal(time.Date(2021, 6, 1, 20, 0, 30, 0, time.UTC)) {
+		t.Fail()
+	}
+}
+
+func TestWallClockTimeClocksForward(t *testing.T) {
+	loc := loadTestLocation(t, "America/Denver")
+	// Clocks went from 2am MST to 3am MDT
+	date := time.Date(2021, 3, 14, 0, 0, 0, 0, loc)
+
+	// Not affected by the change, even though the day is an hour short
+	timestamp := WallClockTime(date, 3600*12, time.Time{})
+	if !timestamp.Equal(time.Date(2021, 3, 14, 18, 0, 0, 0, time.UTC)) {
+		t.Fail()
+	}
+
+	// 2:30 never happened, so it's moved forward to 3:30
+	timestamp = WallClockTime(date, 3600*2+1800, time.Time{})
+	if !timestamp.Equal(time.Date(2021, 3, 14, 9, 30, 0, 0, time.UTC)) {
+		t.Fail()
+	}
+}
+
+func TestWallClockTimeClocksBack(t *testing.T) {
+	loc := loadTestLocation(t, "America/Denver")
+	// Clocks went from 2am MDT back to 1am MST
+	date := time.Date(2021, 11, 7, 0, 0, 0, 0, loc)
+
+	// First time through 1:30
+	first := WallClockTime(date, 3600+1800, time.Time{})
+	if !first.Equal(time.Date(2021, 11, 7, 7, 30, 0, 0, time.UTC)) {
+		t.Fail()
+	}
+
+	// 1:10 after 1:30 must be the second time through
+	second := WallClockTime(date, 3600+600, first)
+	if !second.Equal(time.Date(2021, 11, 7, 8, 10, 0, 0, time.UTC)) {
+		t.Fail()
+	}
+
+	// Afternoon readings are an hour later than midnight plus the time of day
+	timestamp := WallClockTime(date, 3600*12, second)
+	if !timestamp.Equal(time.Date(2021, 11, 7, 19, 0, 0, 0, time.UTC)) {
+		t.Fail()
+	}
+}
+
+func TestNormalizeRawMultiStatTimeZone(t *testing.T) {
+	loc := loadTestLocation(t, "Europe/London")
+	raw := []RawMultiStat{
+		{
+			Date:             "10/31/2021",
+			SlaveIds:         []int{0},
+			Values:           [][]float32{{1, 2, 3}},
+			TimeOfDaySeconds: [][]int{{3600 + 1800, 3600 + 300, 3600 * 12}},
+		},
+	}
+
+	output, err := NormalizeRawMultiStat(raw, loc)
+	if err != nil {
+		t.FailNow()
+	}
+	expected := []time.Time{
+		time.Date(2021, 10, 31, 0, 30, 0, 0, time.UTC),
+		time.Date(2021, 10, 31, 1, 5, 0, 0, time.UTC),
+		time.Date(2021, 10, 31, 12, 0, 0, 0, time.UTC),
+	}
+	for i, reading := range output[0].Readings {
+		if !reading.Timestamp.Equal(expected[i]) {
+			t.Fail()
+		}
+	}
+}
+
+func TestNormalizeRawMultiStatRagged(t *testing.T) {
+	tests := []RawMultiStat{
+		// More values than ids
+		{
+			Date:             "1/2/2006",
+			SlaveIds:         []int{0},
+			Values:           [][]float32{{1}, {2}},
+			TimeOfDaySeconds: [][]int{{0}, {0}},
+		},
+		// Missing times for a tag
+		{
+			Date:             "1/2/2006",
+			SlaveIds:         []int{0, 1},
+			Values:           [][]float32{{1}, {2}},
+			TimeOfDaySeconds: [][]int{{0}},
+		},
+		// Fewer times than values
+		{
+			Date:             "1/2/2006",
+			SlaveIds:         []int{0, 1},
+			Values:           [][]float32{{1}, {2, 3}},
+			TimeOfDaySeconds: [][]int{{0}, {0}},
+		},
+	}
+
+	for _, raw := range tests {
+		_, err := NormalizeRawMultiStat([]RawMultiStat{raw}, time.Local)
+		var malformed *MalformedStatError
+		if !errors.As(err, &malformed) {
+			t.Fail()
+		}
+	}
+}
+
+func TestNormalizeRawStatRagged(t *testing.T) {
+	raw := RawStat{
+		Date:             "1/2/2006",
+		Temperatures:     []float32{20, 21},
+		Caps:             []float32{40},
+		TimeOfDaySeconds: []int{0, 60},
+	}
+	_, err := NormalizeRawStat(5, []RawStat{raw}, time.Local)
+	var malformed *MalformedStatError
+	if !errors.As(err, &malformed) {
+		t.Fail()
+	}
+
+	// No humidity sensor is fine
+	raw.Caps = nil
+	output, err := NormalizeRawStat(5, []RawStat{raw}, time.Local)
+	if err != nil || len(output["temperature"].Readings) != 2 || len(output["cap"].Readings) != 0 {
+		t.Fail()
+	}
+}
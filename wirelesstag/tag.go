@@ -14,4 +14,8 @@ type Tag struct {
 	Temperature      float32
 	UUID             string
 	Version1         byte
+
+	// Mac of the tag manager the tag is connected to.  Not part of the API
+	// response, but filled in by GetTagManagerTagList.
+	ManagerMac string `json:"-"`
 }